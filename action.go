@@ -3,6 +3,9 @@ package baker
 import (
 	"context"
 	"log/slog"
+	"time"
+
+	"ella.to/baker/internal/metrics"
 )
 
 type EventType int
@@ -14,8 +17,31 @@ const (
 	updateEvent
 	removeEvent
 	getEvent
+	drainEvent
+	removeDrainedEvent
 )
 
+func (e EventType) String() string {
+	switch e {
+	case pingerEvent:
+		return "pinger"
+	case addEvent:
+		return "add"
+	case updateEvent:
+		return "update"
+	case removeEvent:
+		return "remove"
+	case getEvent:
+		return "get"
+	case drainEvent:
+		return "drain"
+	case removeDrainedEvent:
+		return "remove_drained"
+	default:
+		return "unknown"
+	}
+}
+
 type Event struct {
 	Type      EventType
 	Container *Container
@@ -27,17 +53,20 @@ type Event struct {
 }
 
 type ActionRunner struct {
-	pingerCallback func()
-	addCallback    func(*Container)
-	updateCallback func(*Container, *Endpoint)
-	removeCallback func(*Container)
-	getCallback    func(string, string) (*Container, *Endpoint)
+	pingerCallback        func()
+	addCallback           func(*Container)
+	updateCallback        func(*Container, *Endpoint)
+	removeCallback        func(*Container)
+	getCallback           func(string, string) (*Container, *Endpoint)
+	drainCallback         func(*Container)
+	removeDrainedCallback func(*Container)
 
 	events chan *Event
 	close  chan struct{} // using this to make sure pushing to events stops when Close() is called
 }
 
 var _ Driver = (*ActionRunner)(nil)
+var _ Drainer = (*ActionRunner)(nil)
 
 func (ar *ActionRunner) Pinger() {
 	ar.push(&Event{Type: pingerEvent})
@@ -55,6 +84,16 @@ func (ar *ActionRunner) Remove(container *Container) {
 	ar.push(&Event{Type: removeEvent, Container: container})
 }
 
+func (ar *ActionRunner) Drain(container *Container) {
+	ar.push(&Event{Type: drainEvent, Container: container})
+}
+
+// RemoveDrained removes the container once its drain is over,
+// unless it was removed and added again in the meantime
+func (ar *ActionRunner) RemoveDrained(container *Container) {
+	ar.push(&Event{Type: removeDrainedEvent, Container: container})
+}
+
 func (ar *ActionRunner) Get(ctx context.Context, endpoint *Endpoint) (*Container, *Endpoint) {
 	evt := &Event{
 		Type:     getEvent,
@@ -65,7 +104,9 @@ func (ar *ActionRunner) Get(ctx context.Context, endpoint *Endpoint) (*Container
 		}, 1),
 	}
 
-	ar.push(evt)
+	if !ar.pushContext(ctx, evt) {
+		return nil, nil
+	}
 
 	select {
 	case r := <-evt.Result:
@@ -77,13 +118,38 @@ func (ar *ActionRunner) Get(ctx context.Context, endpoint *Endpoint) (*Container
 	}
 }
 
+// push waits while the events channel is full, as losing an event would leave a container
+// in the wrong state, e.g. a drained container which is never removed. Only the pinger
+// events are dropped, the next one pings the containers again. It must not be called
+// from the callbacks, they run on the goroutine which empties the channel.
 func (ar *ActionRunner) push(event *Event) {
+	if event.Type != pingerEvent {
+		ar.pushContext(context.Background(), event)
+		return
+	}
+
 	select {
 	case <-ar.close:
 		return
 	case ar.events <- event:
+		metrics.RunnerQueueDepth(len(ar.events))
 	default:
-		slog.Error("ActionRunner: events channel is full, dropping event")
+		slog.Error("ActionRunner: events channel is full, dropping event", "event", event.Type.String())
+		metrics.RunnerDroppedEvent(event.Type.String())
+	}
+}
+
+// pushContext waits until the event is pushed, it returns false if ctx is done
+// or the runner is closed before
+func (ar *ActionRunner) pushContext(ctx context.Context, event *Event) bool {
+	select {
+	case <-ar.close:
+		return false
+	case <-ctx.Done():
+		return false
+	case ar.events <- event:
+		metrics.RunnerQueueDepth(len(ar.events))
+		return true
 	}
 }
 
@@ -115,6 +181,18 @@ func WithRemoveCallback(callback func(*Container)) func(*ActionRunner) {
 	}
 }
 
+func WithDrainCallback(callback func(*Container)) func(*ActionRunner) {
+	return func(ar *ActionRunner) {
+		ar.drainCallback = callback
+	}
+}
+
+func WithRemoveDrainedCallback(callback func(*Container)) func(*ActionRunner) {
+	return func(ar *ActionRunner) {
+		ar.removeDrainedCallback = callback
+	}
+}
+
 func WithGetCallback(callback func(string, string) (*Container, *Endpoint)) func(*ActionRunner) {
 	return func(ar *ActionRunner) {
 		ar.getCallback = callback
@@ -145,6 +223,9 @@ func NewActionRunner(bufferSize int, cbs ...ActionCallback) *ActionRunner {
 					return
 				}
 
+				metrics.RunnerQueueDepth(len(ar.events))
+				start := time.Now()
+
 				switch event.Type {
 				case pingerEvent:
 					ar.pingerCallback()
@@ -154,6 +235,10 @@ func NewActionRunner(bufferSize int, cbs ...ActionCallback) *ActionRunner {
 					ar.updateCallback(event.Container, event.Endpoint)
 				case removeEvent:
 					ar.removeCallback(event.Container)
+				case drainEvent:
+					ar.drainCallback(event.Container)
+				case removeDrainedEvent:
+					ar.removeDrainedCallback(event.Container)
 				case getEvent:
 					container, endpoint := ar.getCallback(event.Endpoint.Domain, event.Endpoint.Path)
 					event.Result <- struct {
@@ -163,6 +248,8 @@ func NewActionRunner(bufferSize int, cbs ...ActionCallback) *ActionRunner {
 				default:
 					continue
 				}
+
+				metrics.RunnerEventDuration(event.Type.String(), time.Since(start).Seconds())
 			}
 		}
 	}()
@@ -0,0 +1,47 @@
+package baker_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"ella.to/baker"
+)
+
+func TestActionRunnerQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	drained := make(chan string, 10)
+
+	runner := baker.NewActionRunner(1,
+		baker.WithAddCallback(func(*baker.Container) {
+			<-release
+		}),
+		baker.WithDrainCallback(func(c *baker.Container) {
+			drained <- c.Id
+		}),
+	)
+	t.Cleanup(runner.Close)
+
+	// the runner is busy with the first event, the next ones fill the queue
+	runner.Add(&baker.Container{Id: "container-0"})
+
+	go func() {
+		for i := range 5 {
+			runner.Drain(&baker.Container{Id: fmt.Sprintf("container-%d", i)})
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	for i := range 5 {
+		select {
+		case id := <-drained:
+			if want := fmt.Sprintf("container-%d", i); id != want {
+				t.Errorf("expected %s to be drained, got %s", want, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the drain events not to be dropped, got %d of 5", i)
+		}
+	}
+}
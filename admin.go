@@ -0,0 +1,75 @@
+package baker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler returns the handler of the admin api, it should not be exposed
+// to the internet. Requests must send the token as a bearer token, every request
+// is refused if the token is empty.
+//
+//	GET    /maintenance                       lists the domains and paths in maintenance
+//	PUT    /maintenance                       {"domain": "...", "path": "...", "args": {...}}
+//	DELETE /maintenance?domain=...&path=...   takes the domain and path out of maintenance
+func (s *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /maintenance", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, s.Maintenances())
+	})
+
+	mux.HandleFunc("PUT /maintenance", func(w http.ResponseWriter, r *http.Request) {
+		m := &Maintenance{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(m); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid maintenance payload: "+err.Error())
+			return
+		}
+
+		if err := s.SetMaintenance(m.Domain, m.Path, m.Args); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		slog.Info("maintenance enabled", "domain", m.Domain, "path", normalizeMaintenancePath(m.Path))
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("DELETE /maintenance", func(w http.ResponseWriter, r *http.Request) {
+		domain := r.URL.Query().Get("domain")
+		path := r.URL.Query().Get("path")
+
+		if !s.RemoveMaintenance(domain, path) {
+			writeAdminError(w, http.StatusNotFound, "domain and path are not in maintenance")
+			return
+		}
+
+		slog.Info("maintenance disabled", "domain", domain, "path", normalizeMaintenancePath(path))
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, statusCode int, message string) {
+	writeAdminJSON(w, statusCode, map[string]string{"error": message})
+}
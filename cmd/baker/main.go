@@ -2,19 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"ella.to/baker"
 	"ella.to/baker/driver"
+	"ella.to/baker/internal/accesslog"
 	"ella.to/baker/internal/acme"
+	"ella.to/baker/internal/errorpage"
 	"ella.to/baker/internal/httpclient"
 	"ella.to/baker/internal/metrics"
+	"ella.to/baker/internal/requestid"
+	"ella.to/baker/internal/tracing"
 	"ella.to/baker/rule"
 )
 
@@ -36,41 +49,166 @@ Git Hash: %s
 https://ella.to/baker
 `, Version, GitCommit)
 
+	if err := run(); err != nil {
+		slog.Error("baker stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+// run starts baker and blocks until it's stopped by a signal, or one of its servers fails to start.
+// The servers, the access log and the tracer are always shut down before it returns.
+func run() error {
 	acmePath := os.Getenv("BAKER_ACME_PATH")
 	acmeEnable := strings.ToLower(os.Getenv("BAKER_ACME")) == "yes"
+	acmeHTTPRedirect := strings.ToLower(os.Getenv("BAKER_ACME_HTTP_REDIRECT")) != "no"
 	logLevel := strings.ToLower(os.Getenv("BAKER_LOG_LEVEL"))
 	bufferSize := parseInt(os.Getenv("BAKER_BUFFER_SIZE"), 100)
 	pingDuration := parseDuration(os.Getenv("BAKER_PING_DURATION"), 2*time.Second)
+	dialTimeout := parseDuration(os.Getenv("BAKER_UPSTREAM_DIAL_TIMEOUT"), 10*time.Second)
+	responseHeaderTimeout := parseDuration(os.Getenv("BAKER_UPSTREAM_RESPONSE_HEADER_TIMEOUT"), 0)
+	errorPagesFormat := strings.ToLower(os.Getenv("BAKER_ERROR_PAGES_FORMAT"))
+	errorPagesDir := os.Getenv("BAKER_ERROR_PAGES_DIR")
+	errorPagesIntercept := parseStatusCodes(os.Getenv("BAKER_ERROR_PAGES_INTERCEPT"))
+	requestIDHeader := os.Getenv("BAKER_REQUEST_ID_HEADER")
+	if requestIDHeader == "" {
+		requestIDHeader = "X-Request-Id"
+	} else if strings.ToLower(requestIDHeader) == "none" {
+		requestIDHeader = ""
+	}
+	requestIDFormat := strings.ToLower(os.Getenv("BAKER_REQUEST_ID_FORMAT"))
+	if requestIDFormat == "" {
+		requestIDFormat = requestid.FormatUUIDv7
+	}
+	accessLogPath := os.Getenv("BAKER_ACCESS_LOG")
+	accessLogFormat := strings.ToLower(os.Getenv("BAKER_ACCESS_LOG_FORMAT"))
+	accessLogFields := parseList(os.Getenv("BAKER_ACCESS_LOG_FIELDS"))
+	accessLogSampleRate := parseFloat(os.Getenv("BAKER_ACCESS_LOG_SAMPLE_RATE"), 1)
+	accessLogMaxSize := parseByteSize(os.Getenv("BAKER_ACCESS_LOG_MAX_SIZE"), 100<<20)
+	accessLogMaxBackups := parseInt(os.Getenv("BAKER_ACCESS_LOG_MAX_BACKUPS"), 5)
+	tracingEndpoint := os.Getenv("BAKER_TRACING_ENDPOINT")
+	tracingServiceName := os.Getenv("BAKER_TRACING_SERVICE_NAME")
+	if tracingServiceName == "" {
+		tracingServiceName = "baker"
+	}
+	tracingSampleRate := parseFloat(os.Getenv("BAKER_TRACING_SAMPLE_RATE"), 1)
+	tracingTrustParent := strings.ToLower(os.Getenv("BAKER_TRACING_TRUST_PARENT")) == "yes"
+	adminAddr := os.Getenv("BAKER_ADMIN_ADDR")
+	adminToken := os.Getenv("BAKER_ADMIN_TOKEN")
 	metricsAddr := os.Getenv("BAKER_METRICS_ADDR")
 	if metricsAddr == "" {
 		metricsAddr = "0.0.0.0:8089"
 	}
+	metricsMaxPaths := parseInt(os.Getenv("BAKER_METRICS_MAX_PATHS"), 1000)
+	shutdownTimeout := parseDuration(os.Getenv("BAKER_SHUTDOWN_TIMEOUT"), 30*time.Second)
+	containerDrainTimeout := parseDuration(os.Getenv("BAKER_CONTAINER_DRAIN_TIMEOUT"), 30*time.Second)
+	driverName := strings.ToLower(os.Getenv("BAKER_DRIVER"))
+	dockerHost := os.Getenv("DOCKER_HOST")
+	dockerTLSVerify := os.Getenv("DOCKER_TLS_VERIFY") != ""
+	dockerCertPath := os.Getenv("DOCKER_CERT_PATH")
+	dockerAPIVersion := os.Getenv("DOCKER_API_VERSION")
 
 	slog.SetLogLoggerLevel(parseLogLevel(logLevel))
+	setDefaultLogger()
 
 	metricsHandler := metrics.SetupHandler()
 	metrics.SetInfo(Version, GitCommit)
+	metrics.SetMaxPathLabels(metricsMaxPaths)
+
+	dockerTLS, err := newDockerTLS(dockerCertPath, dockerTLSVerify)
+	if err != nil {
+		return fmt.Errorf("failed to load docker tls config: %w", err)
+	}
 
 	dockerGetter, err := httpclient.NewClient(
-		httpclient.WithUnixSock("/var/run/docker.sock", "http://localhost"),
+		httpclient.WithDockerHost(dockerHost, dockerTLS),
+		httpclient.WithDockerAPIVersion(dockerAPIVersion),
 	)
 	if err != nil {
-		slog.Error("failed to create http client", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to create http client: %w", err)
 	}
 
-	docker := driver.NewDocker(dockerGetter)
+	var orchestrator interface {
+		RegisterDriver(baker.Driver)
+		Close()
+	}
+
+	switch driverName {
+	case "", "docker":
+		orchestrator = driver.NewDocker(dockerGetter)
+	case "swarm":
+		orchestrator = driver.NewSwarm(dockerGetter)
+	default:
+		return fmt.Errorf("unknown driver '%s'", driverName)
+	}
+	defer orchestrator.Close()
+
+	var errorPagesTemplates map[string]string
+	if errorPagesDir != "" {
+		errorPagesTemplates, err = errorpage.LoadDir(errorPagesDir)
+		if err != nil {
+			return fmt.Errorf("failed to load error pages: %w", err)
+		}
+	}
+
+	accessLog, accessLogFile, err := newAccessLog(accessLogPath, accessLogMaxSize, accessLogMaxBackups,
+		accesslog.WithFormat(accessLogFormat),
+		accesslog.WithFields(accessLogFields...),
+		accesslog.WithSampleRate(accessLogSampleRate),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create access log: %w", err)
+	}
+	if accessLogFile != nil {
+		defer accessLogFile.Close()
+	}
+
+	var tracer *tracing.Tracer
+	if tracingEndpoint != "" {
+		tracingOpts := []tracing.Option{
+			tracing.WithSampleRate(tracingSampleRate),
+		}
+		if tracingTrustParent {
+			tracingOpts = append(tracingOpts, tracing.WithTrustedParent())
+		}
+
+		tracer = tracing.New(
+			tracing.NewOTLPExporter(tracingEndpoint, tracingServiceName, nil),
+			tracingOpts...,
+		)
+
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			tracer.Shutdown(ctx)
+		}()
+	}
 
 	handler := baker.NewServer(
 		baker.WithBufferSize(bufferSize),
 		baker.WithPingDuration(pingDuration),
+		baker.WithUpstreamTimeouts(dialTimeout, responseHeaderTimeout),
+		baker.WithContainerDrainTimeout(containerDrainTimeout),
+		baker.WithRequestID(requestIDHeader, requestIDFormat),
+		baker.WithAccessLog(accessLog),
+		baker.WithTracer(tracer),
+		baker.WithErrorPages(errorPagesFormat, errorPagesTemplates, errorPagesIntercept...),
 		baker.WithRules(
 			rule.RegisterAppendPath(),
 			rule.RegisterReplacePath(),
+			rule.RegisterRewritePath(),
 			rule.RegisterRateLimiter(),
+			rule.RegisterHTTPCache(),
+			rule.RegisterCompress(),
+			rule.RegisterRedirect(),
+			rule.RegisterLimits(),
+			rule.RegisterErrorPages(),
+			rule.RegisterMaintenance(),
 		),
 	)
-	handler.RegisterDriver(docker.RegisterDriver)
+	if handler == nil {
+		return errors.New("failed to configure server")
+	}
+	handler.RegisterDriver(orchestrator.RegisterDriver)
 
 	metricsServer := http.Server{
 		Addr:    metricsAddr,
@@ -81,26 +219,106 @@ https://ella.to/baker
 
 	go func() {
 		slog.Info("starting metrics server", "addr", metricsAddr)
-		err := metricsServer.ListenAndServe()
-		if err != nil {
+		if err := listenAndServe(&metricsServer); err != nil {
 			slog.Error("failed to start metrics server", "error", err)
 		}
 	}()
 
+	if adminAddr != "" {
+		// the admin api can put any domain into maintenance, it's never served without a token
+		if adminToken == "" {
+			return fmt.Errorf("BAKER_ADMIN_TOKEN is required to start the admin server on %s", adminAddr)
+		}
+
+		adminServer := http.Server{
+			Addr:    adminAddr,
+			Handler: handler.AdminHandler(adminToken),
+		}
+
+		defer adminServer.Shutdown(context.Background())
+
+		go func() {
+			slog.Info("starting admin server", "addr", adminAddr)
+			if err := listenAndServe(&adminServer); err != nil {
+				slog.Error("failed to start admin server", "error", err)
+			}
+		}()
+	}
+
+	var servers []*http.Server
 	if acmeEnable {
 		slog.Info("starting acme server", "addr", acmePath)
-		err := acme.Start(handler, acmePath)
-		if err != nil {
-			slog.Error("failed to start acme", "error", err)
-			os.Exit(1)
-		}
+		httpServer, httpsServer := acme.NewServers(handler, acmePath, acmeHTTPRedirect)
+		servers = append(servers, httpServer, httpsServer)
 	} else {
-		slog.Info("starting server", "addr", ":80")
-		err := http.ListenAndServe(":80", handler)
-		if err != nil {
-			slog.Error("failed to start server", "error", err)
-		}
+		servers = append(servers, &http.Server{Addr: ":80", Handler: handler})
 	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			slog.Info("starting server", "addr", server.Addr)
+			errs <- listenAndServe(server)
+		}()
+	}
+
+	var serveErr error
+
+	select {
+	case <-ctx.Done():
+	case err := <-errs:
+		serveErr = fmt.Errorf("failed to start server: %w", err)
+	}
+
+	// a second signal stops baker right away
+	stop()
+
+	slog.Info("shutting down", "timeout", shutdownTimeout)
+
+	shutdown(handler, servers, shutdownTimeout)
+
+	return serveErr
+}
+
+func listenAndServe(server *http.Server) error {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// shutdown stops accepting new connections, then waits for the in-flight
+// requests to finish and closes the websocket connections, up to timeout
+func shutdown(handler *baker.Server, servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Error("failed to shutdown server", "addr", server.Addr, "error", err)
+			}
+		}()
+	}
+
+	if err := handler.Shutdown(ctx); err != nil {
+		slog.Error("failed to drain server", "error", err)
+	}
+
+	wg.Wait()
 }
 
 func parseDuration(s string, defaultValue time.Duration) time.Duration {
@@ -121,6 +339,115 @@ func parseInt(s string, defaultValue int) int {
 	return int(i)
 }
 
+// newDockerTLS returns nil if neither DOCKER_TLS_VERIFY nor DOCKER_CERT_PATH
+// is set, the certificates are loaded from ~/.docker by default
+func newDockerTLS(certPath string, verify bool) (*tls.Config, error) {
+	if !verify && certPath == "" {
+		return nil, nil
+	}
+
+	if certPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		certPath = filepath.Join(home, ".docker")
+	}
+
+	return httpclient.DockerTLSConfig(certPath, verify)
+}
+
+// newAccessLog returns nil if path is empty, path is either stdout
+// or a file which is rotated once it reaches maxSize, the file is
+// returned as well so it can be closed on shutdown
+func newAccessLog(path string, maxSize int64, maxBackups int, opts ...accesslog.Option) (*accesslog.Logger, io.Closer, error) {
+	if path == "" {
+		return nil, nil, nil
+	}
+
+	if strings.ToLower(path) == "stdout" {
+		logger, err := accesslog.New(os.Stdout, opts...)
+		return logger, nil, err
+	}
+
+	file, err := accesslog.NewRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger, err := accesslog.New(file, opts...)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return logger, file, nil
+}
+
+func parseFloat(s string, defaultValue float64) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return defaultValue
+	}
+
+	return f
+}
+
+// parseByteSize parses sizes such as 100MB or 1048576
+func parseByteSize(s string, defaultValue int64) int64 {
+	if s == "" {
+		return defaultValue
+	}
+
+	var size rule.ByteSize
+	if err := json.Unmarshal([]byte(strconv.Quote(s)), &size); err != nil {
+		return defaultValue
+	}
+
+	return int64(size)
+}
+
+// parseList parses a comma separated list, e.g. "host,path,status"
+func parseList(s string) []string {
+	var result []string
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			result = append(result, part)
+		}
+	}
+
+	return result
+}
+
+// parseStatusCodes parses a comma separated list of status codes, e.g. "502,503,504"
+func parseStatusCodes(s string) []int {
+	var codes []int
+
+	for _, part := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		codes = append(codes, code)
+	}
+
+	return codes
+}
+
+// setDefaultLogger adds the request id to the lines logged with the context of a request,
+// e.g. slog.ErrorContext(r.Context(), ...), the format of the logs stays the same
+func setDefaultLogger() {
+	// slog.SetDefault redirects the log package to the new handler, which writes through
+	// the log package again with the default handler it wraps, the output is restored
+	// so they don't wait on each other
+	out, flags := log.Writer(), log.Flags()
+	slog.SetDefault(slog.New(requestid.NewLogHandler(slog.Default().Handler())))
+	log.SetOutput(out)
+	log.SetFlags(flags)
+}
+
 func parseLogLevel(logLevel string) slog.Level {
 	switch logLevel {
 	case "debug":
@@ -3,6 +3,7 @@ package baker
 import (
 	"encoding/json"
 	"net/netip"
+	"strconv"
 	"strings"
 )
 
@@ -11,6 +12,7 @@ type Meta struct {
 		Domain  string
 		Path    string
 		Headers map[string]string
+		Rules   []Rule
 	}
 }
 
@@ -36,6 +38,31 @@ func (e *Endpoint) getHashKey() string {
 	return sb.String()
 }
 
+// getMiddlewareKey returns the key of a cached middleware, an endpoint
+// can have more than one cachable rule, so the position and type
+// of the rule are part of the key
+func (e *Endpoint) getMiddlewareKey(index int, ruleType string) string {
+	var sb strings.Builder
+
+	sb.WriteString(e.getHashKey())
+	sb.WriteString("#")
+	sb.WriteString(strconv.Itoa(index))
+	sb.WriteString(":")
+	sb.WriteString(ruleType)
+
+	return sb.String()
+}
+
+// hasRule returns true if one of the rules of the endpoint is of the given type
+func (e *Endpoint) hasRule(ruleType string) bool {
+	for _, r := range e.Rules {
+		if r.Type == ruleType {
+			return true
+		}
+	}
+	return false
+}
+
 type Rule struct {
 	Type string          `json:"type"`
 	Args json.RawMessage `json:"args"`
@@ -54,3 +81,10 @@ type Driver interface {
 	Add(*Container)
 	Remove(*Container)
 }
+
+// Drainer is implemented by the drivers which can drain a container: it stops
+// receiving new requests, and is removed once its in-flight requests and websocket
+// connections are done, or the drain timeout is reached
+type Drainer interface {
+	Drain(*Container)
+}
@@ -0,0 +1,195 @@
+package baker
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// upstreamConns tracks the in-flight requests and the websocket connections of
+// each container, so a draining container is only removed once they are done.
+// Containers without in-flight requests are not kept in the map.
+type upstreamConns struct {
+	mu         sync.Mutex
+	conns      map[string]*containerConns // containerID -> connections
+	registered map[string]struct{}        // containerID of the containers which are not removed
+}
+
+type containerConns struct {
+	requests   int
+	websockets map[*websocket.Conn]struct{}
+	onIdle     func() // set once the container is draining
+}
+
+func newUpstreamConns() *upstreamConns {
+	return &upstreamConns{
+		conns:      make(map[string]*containerConns),
+		registered: make(map[string]struct{}),
+	}
+}
+
+// acquire registers a request sent to the container, the returned function must be called once it is done
+func (u *upstreamConns) acquire(containerID string) func() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c, ok := u.conns[containerID]
+	if !ok {
+		c = &containerConns{websockets: make(map[*websocket.Conn]struct{})}
+		u.conns[containerID] = c
+	}
+	c.requests++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			u.release(containerID, c)
+		})
+	}
+}
+
+func (u *upstreamConns) release(containerID string, c *containerConns) {
+	u.mu.Lock()
+	c.requests--
+	var onIdle func()
+	if c.requests == 0 {
+		onIdle = c.onIdle
+		if u.conns[containerID] == c {
+			delete(u.conns, containerID)
+		}
+	}
+	u.mu.Unlock()
+
+	if onIdle != nil {
+		onIdle()
+	}
+}
+
+// addWebsocket registers the client side of a websocket connection proxied to the container,
+// it is closed if the container is removed before the connection is over
+func (u *upstreamConns) addWebsocket(containerID string, conn *websocket.Conn) func() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c, ok := u.conns[containerID]
+	if !ok {
+		// the websocket is part of an acquired request, it can't be missing
+		return func() {}
+	}
+	c.websockets[conn] = struct{}{}
+
+	return func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		delete(c.websockets, conn)
+	}
+}
+
+// drain calls onIdle once the container has no in-flight requests,
+// it returns false without calling it if the container has none
+func (u *upstreamConns) drain(containerID string, onIdle func()) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c, ok := u.conns[containerID]
+	if ok {
+		c.onIdle = onIdle
+	}
+
+	return ok
+}
+
+// removed is called once the container is removed, the clients still connected
+// to it with a websocket are sent a going away close frame. onIdle is called once
+// the in-flight requests are done, right away if it has none.
+func (u *upstreamConns) removed(containerID string, onIdle func()) {
+	u.mu.Lock()
+	delete(u.registered, containerID)
+	var conns []*websocket.Conn
+	c, ok := u.conns[containerID]
+	if ok {
+		// replaces the onIdle of the drain, the container is already removed
+		c.onIdle = onIdle
+		for conn := range c.websockets {
+			conns = append(conns, conn)
+		}
+	}
+	u.mu.Unlock()
+
+	if !ok {
+		onIdle()
+	}
+
+	for _, conn := range conns {
+		go closeGoingAway(conn)
+	}
+}
+
+// added is called once a container is added, a container with the same id can be
+// started again while the requests of the removed one are still in flight
+func (u *upstreamConns) added(containerID string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.registered[containerID] = struct{}{}
+	if c, ok := u.conns[containerID]; ok {
+		c.onIdle = nil
+	}
+}
+
+// record calls fn, which records the metrics of the container, unless the container was
+// removed, e.g. while it was pinged. Its metrics are already deleted, fn would create them again.
+func (u *upstreamConns) record(containerID string, fn func()) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.registered[containerID]; ok {
+		fn()
+	}
+}
+
+// drainContainer stops sending new requests to the container, and removes it
+// once its in-flight requests are done or the drain timeout is reached
+func (s *Server) drainContainer(container *Container) {
+	cInfo, ok := s.containersMap[container.Id]
+	if !ok || cInfo.draining {
+		return
+	}
+
+	cInfo.draining = true
+
+	for _, rt := range cInfo.routes {
+		s.removeRoute(container, rt)
+	}
+	cInfo.routes = nil
+
+	s.recordRoutingTable()
+
+	slog.Info("draining container", "container_id", container.Id, "timeout", s.drainTimeout)
+
+	remove := func() {
+		s.runner.RemoveDrained(cInfo.container)
+	}
+
+	if !s.upstreams.drain(container.Id, remove) {
+		// without in-flight requests, the container is removed right away
+		s.removeContainer(container)
+		return
+	}
+
+	cInfo.drainTimer = time.AfterFunc(s.drainTimeout, remove)
+}
+
+// removeDrainedContainer removes the container at the end of its drain, the timer can fire
+// after the container was removed and a new one with the same id, e.g. restarted, was added
+func (s *Server) removeDrainedContainer(container *Container) {
+	cInfo, ok := s.containersMap[container.Id]
+	if !ok || cInfo.container != container || !cInfo.draining {
+		return
+	}
+
+	s.removeContainer(container)
+}
@@ -3,11 +3,15 @@ package driver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"ella.to/baker"
 	"ella.to/baker/internal/httpclient"
@@ -17,60 +21,191 @@ type Docker struct {
 	driver baker.Driver
 	getter httpclient.GetterFunc
 	close  chan struct{}
+	known  map[string]*dockerContainer // ids of the containers added to the driver
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// dockerContainer is a container added to the driver, it's added
+// as one baker.Container for each of its services
+type dockerContainer struct {
+	healthcheck bool   // whether its routing depends on the docker health check
+	stopSignal  string // the signal sent by docker stop, e.g. 15
+	services    []*baker.Container
+}
+
+// HealthcheckDocker is the value of the baker.service.healthcheck label, the container
+// is only routed while the HEALTHCHECK of its image reports it as healthy
+const HealthcheckDocker = "docker"
+
+// errNotHealthy is returned for the containers which use the docker health check and aren't healthy
+var errNotHealthy = errors.New("container is not healthy")
+
+type Service struct {
+	Port int
+	Ping string
+
+	Static struct {
+		Domain  string
+		Path    string
+		Headers map[string]string
+		Rules   []baker.Rule
+	}
 }
 
+// maxStaticRules limits the index of the rules, so a label can't allocate a huge slice
+const maxStaticRules = 64
+
 type Label struct {
-	Enable  bool
-	Network string
-	Service struct {
-		Port int
-		Ping string
+	Enable      bool
+	Network     string
+	Healthcheck string
+	Service     Service
+	Services    map[string]*Service // services defined by baker.services.<name>.* labels
+}
+
+// parseService sets the field of the service defined by key, e.g. port or static.domain
+func parseService(s *Service, key string, value string) error {
+	var err error
+
+	switch key {
+	case "port":
+		s.Port, err = strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("failed to parse port because %s", err)
+		}
+	case "ping":
+		s.Ping = value
+	case "static.domain":
+		s.Static.Domain = value
+	case "static.path":
+		s.Static.Path = value
+	default:
+		if strings.HasPrefix(key, "static.headers.") {
+			if s.Static.Headers == nil {
+				s.Static.Headers = make(map[string]string)
+			}
+			s.Static.Headers[strings.TrimPrefix(key, "static.headers.")] = value
+		} else if strings.HasPrefix(key, "static.rules.") {
+			return parseRule(s, strings.TrimPrefix(key, "static.rules."), value)
+		} else {
+			// a typo would leave the service with a missing setting
+			return fmt.Errorf("unknown service field '%s'", key)
+		}
+	}
+
+	return nil
+}
+
+// parseRule sets the field of the rule defined by key, e.g. 0.type or 0.args
+func parseRule(s *Service, key string, value string) error {
+	index, field, _ := strings.Cut(key, ".")
+
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 || i >= maxStaticRules {
+		return fmt.Errorf("invalid rule index '%s'", index)
+	}
+
+	for len(s.Static.Rules) <= i {
+		s.Static.Rules = append(s.Static.Rules, baker.Rule{})
+	}
 
-		Static struct {
-			Domain  string
-			Path    string
-			Headers map[string]string
+	switch field {
+	case "type":
+		s.Static.Rules[i].Type = value
+	case "args":
+		if !json.Valid([]byte(value)) {
+			return fmt.Errorf("args of rule %d is not a valid json", i)
 		}
+		s.Static.Rules[i].Args = json.RawMessage(value)
+	default:
+		return fmt.Errorf("unknown field '%s' of rule %d", field, i)
 	}
+
+	return nil
 }
 
-func parseLabels(labels map[string]string) (*Label, error) {
-	var err error
+// validateRules makes sure the rules have no gap, and sets
+// the missing args to an empty object
+func validateRules(s *Service) error {
+	for i := range s.Static.Rules {
+		if s.Static.Rules[i].Type == "" {
+			return fmt.Errorf("type of rule %d is not set", i)
+		}
 
+		if s.Static.Rules[i].Args == nil {
+			s.Static.Rules[i].Args = json.RawMessage("{}")
+		}
+	}
+
+	if len(s.Static.Rules) > 0 && s.Static.Domain == "" {
+		return fmt.Errorf("rules are only supported with a static domain")
+	}
+
+	return nil
+}
+
+func parseLabels(labels map[string]string) (*Label, error) {
 	l := &Label{}
 
 	for key, value := range labels {
-		switch key {
-		case "baker.enable":
+		switch {
+		case key == "baker.enable":
 			l.Enable = strings.ToLower(value) == "true"
-		case "baker.network":
+		case key == "baker.network":
 			l.Network = value
-		case "baker.service.port":
-			l.Service.Port, err = strconv.Atoi(value)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse port because %s", err)
+		case key == "baker.service.healthcheck":
+			l.Healthcheck = strings.ToLower(value)
+			if l.Healthcheck != HealthcheckDocker {
+				return nil, fmt.Errorf("unsupported healthcheck '%s'", value)
+			}
+		case strings.HasPrefix(key, "baker.service."):
+			if err := parseService(&l.Service, strings.TrimPrefix(key, "baker.service."), value); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(key, "baker.services."):
+			name, field, ok := strings.Cut(strings.TrimPrefix(key, "baker.services."), ".")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("invalid label '%s'", key)
+			}
+
+			if l.Services == nil {
+				l.Services = make(map[string]*Service)
 			}
 
-		case "baker.service.ping":
-			l.Service.Ping = value
-		case "baker.service.static.domain":
-			l.Service.Static.Domain = value
-		case "baker.service.static.path":
-			l.Service.Static.Path = value
-		default:
-			if strings.HasPrefix(key, "baker.service.static.headers.") {
-				if l.Service.Static.Headers == nil {
-					l.Service.Static.Headers = make(map[string]string)
-				}
-				l.Service.Static.Headers[strings.TrimPrefix(key, "baker.service.static.headers.")] = value
+			service, ok := l.Services[name]
+			if !ok {
+				service = &Service{}
+				l.Services[name] = service
+			}
+
+			if err := parseService(service, field, value); err != nil {
+				return nil, fmt.Errorf("failed to parse service '%s': %w", name, err)
 			}
 		}
 	}
 
+	if err := validateRules(&l.Service); err != nil {
+		return nil, err
+	}
+
+	for name, service := range l.Services {
+		if service.Port == 0 {
+			return nil, fmt.Errorf("label 'baker.services.%s.port' is not set", name)
+		}
+
+		if err := validateRules(service); err != nil {
+			return nil, fmt.Errorf("failed to parse service '%s': %w", name, err)
+		}
+	}
+
 	return l, nil
 }
 
-func (d *Docker) loadContainerById(ctx context.Context, id string) (*baker.Container, error) {
+// loadContainerById returns a baker.Container for each service of the container, errNotHealthy is returned
+// if its routing depends on the docker health check and the container is not healthy yet
+func (d *Docker) loadContainerById(ctx context.Context, id string) (*dockerContainer, error) {
 	r, _, err := d.getter(ctx, "/containers/"+id+"/json")
 	if err != nil {
 		return nil, err
@@ -79,8 +214,14 @@ func (d *Docker) loadContainerById(ctx context.Context, id string) (*baker.Conta
 
 	payload := struct {
 		Config struct {
-			Labels map[string]string `json:"Labels"`
+			Labels     map[string]string `json:"Labels"`
+			StopSignal string            `json:"StopSignal"` // empty if the default SIGTERM is used
 		} `json:"Config"`
+		State struct {
+			Health *struct {
+				Status string `json:"Status"`
+			} `json:"Health"`
+		} `json:"State"`
 		NetworkSettings struct {
 			Networks map[string]struct {
 				IPAddress string `json:"IPAddress"`
@@ -103,115 +244,283 @@ func (d *Docker) loadContainerById(ctx context.Context, id string) (*baker.Conta
 		return nil, fmt.Errorf("label 'baker.enable' is not set to true")
 	}
 
+	healthcheck := labels.Healthcheck == HealthcheckDocker
+	if healthcheck {
+		if payload.State.Health == nil {
+			return nil, fmt.Errorf("container '%s' has no HEALTHCHECK", id)
+		}
+
+		if payload.State.Health.Status != "healthy" {
+			return nil, errNotHealthy
+		}
+	}
+
 	network, ok := payload.NetworkSettings.Networks[labels.Network]
 	if !ok {
 		return nil, fmt.Errorf("network '%s' not exists in labels", labels.Network)
 	}
 
-	var addr netip.AddrPort
+	containers, err := newContainers(id, network.IPAddress, labels)
+	if err != nil {
+		return nil, err
+	}
 
-	if network.IPAddress != "" {
-		addr, err = netip.ParseAddrPort(fmt.Sprintf("%s:%d", network.IPAddress, labels.Service.Port))
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse address for container '%s' because %s", id, err)
-		}
+	stopSignal := "SIGTERM"
+	if payload.Config.StopSignal != "" {
+		stopSignal = payload.Config.StopSignal
 	}
 
-	slog.Debug("docker driver loaded container", "id", id, "addr", addr, "config", labels.Service.Ping)
+	return &dockerContainer{
+		healthcheck: healthcheck,
+		stopSignal:  normalizeSignal(stopSignal),
+		services:    containers,
+	}, nil
+}
+
+// newContainers returns a baker.Container for each service defined by the labels, id
+// is the id of the container, or the task, and ip its address on the baker network
+func newContainers(id string, ip string, labels *Label) ([]*baker.Container, error) {
+	var err error
 
-	container := &baker.Container{
-		Id:         id,
-		Addr:       addr,
-		ConfigPath: labels.Service.Ping,
+	// the baker.service.* labels are kept for the containers with a single service,
+	// the container id is used as is to identify it
+	services := map[string]*Service{}
+	if len(labels.Services) == 0 || labels.Service.Port != 0 {
+		services[id] = &labels.Service
+	}
+	for name, service := range labels.Services {
+		services[id+"/"+name] = service
 	}
 
-	container.Meta.Static.Domain = labels.Service.Static.Domain
-	container.Meta.Static.Path = labels.Service.Static.Path
-	container.Meta.Static.Headers = labels.Service.Static.Headers
+	containers := make([]*baker.Container, 0, len(services))
 
-	return container, nil
+	for _, serviceId := range slices.Sorted(maps.Keys(services)) {
+		service := services[serviceId]
+
+		var addr netip.AddrPort
+
+		if ip != "" {
+			addr, err = netip.ParseAddrPort(fmt.Sprintf("%s:%d", ip, service.Port))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse address for container '%s' because %s", serviceId, err)
+			}
+		}
+
+		slog.Debug("docker driver loaded container", "id", serviceId, "addr", addr, "config", service.Ping)
+
+		container := &baker.Container{
+			Id:         serviceId,
+			Addr:       addr,
+			ConfigPath: service.Ping,
+		}
+
+		container.Meta.Static.Domain = service.Static.Domain
+		container.Meta.Static.Path = service.Static.Path
+		container.Meta.Static.Headers = service.Static.Headers
+		container.Meta.Static.Rules = service.Static.Rules
+
+		containers = append(containers, container)
+	}
+
+	return containers, nil
 }
 
-func (d *Docker) loadCurrentContainers(ctx context.Context) {
+// reconcile lists the running containers, adds the ones the driver doesn't know
+// yet and removes the ones which are gone, e.g. while the event stream was down
+func (d *Docker) reconcile(ctx context.Context) error {
 	r, _, err := d.getter(ctx, "/containers/json")
 	if err != nil {
-		slog.Error("failed to get containers", "error", err)
-		return
+		return fmt.Errorf("failed to get containers: %w", err)
 	}
 	defer r.Close()
 
 	events := []struct {
-		ID    string `json:"Id"`
-		State string `json:"State"`
+		ID     string `json:"Id"`
+		State  string `json:"State"`
+		Status string `json:"Status"` // e.g. Up 5 minutes (healthy)
 	}{}
 
 	err = json.NewDecoder(r).Decode(&events)
 	if err != nil {
-		slog.Error("failed to decode containers", "error", err)
-		return
+		return fmt.Errorf("failed to decode containers: %w", err)
 	}
 
-	for _, event := range events {
-		var container *baker.Container
+	running := make(map[string]struct{}, len(events))
 
+	for _, event := range events {
 		if event.State != "running" {
 			continue
 		}
 
-		slog.Debug("docker driver received current event", "id", event.ID, "state", event.State)
+		// a container which became unhealthy while the event stream was down
+		if known, ok := d.known[event.ID]; ok && known.healthcheck && !strings.Contains(event.Status, "(healthy)") {
+			slog.Debug("docker driver removed unhealthy container", "id", event.ID)
+			d.remove(event.ID)
+			continue
+		}
 
-		container, err := d.loadContainerById(ctx, event.ID)
-		if err != nil {
-			slog.Error("failed to load container", "id", event.ID, "error", err)
+		running[event.ID] = struct{}{}
+
+		if _, ok := d.known[event.ID]; ok {
 			continue
 		}
 
-		d.driver.Add(container)
+		slog.Debug("docker driver received current event", "id", event.ID, "state", event.State)
+
+		d.add(ctx, event.ID)
+	}
+
+	for id := range d.known {
+		if _, ok := running[id]; !ok {
+			slog.Debug("docker driver removed missing container", "id", id)
+			d.remove(id)
+		}
 	}
+
+	return nil
 }
 
-func (d *Docker) loadFutureContainers(ctx context.Context) {
-	r, _, err := d.getter(ctx, "/events")
+func (d *Docker) add(ctx context.Context, id string) {
+	container, err := d.loadContainerById(ctx, id)
+	if errors.Is(err, errNotHealthy) {
+		slog.Debug("docker driver is waiting for the container to be healthy", "id", id)
+		return
+	}
 	if err != nil {
+		slog.Error("failed to load container", "id", id, "error", err)
+		return
+	}
+
+	d.known[id] = container
+	for _, service := range container.services {
+		d.driver.Add(service)
+	}
+}
+
+func (d *Docker) remove(id string) {
+	known, ok := d.known[id]
+	if !ok {
 		return
 	}
+
+	delete(d.known, id)
+	for _, service := range known.services {
+		d.driver.Remove(service)
+	}
+}
+
+// watch opens the event stream, reconciles the containers and then follows the events
+// until the stream fails. It returns false if the stream couldn't be opened.
+func (d *Docker) watch(ctx context.Context) bool {
+	r, statusCode, err := d.getter(ctx, "/events")
+	if err != nil {
+		slog.Error("failed to get events", "error", err)
+		return false
+	}
 	defer r.Close()
 
+	if statusCode >= 400 {
+		slog.Error("failed to get events", "status_code", statusCode)
+		return false
+	}
+
+	// the containers are listed once the stream is open, the
+	// events which happen in between are not lost
+	if err := d.reconcile(ctx); err != nil {
+		slog.Error("failed to reconcile containers", "error", err)
+		return false
+	}
+
 	decoder := json.NewDecoder(r)
 
 	event := struct {
 		ID     string `json:"id"`
 		Status string `json:"status"`
+		Action string `json:"Action"`
+		Actor  struct {
+			Attributes map[string]string `json:"Attributes"`
+		} `json:"Actor"`
 	}{}
 
 	for {
 		event.ID = ""
 		event.Status = ""
+		event.Action = ""
+		event.Actor.Attributes = nil
 
+		// the stream can't be decoded past an error, it has to be opened again
 		if err := decoder.Decode(&event); err != nil {
-			slog.Error("failed to decode event", "error", err)
-			continue
+			if ctx.Err() == nil {
+				slog.Error("docker event stream failed", "error", err)
+			}
+			return true
+		}
+
+		// status is deprecated in favor of Action
+		if event.Status == "" {
+			event.Status = event.Action
 		}
 
 		slog.Debug("docker driver received future event", "id", event.ID, "status", event.Status)
 
-		if event.Status == "die" {
-			d.driver.Remove(&baker.Container{Id: event.ID})
-			continue
-		}
+		switch event.Status {
+		case "die":
+			d.remove(event.ID)
+		case "kill":
+			// docker stop sends a kill event with the stop signal of the container before it dies,
+			// it stops receiving new requests while it finishes the in-flight ones. The other
+			// signals, e.g. SIGHUP to reload the config, don't necessarily stop the container.
+			drainer, ok := d.driver.(baker.Drainer)
+			known, found := d.known[event.ID]
+			if !ok || !found || normalizeSignal(event.Actor.Attributes["signal"]) != known.stopSignal {
+				continue
+			}
 
-		if event.Status != "die" && event.Status != "start" {
-			continue
-		}
+			for _, service := range known.services {
+				drainer.Drain(service)
+			}
+		case "start":
+			if _, ok := d.known[event.ID]; ok {
+				// already added by reconcile
+				continue
+			}
 
-		container, err := d.loadContainerById(ctx, event.ID)
-		if err != nil {
-			slog.Error("failed to load container", "id", event.ID, "error", err)
-			continue
+			d.add(ctx, event.ID)
+		case "health_status: healthy":
+			if _, ok := d.known[event.ID]; !ok {
+				d.add(ctx, event.ID)
+			}
+		case "health_status: unhealthy":
+			if known, ok := d.known[event.ID]; ok && known.healthcheck {
+				slog.Warn("docker driver removed unhealthy container", "id", event.ID)
+				d.remove(event.ID)
+			}
 		}
+	}
+}
+
+// signalNumbers are the linux numbers of the signals usually used to stop a container
+var signalNumbers = map[string]string{
+	"HUP":   "1",
+	"INT":   "2",
+	"QUIT":  "3",
+	"KILL":  "9",
+	"USR1":  "10",
+	"USR2":  "12",
+	"TERM":  "15",
+	"WINCH": "28",
+	"PWR":   "30",
+}
 
-		d.driver.Add(container)
+// normalizeSignal returns the number of the signal, the events have the number of the
+// signal, e.g. 15, and the config of the container its name, e.g. SIGTERM or TERM
+func normalizeSignal(signal string) string {
+	name := strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+	if number, ok := signalNumbers[name]; ok {
+		return number
 	}
+
+	return signal
 }
 
 func (d *Docker) run() {
@@ -221,8 +530,7 @@ func (d *Docker) run() {
 		cancel()
 	}()
 
-	d.loadCurrentContainers(ctx)
-	d.loadFutureContainers(ctx)
+	reconnect(ctx, "docker", d.watch, d.minBackoff, d.maxBackoff)
 }
 
 func (d *Docker) Close() {
@@ -240,7 +548,10 @@ func (d *Docker) RegisterDriver(driver baker.Driver) {
 
 func NewDocker(getter httpclient.Getter) *Docker {
 	return &Docker{
-		getter: getter.Get,
-		close:  make(chan struct{}),
+		getter:     getter.Get,
+		close:      make(chan struct{}),
+		known:      make(map[string]*dockerContainer),
+		minBackoff: 500 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
 	}
 }
@@ -0,0 +1,510 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ella.to/baker"
+	"ella.to/baker/internal/httpclient"
+)
+
+// fakeDocker is a stand-in for the Docker API, the event stream
+// can be broken to check that the driver reconnects and resyncs
+type fakeDocker struct {
+	mu      sync.Mutex
+	running []string
+	health  map[string]string            // containers with a HEALTHCHECK -> their status
+	labels  map[string]map[string]string // labels of the containers, the default ones are used if not set
+	signals map[string]string            // containers with a STOPSIGNAL -> their signal
+	events  chan string
+	streams int
+}
+
+func newFakeDocker(running ...string) *fakeDocker {
+	return &fakeDocker{
+		running: running,
+		health:  make(map[string]string),
+		labels:  make(map[string]map[string]string),
+		signals: make(map[string]string),
+		events:  make(chan string, 10),
+	}
+}
+
+func (f *fakeDocker) setLabels(id string, labels map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.labels[id] = labels
+}
+
+func (f *fakeDocker) setHealth(id string, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.health[id] = status
+}
+
+func (f *fakeDocker) setStopSignal(id string, signal string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.signals[id] = signal
+}
+
+func (f *fakeDocker) setRunning(ids ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.running = ids
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/containers/json":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		containers := []map[string]string{}
+		for _, id := range f.running {
+			status := "Up 5 minutes"
+			if health, ok := f.health[id]; ok {
+				status += " (" + health + ")"
+			}
+			containers = append(containers, map[string]string{"Id": id, "State": "running", "Status": status})
+		}
+		json.NewEncoder(w).Encode(containers)
+
+	case strings.HasPrefix(r.URL.Path, "/containers/"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+
+		f.mu.Lock()
+		health, ok := f.health[id]
+		labels := f.labels[id]
+		signal := f.signals[id]
+		f.mu.Unlock()
+
+		if labels == nil {
+			labels = map[string]string{"baker.enable": "true", "baker.network": "baker", "baker.service.port": "8000", "baker.service.ping": "/config"}
+		}
+
+		state := `{"Status": "running"}`
+		if ok {
+			labels = maps.Clone(labels)
+			labels["baker.service.healthcheck"] = "docker"
+			state = fmt.Sprintf(`{"Status": "running", "Health": {"Status": %q}}`, health)
+		}
+
+		encoded, _ := json.Marshal(labels)
+
+		fmt.Fprintf(w, `{
+			"Id": %q,
+			"Config": {"Labels": %s, "StopSignal": %q},
+			"State": %s,
+			"NetworkSettings": {"Networks": {"baker": {"IPAddress": "10.0.0.2"}}}
+		}`, id, encoded, signal, state)
+
+	case r.URL.Path == "/events":
+		f.mu.Lock()
+		f.streams++
+		f.mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-f.events:
+				// an empty event breaks the stream
+				if !ok || event == "" {
+					return
+				}
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			}
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeDocker) streamCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.streams
+}
+
+// recorder is a baker.Driver which keeps the running containers
+type recorder struct {
+	mu         sync.Mutex
+	containers map[string]*baker.Container
+	drained    []string
+}
+
+func (r *recorder) Add(c *baker.Container) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.containers[c.Id] = c
+}
+
+func (r *recorder) Remove(c *baker.Container) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.containers, c.Id)
+}
+
+func (r *recorder) Drain(c *baker.Container) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.drained = append(r.drained, c.Id)
+}
+
+func (r *recorder) ids() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]string, 0, len(r.containers))
+	for id := range r.containers {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDockerReconnect(t *testing.T) {
+	fake := newFakeDocker("a", "b")
+	fake.setStopSignal("b", "SIGQUIT")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	getter, err := httpclient.NewClient(httpclient.WithHttpClient(http.DefaultClient, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docker := NewDocker(getter)
+	docker.minBackoff = 10 * time.Millisecond
+	docker.maxBackoff = 50 * time.Millisecond
+	defer docker.Close()
+
+	rec := &recorder{containers: make(map[string]*baker.Container)}
+	docker.RegisterDriver(rec)
+
+	waitFor(t, "the running containers", func() bool {
+		return slices.Equal(rec.ids(), []string{"a", "b"})
+	})
+
+	rec.mu.Lock()
+	addr := rec.containers["a"].Addr.String()
+	rec.mu.Unlock()
+
+	if addr != "10.0.0.2:8000" {
+		t.Fatalf("unexpected address %s", addr)
+	}
+
+	fake.setRunning("a", "b", "c")
+	fake.events <- `{"id": "c", "status": "start"}`
+
+	waitFor(t, "the started container", func() bool {
+		return slices.Equal(rec.ids(), []string{"a", "b", "c"})
+	})
+
+	// only the stop signal of the container drains it, the other signals, e.g. to
+	// reload its config, don't necessarily stop it
+	fake.events <- `{"id": "a", "status": "kill", "Actor": {"Attributes": {"signal": "SIGHUP"}}}`
+	fake.events <- `{"id": "a", "status": "kill", "Actor": {"Attributes": {"signal": "2"}}}`
+	fake.events <- `{"id": "b", "status": "kill", "Actor": {"Attributes": {"signal": "3"}}}`
+	fake.events <- `{"id": "c", "status": "kill", "Actor": {"Attributes": {"signal": "15"}}}`
+
+	waitFor(t, "the stopped containers to be drained", func() bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return slices.Equal(rec.drained, []string{"b", "c"})
+	})
+
+	// the stream breaks, and the containers change while the driver is disconnected
+	fake.setRunning("a", "d")
+	fake.events <- ""
+
+	waitFor(t, "the driver to resync", func() bool {
+		return slices.Equal(rec.ids(), []string{"a", "d"})
+	})
+
+	if fake.streamCount() != 2 {
+		t.Fatalf("expected the driver to open the event stream twice, got %d", fake.streamCount())
+	}
+
+	// the events of the new stream are followed
+	fake.events <- `{"id": "d", "status": "die"}`
+
+	waitFor(t, "the dead container", func() bool {
+		return slices.Equal(rec.ids(), []string{"a"})
+	})
+}
+
+func TestDockerBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var attempts []time.Time
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			mu.Lock()
+			attempts = append(attempts, time.Now())
+			mu.Unlock()
+		}
+
+		// docker is up but not answering properly
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	getter, err := httpclient.NewClient(httpclient.WithHttpClient(http.DefaultClient, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docker := NewDocker(getter)
+	docker.minBackoff = 20 * time.Millisecond
+	docker.maxBackoff = 80 * time.Millisecond
+	defer docker.Close()
+
+	docker.RegisterDriver(&recorder{containers: make(map[string]*baker.Container)})
+
+	waitFor(t, "the reconnection attempts", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(attempts) >= 5
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// 20ms, 40ms, 80ms, 80ms
+	if gap := attempts[4].Sub(attempts[3]); gap < 70*time.Millisecond {
+		t.Fatalf("expected the backoff to grow up to the max, last gap was %s", gap)
+	}
+}
+
+func TestDockerHealthcheck(t *testing.T) {
+	fake := newFakeDocker("a", "b")
+	fake.setHealth("b", "starting")
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	getter, err := httpclient.NewClient(httpclient.WithHttpClient(http.DefaultClient, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docker := NewDocker(getter)
+	docker.minBackoff = 10 * time.Millisecond
+	docker.maxBackoff = 50 * time.Millisecond
+	defer docker.Close()
+
+	rec := &recorder{containers: make(map[string]*baker.Container)}
+	docker.RegisterDriver(rec)
+
+	// b is not routed until it's healthy
+	waitFor(t, "the running containers", func() bool {
+		return slices.Equal(rec.ids(), []string{"a"})
+	})
+
+	fake.setHealth("b", "healthy")
+	fake.events <- `{"id": "b", "Action": "health_status: healthy"}`
+
+	waitFor(t, "the healthy container", func() bool {
+		return slices.Equal(rec.ids(), []string{"a", "b"})
+	})
+
+	fake.setHealth("b", "unhealthy")
+	fake.events <- `{"id": "b", "Action": "health_status: unhealthy"}`
+
+	waitFor(t, "the unhealthy container to be removed", func() bool {
+		return slices.Equal(rec.ids(), []string{"a"})
+	})
+
+	// recovers while the driver is disconnected
+	fake.setHealth("b", "healthy")
+	fake.events <- ""
+
+	waitFor(t, "the driver to resync the healthy container", func() bool {
+		return slices.Equal(rec.ids(), []string{"a", "b"})
+	})
+
+	// becomes unhealthy while the driver is disconnected
+	fake.setHealth("b", "unhealthy")
+	fake.events <- ""
+
+	waitFor(t, "the driver to resync the unhealthy container", func() bool {
+		return slices.Equal(rec.ids(), []string{"a"})
+	})
+}
+
+func TestParseHealthcheckLabel(t *testing.T) {
+	labels := map[string]string{"baker.enable": "true", "baker.service.healthcheck": "Docker"}
+
+	l, err := parseLabels(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Healthcheck != HealthcheckDocker {
+		t.Fatalf("unexpected healthcheck %q", l.Healthcheck)
+	}
+
+	labels["baker.service.healthcheck"] = "http"
+	if _, err := parseLabels(labels); err == nil {
+		t.Fatal("expected an error for an unsupported healthcheck")
+	}
+}
+
+func TestDockerServices(t *testing.T) {
+	fake := newFakeDocker("a")
+	fake.setLabels("a", map[string]string{
+		"baker.enable":                             "true",
+		"baker.network":                            "baker",
+		"baker.services.api.port":                  "8000",
+		"baker.services.api.ping":                  "/config",
+		"baker.services.admin.port":                "9000",
+		"baker.services.admin.static.domain":       "admin.example.com",
+		"baker.services.admin.static.path":         "/*",
+		"baker.services.admin.static.headers.host": "admin.example.com",
+	})
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	getter, err := httpclient.NewClient(httpclient.WithHttpClient(http.DefaultClient, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docker := NewDocker(getter)
+	defer docker.Close()
+
+	rec := &recorder{containers: make(map[string]*baker.Container)}
+	docker.RegisterDriver(rec)
+
+	waitFor(t, "a container for each service", func() bool {
+		return slices.Equal(rec.ids(), []string{"a/admin", "a/api"})
+	})
+
+	rec.mu.Lock()
+	api, admin := rec.containers["a/api"], rec.containers["a/admin"]
+	rec.mu.Unlock()
+
+	if api.Addr.String() != "10.0.0.2:8000" || api.ConfigPath != "/config" {
+		t.Errorf("unexpected api service %+v", api)
+	}
+
+	if admin.Addr.String() != "10.0.0.2:9000" || admin.Meta.Static.Domain != "admin.example.com" || admin.Meta.Static.Headers["host"] != "admin.example.com" {
+		t.Errorf("unexpected admin service %+v", admin)
+	}
+
+	// all the services are drained and removed with the container
+	fake.events <- `{"id": "a", "status": "kill", "Actor": {"Attributes": {"signal": "SIGTERM"}}}`
+
+	waitFor(t, "the services to be drained", func() bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return len(rec.drained) == 2
+	})
+
+	fake.events <- `{"id": "a", "status": "die"}`
+
+	waitFor(t, "the services to be removed", func() bool {
+		return len(rec.ids()) == 0
+	})
+}
+
+func TestParseServiceLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+	}{
+		{name: "missing port", labels: map[string]string{"baker.services.api.ping": "/config"}},
+		{name: "invalid port", labels: map[string]string{"baker.services.api.port": "http"}},
+		{name: "missing name", labels: map[string]string{"baker.services..port": "8000"}},
+		{name: "missing field", labels: map[string]string{"baker.services.api": "8000"}},
+		{name: "unknown field", labels: map[string]string{"baker.services.api.port": "8000", "baker.services.api.pong": "/config"}},
+		{name: "unknown static field", labels: map[string]string{"baker.services.api.port": "8000", "baker.services.api.static.domian": "example.com"}},
+		{name: "unknown field of the default service", labels: map[string]string{"baker.service.port": "8000", "baker.service.prot": "8001"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseLabels(tt.labels); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestParseRuleLabels(t *testing.T) {
+	l, err := parseLabels(map[string]string{
+		"baker.service.static.domain":       "example.com",
+		"baker.service.static.rules.1.type": "ReplacePath",
+		"baker.service.static.rules.1.args": `{"search":"/api","replace":"","times":1}`,
+		"baker.service.static.rules.0.type": "RateLimiter",
+		"baker.service.static.rules.0.args": `{"request_limit":10,"window_duration":"1s"}`,
+		"baker.service.static.rules.2.type": "Maintenance",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := l.Service.Static.Rules
+	if len(rules) != 3 || rules[0].Type != "RateLimiter" || rules[1].Type != "ReplacePath" || rules[2].Type != "Maintenance" {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+
+	if string(rules[1].Args) != `{"search":"/api","replace":"","times":1}` || string(rules[2].Args) != "{}" {
+		t.Fatalf("unexpected args %s and %s", rules[1].Args, rules[2].Args)
+	}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+	}{
+		{name: "gap", labels: map[string]string{"baker.service.static.domain": "example.com", "baker.service.static.rules.1.type": "Maintenance"}},
+		{name: "invalid index", labels: map[string]string{"baker.service.static.domain": "example.com", "baker.service.static.rules.x.type": "Maintenance"}},
+		{name: "large index", labels: map[string]string{"baker.service.static.domain": "example.com", "baker.service.static.rules.1000000.type": "Maintenance"}},
+		{name: "invalid args", labels: map[string]string{"baker.service.static.domain": "example.com", "baker.service.static.rules.0.type": "Maintenance", "baker.service.static.rules.0.args": "{"}},
+		{name: "unknown field", labels: map[string]string{"baker.service.static.domain": "example.com", "baker.service.static.rules.0.kind": "Maintenance"}},
+		{name: "not static", labels: map[string]string{"baker.service.static.rules.0.type": "Maintenance"}},
+		{name: "service", labels: map[string]string{"baker.services.api.port": "8000", "baker.services.api.static.domain": "example.com", "baker.services.api.static.rules.1.type": "Maintenance"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseLabels(tt.labels); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
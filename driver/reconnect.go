@@ -0,0 +1,37 @@
+package driver
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"ella.to/baker/internal/metrics"
+)
+
+// reconnect calls watch until ctx is done. watch follows the event stream of the orchestrator and
+// returns false if it couldn't be opened, the wait between the attempts grows up to maxBackoff
+// as long as the orchestrator can't be reached, and is reset once it's connected.
+func reconnect(ctx context.Context, name string, watch func(context.Context) bool, minBackoff time.Duration, maxBackoff time.Duration) {
+	backoff := minBackoff
+
+	for {
+		connected := watch(ctx)
+
+		if connected {
+			backoff = minBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if !connected {
+			backoff = min(backoff*2, maxBackoff)
+		}
+
+		slog.Warn("driver reconnecting to the event stream", "driver", name)
+		metrics.DriverReconnect(name)
+	}
+}
@@ -0,0 +1,346 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"ella.to/baker"
+	"ella.to/baker/internal/httpclient"
+)
+
+// Swarm discovers the tasks of the Swarm services which have the baker labels. Each running
+// task is added with its address on the overlay network, so the tasks of every node are routed.
+//
+// The events of the tasks running on the other nodes are not sent by docker, the tasks are
+// listed again on every service or container event, and every poll interval.
+type Swarm struct {
+	driver baker.Driver
+	getter httpclient.GetterFunc
+	close  chan struct{}
+	known  map[string]*swarmTask // ids of the tasks added to the driver
+
+	pollInterval time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+}
+
+// swarmTask is a task added to the driver, it's added
+// as one baker.Container for each of its services
+type swarmTask struct {
+	draining bool
+	services []*baker.Container
+}
+
+// swarmEventsFilter limits the event stream to the events which change the tasks
+var swarmEventsFilter = url.QueryEscape(`{"type":["service","container"],"event":["create","update","remove","start","kill","die"]}`)
+
+// swarmTasksFilter lists the running tasks, and the ones which are being shut down so they can be drained
+var swarmTasksFilter = url.QueryEscape(`{"desired-state":["running","shutdown"]}`)
+
+// loadServices returns the labels of the services which are enabled
+func (s *Swarm) loadServices(ctx context.Context) (map[string]*Label, error) {
+	r, statusCode, err := s.getter(ctx, "/services")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get services: %w", err)
+	}
+	defer r.Close()
+
+	if statusCode >= 400 {
+		return nil, fmt.Errorf("failed to get services, status code %d", statusCode)
+	}
+
+	payload := []struct {
+		ID   string `json:"ID"`
+		Spec struct {
+			Name   string            `json:"Name"`
+			Labels map[string]string `json:"Labels"`
+		} `json:"Spec"`
+	}{}
+
+	err = json.NewDecoder(r).Decode(&payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode services: %w", err)
+	}
+
+	services := make(map[string]*Label, len(payload))
+
+	for _, service := range payload {
+		labels, err := parseLabels(service.Spec.Labels)
+		if err != nil {
+			slog.Error("failed to parse labels", "service", service.Spec.Name, "error", err)
+			continue
+		}
+
+		if !labels.Enable {
+			continue
+		}
+
+		services[service.ID] = labels
+	}
+
+	return services, nil
+}
+
+type task struct {
+	ID           string `json:"ID"`
+	ServiceID    string `json:"ServiceID"`
+	DesiredState string `json:"DesiredState"`
+	Status       struct {
+		State string `json:"State"`
+	} `json:"Status"`
+	NetworksAttachments []struct {
+		Network struct {
+			Spec struct {
+				Name string `json:"Name"`
+			} `json:"Spec"`
+		} `json:"Network"`
+		Addresses []string `json:"Addresses"` // e.g. 10.0.1.5/24
+	} `json:"NetworksAttachments"`
+}
+
+func (s *Swarm) loadTasks(ctx context.Context) ([]task, error) {
+	r, statusCode, err := s.getter(ctx, "/tasks?filters="+swarmTasksFilter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tasks: %w", err)
+	}
+	defer r.Close()
+
+	if statusCode >= 400 {
+		return nil, fmt.Errorf("failed to get tasks, status code %d", statusCode)
+	}
+
+	tasks := []task{}
+
+	err = json.NewDecoder(r).Decode(&tasks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tasks: %w", err)
+	}
+
+	return tasks, nil
+}
+
+// reconcile lists the tasks of the services, adds the running ones the driver doesn't know yet,
+// drains the ones which are being shut down and removes the ones which are gone
+func (s *Swarm) reconcile(ctx context.Context) error {
+	services, err := s.loadServices(ctx)
+	if err != nil {
+		return err
+	}
+
+	tasks, err := s.loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	running := make(map[string]struct{}, len(tasks))
+
+	for _, task := range tasks {
+		labels, ok := services[task.ServiceID]
+		if !ok || task.Status.State != "running" {
+			continue
+		}
+
+		running[task.ID] = struct{}{}
+
+		known, ok := s.known[task.ID]
+
+		// the task is scaled down, or replaced by an update, it stops receiving
+		// new requests while it finishes the in-flight ones
+		if task.DesiredState != "running" {
+			if ok && !known.draining {
+				s.drain(task.ID)
+			}
+			continue
+		}
+
+		if ok {
+			continue
+		}
+
+		s.add(task, labels)
+	}
+
+	for id := range s.known {
+		if _, ok := running[id]; !ok {
+			slog.Debug("swarm driver removed task", "id", id)
+			s.remove(id)
+		}
+	}
+
+	return nil
+}
+
+func (s *Swarm) add(task task, labels *Label) {
+	var ip string
+
+	for _, attachment := range task.NetworksAttachments {
+		if attachment.Network.Spec.Name != labels.Network || len(attachment.Addresses) == 0 {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(attachment.Addresses[0])
+		if err != nil {
+			slog.Error("failed to parse task address", "id", task.ID, "address", attachment.Addresses[0], "error", err)
+			return
+		}
+
+		ip = prefix.Addr().String()
+		break
+	}
+
+	if ip == "" {
+		slog.Error("task is not attached to the network", "id", task.ID, "network", labels.Network)
+		return
+	}
+
+	services, err := newContainers(task.ID, ip, labels)
+	if err != nil {
+		slog.Error("failed to load task", "id", task.ID, "error", err)
+		return
+	}
+
+	slog.Debug("swarm driver added task", "id", task.ID, "service_id", task.ServiceID, "ip", ip)
+
+	s.known[task.ID] = &swarmTask{services: services}
+	for _, service := range services {
+		s.driver.Add(service)
+	}
+}
+
+func (s *Swarm) drain(id string) {
+	known := s.known[id]
+	known.draining = true
+
+	drainer, ok := s.driver.(baker.Drainer)
+	if !ok {
+		return
+	}
+
+	slog.Debug("swarm driver draining task", "id", id)
+
+	for _, service := range known.services {
+		drainer.Drain(service)
+	}
+}
+
+func (s *Swarm) remove(id string) {
+	known, ok := s.known[id]
+	if !ok {
+		return
+	}
+
+	delete(s.known, id)
+	for _, service := range known.services {
+		s.driver.Remove(service)
+	}
+}
+
+// watch opens the event stream and reconciles the tasks on every event, and every
+// poll interval, until the stream fails. It returns false if it couldn't be opened.
+func (s *Swarm) watch(ctx context.Context) bool {
+	r, statusCode, err := s.getter(ctx, "/events?filters="+swarmEventsFilter)
+	if err != nil {
+		slog.Error("failed to get events", "error", err)
+		return false
+	}
+	defer r.Close()
+
+	if statusCode >= 400 {
+		slog.Error("failed to get events", "status_code", statusCode)
+		return false
+	}
+
+	if err := s.reconcile(ctx); err != nil {
+		slog.Error("failed to reconcile tasks", "error", err)
+		return false
+	}
+
+	// the events only trigger a reconcile, the ones received
+	// while reconciling are merged into one
+	events := make(chan struct{}, 1)
+	failed := make(chan error, 1)
+
+	go func() {
+		decoder := json.NewDecoder(r)
+
+		for {
+			event := struct {
+				Type   string `json:"Type"`
+				Action string `json:"Action"`
+			}{}
+
+			if err := decoder.Decode(&event); err != nil {
+				failed <- err
+				return
+			}
+
+			slog.Debug("swarm driver received event", "type", event.Type, "action", event.Action)
+
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case err := <-failed:
+			if ctx.Err() == nil {
+				slog.Error("swarm event stream failed", "error", err)
+			}
+			return true
+		case <-events:
+		case <-ticker.C:
+		}
+
+		if err := s.reconcile(ctx); err != nil {
+			slog.Error("failed to reconcile tasks", "error", err)
+		}
+	}
+}
+
+func (s *Swarm) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.close
+		cancel()
+	}()
+
+	reconnect(ctx, "swarm", s.watch, s.minBackoff, s.maxBackoff)
+}
+
+func (s *Swarm) Close() {
+	close(s.close)
+}
+
+func (s *Swarm) RegisterDriver(driver baker.Driver) {
+	if s.driver != nil {
+		panic("driver already registered")
+	}
+
+	s.driver = driver
+	go s.run()
+}
+
+// NewSwarm creates a driver which must be connected to a manager node
+func NewSwarm(getter httpclient.Getter) *Swarm {
+	return &Swarm{
+		getter:       getter.Get,
+		close:        make(chan struct{}),
+		known:        make(map[string]*swarmTask),
+		pollInterval: 10 * time.Second,
+		minBackoff:   500 * time.Millisecond,
+		maxBackoff:   30 * time.Second,
+	}
+}
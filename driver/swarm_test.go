@@ -0,0 +1,207 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"ella.to/baker"
+	"ella.to/baker/internal/httpclient"
+)
+
+// fakeSwarm is a stand-in for the Docker API of a manager node
+type fakeSwarm struct {
+	mu    sync.Mutex
+	tasks []map[string]any
+
+	events chan string
+}
+
+func (f *fakeSwarm) setTasks(tasks ...map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tasks = tasks
+}
+
+func swarmTaskJSON(id string, serviceID string, desiredState string, state string, ip string) map[string]any {
+	return map[string]any{
+		"ID":           id,
+		"ServiceID":    serviceID,
+		"DesiredState": desiredState,
+		"Status":       map[string]any{"State": state},
+		"NetworksAttachments": []any{
+			map[string]any{
+				"Network":   map[string]any{"Spec": map[string]any{"Name": "ingress"}},
+				"Addresses": []string{"10.0.0.9/24"},
+			},
+			map[string]any{
+				"Network":   map[string]any{"Spec": map[string]any{"Name": "baker"}},
+				"Addresses": []string{ip + "/24"},
+			},
+		},
+	}
+}
+
+func (f *fakeSwarm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/services":
+		json.NewEncoder(w).Encode([]any{
+			map[string]any{
+				"ID": "web",
+				"Spec": map[string]any{
+					"Name":   "web",
+					"Labels": map[string]string{"baker.enable": "true", "baker.network": "baker", "baker.service.port": "8000", "baker.service.ping": "/config"},
+				},
+			},
+			map[string]any{
+				"ID":   "db",
+				"Spec": map[string]any{"Name": "db"},
+			},
+		})
+
+	case "/tasks":
+		if r.URL.Query().Get("filters") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		json.NewEncoder(w).Encode(f.tasks)
+
+	case "/events":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-f.events:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			}
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestSwarm(t *testing.T) {
+	fake := &fakeSwarm{events: make(chan string, 10)}
+	fake.setTasks(
+		swarmTaskJSON("web.1", "web", "running", "running", "10.0.1.2"),
+		swarmTaskJSON("web.2", "web", "running", "starting", "10.0.1.3"),
+		swarmTaskJSON("db.1", "db", "running", "running", "10.0.1.4"),
+	)
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	getter, err := httpclient.NewClient(httpclient.WithHttpClient(http.DefaultClient, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swarm := NewSwarm(getter)
+	swarm.pollInterval = time.Hour
+	defer swarm.Close()
+
+	rec := &recorder{containers: make(map[string]*baker.Container)}
+	swarm.RegisterDriver(rec)
+
+	// only the running tasks of the services with the baker labels
+	waitFor(t, "the running tasks", func() bool {
+		return slices.Equal(rec.ids(), []string{"web.1"})
+	})
+
+	rec.mu.Lock()
+	addr := rec.containers["web.1"].Addr.String()
+	rec.mu.Unlock()
+
+	if addr != "10.0.1.2:8000" {
+		t.Fatalf("expected the address of the baker network, got %s", addr)
+	}
+
+	// the events trigger a reconcile
+	fake.setTasks(
+		swarmTaskJSON("web.1", "web", "running", "running", "10.0.1.2"),
+		swarmTaskJSON("web.2", "web", "running", "running", "10.0.1.3"),
+	)
+	fake.events <- `{"Type": "container", "Action": "start"}`
+
+	waitFor(t, "the started task", func() bool {
+		return slices.Equal(rec.ids(), []string{"web.1", "web.2"})
+	})
+
+	// a task which is being shut down is drained, then removed once it's stopped
+	fake.setTasks(
+		swarmTaskJSON("web.1", "web", "shutdown", "running", "10.0.1.2"),
+		swarmTaskJSON("web.2", "web", "running", "running", "10.0.1.3"),
+	)
+	fake.events <- `{"Type": "service", "Action": "update"}`
+
+	waitFor(t, "the task to be drained", func() bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return slices.Equal(rec.drained, []string{"web.1"})
+	})
+
+	fake.setTasks(
+		swarmTaskJSON("web.1", "web", "shutdown", "shutdown", "10.0.1.2"),
+		swarmTaskJSON("web.2", "web", "running", "running", "10.0.1.3"),
+	)
+	fake.events <- `{"Type": "container", "Action": "die"}`
+
+	waitFor(t, "the stopped task to be removed", func() bool {
+		return slices.Equal(rec.ids(), []string{"web.2"})
+	})
+
+	rec.mu.Lock()
+	drained := len(rec.drained)
+	rec.mu.Unlock()
+
+	if drained != 1 {
+		t.Fatalf("expected the task to be drained once, got %d", drained)
+	}
+}
+
+func TestSwarmPolling(t *testing.T) {
+	fake := &fakeSwarm{events: make(chan string, 10)}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	getter, err := httpclient.NewClient(httpclient.WithHttpClient(http.DefaultClient, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swarm := NewSwarm(getter)
+	swarm.pollInterval = 20 * time.Millisecond
+	defer swarm.Close()
+
+	rec := &recorder{containers: make(map[string]*baker.Container)}
+	swarm.RegisterDriver(rec)
+
+	// the tasks of the other nodes don't send any event
+	fake.setTasks(swarmTaskJSON("web.1", "web", "running", "running", "10.0.1.2"))
+
+	waitFor(t, "the task of another node", func() bool {
+		return slices.Equal(rec.ids(), []string{"web.1"})
+	})
+
+	fake.setTasks()
+
+	waitFor(t, "the task of another node to be removed", func() bool {
+		return len(rec.ids()) == 0
+	})
+}
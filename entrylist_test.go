@@ -55,4 +55,18 @@ func TestBakerEndpoints(t *testing.T) {
 		fmt.Println(strings.TrimSpace(rr.Body.String()))
 		assert.JSONEq(t, `{"endpoints":[{"domain":"example.com","path":"/","rules":[{"type":"RateLimiter","args":{"request_limit":1,"window_duration":"1s"}}]}]}`, strings.TrimSpace(rr.Body.String()))
 	}
+
+	{
+		rr := httptest.NewRecorder()
+		baker.NewEntryList().
+			New("example.com", "/", true).
+			WithRules(
+				rule.NewRateLimiter(1, 1*time.Second,
+					rule.WithRateLimitKey("header:X-Api-Key"),
+					rule.WithRateLimitResponse(503, "slow down"),
+				),
+			).
+			WriteResponse(rr)
+		assert.JSONEq(t, `{"endpoints":[{"domain":"example.com","path":"/","rules":[{"type":"RateLimiter","args":{"request_limit":1,"window_duration":"1s","key":"header:X-Api-Key","response_status":503,"response_body":"slow down"}}]}]}`, strings.TrimSpace(rr.Body.String()))
+	}
 }
@@ -3,8 +3,10 @@ module ella.to/baker
 go 1.23
 
 require (
+	github.com/andybalholm/brotli v1.2.6
 	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/coder/websocket v1.8.12
+	github.com/klauspost/compress v1.17.9
 	github.com/prometheus/client_golang v1.20.1
 	github.com/stretchr/testify v1.9.0
 	golang.org/x/crypto v0.24.0
@@ -13,7 +15,6 @@ require (
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/klauspost/compress v1.17.9 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
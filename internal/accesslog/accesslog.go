@@ -0,0 +1,287 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+)
+
+// Fields lists the fields of a json record, in the order they are written
+var Fields = []string{
+	"time",
+	"request_id",
+	"client_ip",
+	"host",
+	"method",
+	"path",
+	"query",
+	"proto",
+	"endpoint",
+	"container_id",
+	"status",
+	"bytes_in",
+	"bytes_out",
+	"upstream_latency_ms",
+	"latency_ms",
+	"user_agent",
+	"referer",
+	"rules",
+}
+
+// Record holds everything logged about a request, it is attached to the
+// context of the request so rules can add their outcome with Annotate
+type Record struct {
+	Time            time.Time
+	RequestID       string
+	ClientIP        string
+	Host            string
+	Method          string
+	Path            string
+	Query           string
+	Proto           string
+	Endpoint        string
+	ContainerID     string
+	Status          int
+	BytesIn         int64
+	BytesOut        int64
+	UpstreamLatency time.Duration
+	Latency         time.Duration
+	UserAgent       string
+	Referer         string
+
+	mu    sync.Mutex
+	rules map[string]string
+}
+
+// Rules returns a copy of the outcomes added by the rules
+func (r *Record) Rules() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return maps.Clone(r.rules)
+}
+
+type recordKey struct{}
+
+func WithRecord(ctx context.Context, record *Record) context.Context {
+	return context.WithValue(ctx, recordKey{}, record)
+}
+
+func FromContext(ctx context.Context) *Record {
+	record, _ := ctx.Value(recordKey{}).(*Record)
+	return record
+}
+
+// Annotate records the outcome of a rule, e.g. Annotate(ctx, "cache", "HIT"),
+// it does nothing if the access log is disabled
+func Annotate(ctx context.Context, rule string, outcome string) {
+	record := FromContext(ctx)
+	if record == nil {
+		return
+	}
+
+	record.mu.Lock()
+	defer record.mu.Unlock()
+
+	if record.rules == nil {
+		record.rules = make(map[string]string)
+	}
+	record.rules[rule] = outcome
+}
+
+type Logger struct {
+	mu         sync.Mutex
+	w          io.Writer
+	format     string
+	fields     map[string]bool
+	sampleRate float64
+}
+
+type Option func(*Logger) error
+
+// WithFormat sets the format of the records, json (default), common or combined
+func WithFormat(format string) Option {
+	return func(l *Logger) error {
+		switch format {
+		case FormatJSON, FormatCommon, FormatCombined:
+			l.format = format
+			return nil
+		case "":
+			return nil
+		default:
+			return fmt.Errorf("unknown access log format '%s'", format)
+		}
+	}
+}
+
+// WithFields limits the fields written by the json format
+func WithFields(fields ...string) Option {
+	return func(l *Logger) error {
+		if len(fields) == 0 {
+			return nil
+		}
+
+		l.fields = make(map[string]bool, len(fields))
+		for _, field := range fields {
+			if !slices.Contains(Fields, field) {
+				return fmt.Errorf("unknown access log field '%s'", field)
+			}
+			l.fields[field] = true
+		}
+
+		return nil
+	}
+}
+
+// WithSampleRate logs only a fraction of the requests, between 0 and 1.
+// Requests which fail with a 5xx status are always logged.
+func WithSampleRate(rate float64) Option {
+	return func(l *Logger) error {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("access log sample rate must be between 0 and 1, got %v", rate)
+		}
+		l.sampleRate = rate
+		return nil
+	}
+}
+
+func New(w io.Writer, opts ...Option) (*Logger, error) {
+	l := &Logger{
+		w:          w,
+		format:     FormatJSON,
+		sampleRate: 1,
+	}
+
+	for _, opt := range opts {
+		if err := opt(l); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func (l *Logger) sampled(record *Record) bool {
+	if record.Status >= 500 || l.sampleRate >= 1 {
+		return true
+	}
+	return rand.Float64() < l.sampleRate
+}
+
+// Log writes the record, unless it is dropped by sampling
+func (l *Logger) Log(record *Record) {
+	if !l.sampled(record) {
+		return
+	}
+
+	var buf bytes.Buffer
+
+	switch l.format {
+	case FormatCommon, FormatCombined:
+		l.writeCLF(&buf, record)
+	default:
+		l.writeJSON(&buf, record)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.w.Write(buf.Bytes())
+}
+
+func (l *Logger) writeJSON(buf *bytes.Buffer, record *Record) {
+	values := map[string]any{
+		"time":                record.Time.UTC().Format(time.RFC3339Nano),
+		"request_id":          record.RequestID,
+		"client_ip":           record.ClientIP,
+		"host":                record.Host,
+		"method":              record.Method,
+		"path":                record.Path,
+		"query":               record.Query,
+		"proto":               record.Proto,
+		"endpoint":            record.Endpoint,
+		"container_id":        record.ContainerID,
+		"status":              record.Status,
+		"bytes_in":            record.BytesIn,
+		"bytes_out":           record.BytesOut,
+		"upstream_latency_ms": float64(record.UpstreamLatency.Microseconds()) / 1000,
+		"latency_ms":          float64(record.Latency.Microseconds()) / 1000,
+		"user_agent":          record.UserAgent,
+		"referer":             record.Referer,
+		"rules":               record.Rules(),
+	}
+
+	buf.WriteByte('{')
+
+	first := true
+	for _, field := range Fields {
+		if l.fields != nil && !l.fields[field] {
+			continue
+		}
+
+		value, err := json.Marshal(values[field])
+		if err != nil {
+			continue
+		}
+
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+
+		buf.WriteString(strconv.Quote(field))
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+
+	buf.WriteString("}\n")
+}
+
+// writeCLF writes the record in the Common or Combined Log Format of apache,
+// e.g. 127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 2326
+func (l *Logger) writeCLF(buf *bytes.Buffer, record *Record) {
+	uri := record.Path
+	if record.Query != "" {
+		uri += "?" + record.Query
+	}
+
+	bytesOut := "-"
+	if record.BytesOut > 0 {
+		bytesOut = strconv.FormatInt(record.BytesOut, 10)
+	}
+
+	fmt.Fprintf(buf, "%s - - [%s] %s %d %s",
+		dash(record.ClientIP),
+		record.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(record.Method+" "+uri+" "+record.Proto),
+		record.Status,
+		bytesOut,
+	)
+
+	if l.format == FormatCombined {
+		fmt.Fprintf(buf, " %s %s", strconv.Quote(dash(record.Referer)), strconv.Quote(dash(record.UserAgent)))
+	}
+
+	buf.WriteByte('\n')
+}
+
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
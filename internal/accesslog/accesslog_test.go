@@ -0,0 +1,202 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ella.to/baker/internal/accesslog"
+)
+
+func newRecord() *accesslog.Record {
+	return &accesslog.Record{
+		Time:            time.Date(2024, 10, 10, 13, 55, 36, 0, time.UTC),
+		RequestID:       "req-1",
+		ClientIP:        "127.0.0.1",
+		Host:            "example.com",
+		Method:          "GET",
+		Path:            "/api/users",
+		Query:           "page=2",
+		Proto:           "HTTP/1.1",
+		Endpoint:        "example.com/api/*",
+		ContainerID:     "container-1",
+		Status:          200,
+		BytesIn:         0,
+		BytesOut:        2326,
+		UpstreamLatency: 1500 * time.Microsecond,
+		Latency:         2 * time.Millisecond,
+		UserAgent:       "curl/8.0",
+		Referer:         "https://example.com/",
+	}
+}
+
+func TestLoggerFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []accesslog.Option
+		want string
+	}{
+		{
+			name: "json",
+			want: `{"time":"2024-10-10T13:55:36Z","request_id":"req-1","client_ip":"127.0.0.1","host":"example.com","method":"GET","path":"/api/users","query":"page=2","proto":"HTTP/1.1","endpoint":"example.com/api/*","container_id":"container-1","status":200,"bytes_in":0,"bytes_out":2326,"upstream_latency_ms":1.5,"latency_ms":2,"user_agent":"curl/8.0","referer":"https://example.com/","rules":{"HTTPCache":"MISS"}}` + "\n",
+		},
+		{
+			name: "json with fields",
+			opts: []accesslog.Option{accesslog.WithFields("status", "host", "rules")},
+			want: `{"host":"example.com","status":200,"rules":{"HTTPCache":"MISS"}}` + "\n",
+		},
+		{
+			name: "common",
+			opts: []accesslog.Option{accesslog.WithFormat(accesslog.FormatCommon)},
+			want: `127.0.0.1 - - [10/Oct/2024:13:55:36 +0000] "GET /api/users?page=2 HTTP/1.1" 200 2326` + "\n",
+		},
+		{
+			name: "combined",
+			opts: []accesslog.Option{accesslog.WithFormat(accesslog.FormatCombined)},
+			want: `127.0.0.1 - - [10/Oct/2024:13:55:36 +0000] "GET /api/users?page=2 HTTP/1.1" 200 2326 "https://example.com/" "curl/8.0"` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			logger, err := accesslog.New(&buf, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			record := newRecord()
+			accesslog.Annotate(accesslog.WithRecord(context.Background(), record), "HTTPCache", "MISS")
+
+			logger.Log(record)
+
+			if buf.String() != tt.want {
+				t.Fatalf("got\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggerOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  accesslog.Option
+	}{
+		{name: "format", opt: accesslog.WithFormat("xml")},
+		{name: "field", opt: accesslog.WithFields("password")},
+		{name: "sample rate", opt: accesslog.WithSampleRate(2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := accesslog.New(&bytes.Buffer{}, tt.opt); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoggerSampling(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, err := accesslog.New(&buf, accesslog.WithSampleRate(0), accesslog.WithFields("status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range []int{200, 404, 502} {
+		record := newRecord()
+		record.Status = status
+		logger.Log(record)
+	}
+
+	// server errors are always logged
+	if buf.String() != `{"status":502}`+"\n" {
+		t.Fatalf("unexpected records %q", buf.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	file, err := accesslog.NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{
+		path:        "line-4\n",
+		path + ".1": "line-3\n",
+		path + ".2": "line-2\n",
+	}
+	for name, content := range want {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), got, content)
+		}
+	}
+
+	matches, _ := filepath.Glob(path + "*")
+	if len(matches) != 3 {
+		t.Errorf("expected 3 files, got %s", strings.Join(matches, ", "))
+	}
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "access.log")
+
+	file, err := accesslog.NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write([]byte("line-1\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new file can't be opened, the line goes to the current one
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := file.Write([]byte("line-2\n")); err == nil || n != 7 {
+		t.Fatalf("expected the line to be written with a rotation error, got %d, %v", n, err)
+	}
+
+	// the rotation is retried on the next write
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := file.Write([]byte("line-3\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "line-3\n" {
+		t.Errorf("access.log = %q, want %q", got, "line-3\n")
+	}
+}
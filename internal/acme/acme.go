@@ -1,7 +1,6 @@
 package acme
 
 import (
-	"context"
 	"crypto/tls"
 	"net/http"
 	"time"
@@ -9,17 +8,22 @@ import (
 	"golang.org/x/crypto/acme/autocert"
 )
 
-func Start(handler http.Handler, cachePath string) error {
+// NewServers returns the servers of the handler over https on port 443, using certificates issued
+// by Let's Encrypt, and port 80 which answers the ACME challenges. If redirectHTTP is true every other
+// request to port 80 is redirected to https, otherwise it is passed to the handler, so each endpoint
+// can decide whether it should be redirected, e.g. with the Redirect rule. The https server has
+// a TLSConfig, and must be started with ListenAndServeTLS("", "").
+func NewServers(handler http.Handler, cachePath string, redirectHTTP bool) (httpServer *http.Server, httpsServer *http.Server) {
 	if cachePath == "" {
 		cachePath = "."
 	}
 
-	certManager := autocert.Manager{
+	certManager := &autocert.Manager{
 		Prompt: autocert.AcceptTOS,
 		Cache:  autocert.DirCache(cachePath),
 	}
 
-	httpsServer := &http.Server{
+	httpsServer = &http.Server{
 		Addr:         ":443",
 		Handler:      handler,
 		ReadTimeout:  5 * time.Second,
@@ -29,38 +33,24 @@ func Start(handler http.Handler, cachePath string) error {
 		},
 	}
 
-	httpServer := &http.Server{
-		Addr:         ":80",
-		Handler:      certManager.HTTPHandler(nil),
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-	}
-
-	httpClose := make(chan struct{}, 1)
-	httpsClose := make(chan struct{}, 1)
-	errs := make(chan error, 2)
-
-	go func() {
-		defer close(httpClose)
-		errs <- httpServer.ListenAndServe()
-	}()
+	if redirectHTTP {
+		httpServer = &http.Server{
+			Addr:         ":80",
+			Handler:      certManager.HTTPHandler(nil),
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
 
-	go func() {
-		defer close(httpsClose)
-		errs <- httpsServer.ListenAndServeTLS("", "")
-	}()
-
-	select {
-	case <-httpClose:
-		httpsServer.Shutdown(context.Background())
-	case <-httpsClose:
-		httpServer.Shutdown(context.Background())
+		return httpServer, httpsServer
 	}
 
-	select {
-	case err := <-errs:
-		return err
-	default:
-		return nil
+	// port 80 serves the endpoints too, like the server without ACME the responses are not cut
+	// by a timeout, e.g. websockets, streams or downloads, only the headers must be sent in time
+	httpServer = &http.Server{
+		Addr:              ":80",
+		Handler:           certManager.HTTPHandler(handler),
+		ReadHeaderTimeout: 10 * time.Second,
 	}
+
+	return httpServer, httpsServer
 }
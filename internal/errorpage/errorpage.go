@@ -0,0 +1,280 @@
+package errorpage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ella.to/baker/internal/accesslog"
+)
+
+const (
+	FormatText = "text"
+	FormatHTML = "html"
+	FormatJSON = "json"
+)
+
+const defaultTemplate = `<!DOCTYPE html>
+<html>
+<head><title>{{.StatusCode}} {{.StatusText}}</title></head>
+<body><h1>{{.StatusCode}} {{.StatusText}}</h1></body>
+</html>
+`
+
+// templates caches the parsed templates by their content, since
+// rules are built for every request
+var templates sync.Map // text -> *template.Template
+
+func parseTemplate(text string) (*template.Template, error) {
+	if tmpl, ok := templates.Load(text); ok {
+		return tmpl.(*template.Template), nil
+	}
+
+	tmpl, err := template.New("error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	templates.Store(text, tmpl)
+
+	return tmpl, nil
+}
+
+// Pages describes how the errors generated by baker are sent to the client.
+// Templates are html templates keyed by status code, e.g. "404", or "default"
+// for all the other status codes. Intercept lists the status codes of the
+// services which are replaced by the error page.
+type Pages struct {
+	Format    string            `json:"format,omitempty"`
+	Templates map[string]string `json:"templates,omitempty"`
+	Intercept []int             `json:"intercept,omitempty"`
+
+	parsed map[string]*template.Template
+}
+
+// Data is passed to the html templates
+type Data struct {
+	StatusCode int
+	StatusText string
+	Host       string
+	Path       string
+}
+
+// problem is the body of json errors, see RFC 9457
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func (p *Pages) Compile() error {
+	switch p.Format {
+	case "", FormatText, FormatHTML, FormatJSON:
+	default:
+		return fmt.Errorf("unknown error page format '%s'", p.Format)
+	}
+
+	for _, code := range p.Intercept {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("only error status codes can be intercepted, got %d", code)
+		}
+	}
+
+	p.parsed = make(map[string]*template.Template, len(p.Templates))
+
+	for key, text := range p.Templates {
+		if key != "default" {
+			if _, err := strconv.Atoi(key); err != nil {
+				return fmt.Errorf("invalid error page template key '%s'", key)
+			}
+		}
+
+		tmpl, err := parseTemplate(text)
+		if err != nil {
+			return fmt.Errorf("failed to parse error page template '%s': %w", key, err)
+		}
+
+		p.parsed[key] = tmpl
+	}
+
+	return nil
+}
+
+// Intercepts returns true if the status code sent by a service should be replaced
+func (p *Pages) Intercepts(statusCode int) bool {
+	return p != nil && slices.Contains(p.Intercept, statusCode)
+}
+
+func (p *Pages) template(statusCode int) *template.Template {
+	if tmpl, ok := p.parsed[strconv.Itoa(statusCode)]; ok {
+		return tmpl
+	}
+
+	if tmpl, ok := p.parsed["default"]; ok {
+		return tmpl
+	}
+
+	tmpl, _ := parseTemplate(defaultTemplate)
+	return tmpl
+}
+
+// Render writes the error page for the status code. Headers already
+// set on the response, such as Retry-After, are kept.
+func (p *Pages) Render(w http.ResponseWriter, r *http.Request, statusCode int) {
+	format := FormatText
+	if p != nil && p.Format != "" {
+		format = p.Format
+	}
+
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Set("X-Content-Type-Options", "nosniff")
+
+	switch format {
+	case FormatJSON:
+		body, _ := json.Marshal(problem{
+			Type:     "about:blank",
+			Title:    http.StatusText(statusCode),
+			Status:   statusCode,
+			Instance: r.URL.Path,
+		})
+
+		header.Set("Content-Type", "application/problem+json")
+		w.WriteHeader(statusCode)
+		w.Write(body)
+	case FormatHTML:
+		var buf bytes.Buffer
+
+		err := p.template(statusCode).Execute(&buf, Data{
+			StatusCode: statusCode,
+			StatusText: http.StatusText(statusCode),
+			Host:       r.Host,
+			Path:       r.URL.Path,
+		})
+		if err != nil {
+			buf.Reset()
+			buf.WriteString(http.StatusText(statusCode))
+		}
+
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(statusCode)
+		w.Write(buf.Bytes())
+	default:
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(statusCode)
+		fmt.Fprintln(w, http.StatusText(statusCode))
+	}
+}
+
+// LoadDir reads the html templates of a directory, files are named
+// after the status code, e.g. 404.html, or default.html
+func LoadDir(dir string) (map[string]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(files))
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read error page '%s': %w", file, err)
+		}
+
+		result[strings.TrimSuffix(filepath.Base(file), ".html")] = string(content)
+	}
+
+	return result, nil
+}
+
+type pagesKey struct{}
+
+// WithPages attaches the error pages to the context of the request, so every
+// error generated while processing the request uses the same pages
+func WithPages(ctx context.Context, pages *Pages) context.Context {
+	return context.WithValue(ctx, pagesKey{}, pages)
+}
+
+func FromContext(ctx context.Context) *Pages {
+	pages, _ := ctx.Value(pagesKey{}).(*Pages)
+	return pages
+}
+
+// Write sends the error page attached to the request, or a plain text error if there is none
+func Write(w http.ResponseWriter, r *http.Request, statusCode int) {
+	FromContext(r.Context()).Render(w, r, statusCode)
+}
+
+// InterceptWriter replaces the responses of the service which status code
+// is listed in Pages.Intercept by the error page
+type InterceptWriter struct {
+	http.ResponseWriter
+	pages       *Pages
+	r           *http.Request
+	intercepted bool
+	wroteHeader bool
+}
+
+func NewInterceptWriter(w http.ResponseWriter, r *http.Request, pages *Pages) *InterceptWriter {
+	return &InterceptWriter{
+		ResponseWriter: w,
+		pages:          pages,
+		r:              r,
+	}
+}
+
+func (i *InterceptWriter) WriteHeader(code int) {
+	if i.wroteHeader {
+		return
+	}
+
+	if code >= 200 {
+		i.wroteHeader = true
+	}
+
+	if i.pages.Intercepts(code) {
+		i.intercepted = true
+		accesslog.Annotate(i.r.Context(), "ErrorPages", "intercepted")
+		i.pages.Render(i.ResponseWriter, i.r, code)
+		return
+	}
+
+	i.ResponseWriter.WriteHeader(code)
+}
+
+func (i *InterceptWriter) Write(p []byte) (int, error) {
+	if !i.wroteHeader {
+		i.WriteHeader(http.StatusOK)
+	}
+
+	// the body of the service is dropped, the error page is already written
+	if i.intercepted {
+		return len(p), nil
+	}
+
+	return i.ResponseWriter.Write(p)
+}
+
+func (i *InterceptWriter) Flush() {
+	if i.intercepted {
+		return
+	}
+
+	http.NewResponseController(i.ResponseWriter).Flush()
+}
+
+func (i *InterceptWriter) Unwrap() http.ResponseWriter {
+	return i.ResponseWriter
+}
@@ -0,0 +1,188 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultDockerHost is used when DOCKER_HOST is not set
+const DefaultDockerHost = "unix:///var/run/docker.sock"
+
+// DockerAPIVersion is the highest version of the Docker API used by the client
+const DockerAPIVersion = "1.45"
+
+// WithDockerHost connects to the daemon at dockerHost, which has the format of
+// DOCKER_HOST, e.g. unix:///var/run/docker.sock or tcp://10.0.0.1:2376. The tcp
+// connections use TLS if tlsConfig is not nil.
+func WithDockerHost(dockerHost string, tlsConfig *tls.Config) clientOptionFunc {
+	return func(c *client) error {
+		if c.httpClient != nil {
+			return fmt.Errorf("client already configured")
+		}
+
+		if dockerHost == "" {
+			dockerHost = DefaultDockerHost
+		}
+
+		u, err := url.Parse(dockerHost)
+		if err != nil {
+			return fmt.Errorf("failed to parse docker host '%s': %w", dockerHost, err)
+		}
+
+		switch u.Scheme {
+		case "unix":
+			var dialer net.Dialer
+
+			c.host = "http://localhost"
+			c.httpClient = &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+						return dialer.DialContext(ctx, "unix", u.Path)
+					},
+				},
+			}
+		case "tcp":
+			scheme, port := "http", "2375"
+			if tlsConfig != nil {
+				scheme, port = "https", "2376"
+			}
+
+			host := u.Host
+			if u.Port() == "" {
+				host = net.JoinHostPort(u.Hostname(), port)
+			}
+
+			c.host = scheme + "://" + host
+			c.httpClient = &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: tlsConfig,
+				},
+			}
+		default:
+			return fmt.Errorf("unsupported docker host '%s'", dockerHost)
+		}
+
+		return nil
+	}
+}
+
+// DockerTLSConfig loads the ca.pem, cert.pem and key.pem files of certPath, like
+// DOCKER_CERT_PATH. The certificate of the daemon is only verified if verify is true.
+func DockerTLSConfig(certPath string, verify bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load docker client certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: !verify,
+	}
+
+	if verify {
+		ca, err := os.ReadFile(filepath.Join(certPath, "ca.pem"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load docker ca certificate: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("failed to parse docker ca certificate")
+		}
+	}
+
+	return config, nil
+}
+
+// WithDockerAPIVersion prefixes the urls with the version of the Docker API, e.g. /v1.45/events.
+// If version is empty, it's negotiated with the daemon on the first request: the lowest
+// of DockerAPIVersion and the version of the daemon is used.
+func WithDockerAPIVersion(version string) clientOptionFunc {
+	return func(c *client) error {
+		if version != "" {
+			if _, _, ok := parseAPIVersion(version); !ok {
+				return fmt.Errorf("invalid docker api version '%s'", version)
+			}
+		}
+
+		c.docker = &dockerAPI{
+			version:    strings.TrimPrefix(version, "v"),
+			negotiated: version != "",
+		}
+		return nil
+	}
+}
+
+type dockerAPI struct {
+	mu         sync.Mutex
+	version    string
+	negotiated bool
+}
+
+// apiVersion returns the version of the Docker API, it's negotiated once,
+// and again on the next request if the daemon couldn't be reached
+func (d *dockerAPI) apiVersion(ctx context.Context, c *client) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.negotiated {
+		return d.version, nil
+	}
+
+	resp, err := c.do(ctx, "/_ping")
+	if err != nil {
+		return "", fmt.Errorf("failed to negotiate docker api version: %w", err)
+	}
+	resp.Body.Close()
+
+	// old daemons don't send their version, the urls are used without a version
+	d.version = DockerAPIVersion
+	if version := resp.Header.Get("Api-Version"); version == "" {
+		d.version = ""
+	} else if apiVersionLess(version, DockerAPIVersion) {
+		d.version = version
+	}
+	d.negotiated = true
+
+	return d.version, nil
+}
+
+func parseAPIVersion(version string) (major int, minor int, ok bool) {
+	majorStr, minorStr, found := strings.Cut(strings.TrimPrefix(version, "v"), ".")
+	if !found {
+		return 0, 0, false
+	}
+
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	minor, err = strconv.Atoi(minorStr)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return major, minor, true
+}
+
+func apiVersionLess(a string, b string) bool {
+	aMajor, aMinor, aOk := parseAPIVersion(a)
+	bMajor, bMinor, bOk := parseAPIVersion(b)
+	if !aOk || !bOk {
+		return false
+	}
+
+	return aMajor < bMajor || (aMajor == bMajor && aMinor < bMinor)
+}
@@ -0,0 +1,115 @@
+package httpclient_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ella.to/baker/internal/httpclient"
+)
+
+func TestDockerAPIVersion(t *testing.T) {
+	tests := []struct {
+		name          string
+		pinned        string
+		daemonVersion string
+		want          string
+	}{
+		{name: "older daemon", daemonVersion: "1.41", want: "/v1.41/containers/json"},
+		{name: "newer daemon", daemonVersion: "1.99", want: "/v" + httpclient.DockerAPIVersion + "/containers/json"},
+		{name: "no version", want: "/containers/json"},
+		{name: "pinned", pinned: "1.40", daemonVersion: "1.41", want: "/v1.40/containers/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+				if tt.daemonVersion != "" {
+					w.Header().Set("Api-Version", tt.daemonVersion)
+				}
+				w.Write([]byte("OK"))
+			}))
+			defer server.Close()
+
+			getter, err := httpclient.NewClient(
+				httpclient.WithHttpClient(http.DefaultClient, server.URL),
+				httpclient.WithDockerAPIVersion(tt.pinned),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for range 2 {
+				r, _, err := getter.Get(context.Background(), "/containers/json")
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Close()
+			}
+
+			// the version is negotiated once
+			want := []string{tt.want, tt.want}
+			if tt.pinned == "" {
+				want = append([]string{"/_ping"}, want...)
+			}
+
+			if strings.Join(paths, ",") != strings.Join(want, ",") {
+				t.Fatalf("got %v, want %v", paths, want)
+			}
+		})
+	}
+
+	if _, err := httpclient.NewClient(httpclient.WithDockerAPIVersion("latest")); err == nil {
+		t.Fatal("expected an error for an invalid version")
+	}
+}
+
+func TestDockerHost(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	tcp := httptest.NewServer(server.Config.Handler)
+	defer tcp.Close()
+
+	for _, host := range []string{"unix://" + socket, strings.Replace(tcp.URL, "http://", "tcp://", 1)} {
+		getter, err := httpclient.NewClient(httpclient.WithDockerHost(host, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, statusCode, err := getter.Get(context.Background(), "/events")
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		r.Close()
+
+		if statusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status code %d", host, statusCode)
+		}
+	}
+
+	if _, err := httpclient.NewClient(httpclient.WithDockerHost("ssh://user@host", nil)); err == nil {
+		t.Fatal("expected an error for an unsupported scheme")
+	}
+
+	if _, err := httpclient.DockerTLSConfig(t.TempDir(), true); err == nil {
+		t.Fatal("expected an error for missing certificates")
+	}
+}
@@ -24,15 +24,22 @@ func (fn GetterFunc) Get(ctx context.Context, url string) (io.ReadCloser, int, e
 type client struct {
 	host       string
 	httpClient *http.Client
+	docker     *dockerAPI // set if the urls are prefixed with the version of the Docker API
 }
 
 func (c *client) Get(ctx context.Context, url string) (io.ReadCloser, int, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s%s", c.host, url), nil)
-	if err != nil {
-		return nil, 0, err
+	if c.docker != nil {
+		version, err := c.docker.apiVersion(ctx, c)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if version != "" {
+			url = "/v" + version + url
+		}
 	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(ctx, url)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -40,6 +47,15 @@ func (c *client) Get(ctx context.Context, url string) (io.ReadCloser, int, error
 	return resp.Body, resp.StatusCode, nil
 }
 
+func (c *client) do(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s%s", c.host, url), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.httpClient.Do(req)
+}
+
 type clientOption interface {
 	configureClient(*client) error
 }
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var runnerQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "baker",
+	Name:      "runner_queue_depth",
+	Help:      "How many events are waiting to be processed by the action runner.",
+})
+
+var runnerDroppedEventCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "baker",
+		Name:      "runner_dropped_event_count",
+		Help:      "How many events were dropped because the queue of the action runner was full, partitioned by event type. Only the pinger events are dropped.",
+	},
+	[]string{"event"},
+)
+
+var runnerEventDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "baker",
+	Name:      "runner_event_duration_seconds",
+	Help:      "How long it took the action runner to process an event, partitioned by event type.",
+	Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+
+	NativeHistogramBucketFactor:     nativeHistogramBucketFactor,
+	NativeHistogramMaxBucketNumber:  nativeHistogramMaxBucketNumber,
+	NativeHistogramMinResetDuration: nativeHistogramMinResetDuration,
+},
+	[]string{"event"},
+)
+
+var domainCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "baker",
+	Name:      "domains",
+	Help:      "How many domains have at least one endpoint.",
+})
+
+var pathCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "baker",
+	Name:      "paths",
+	Help:      "How many endpoints, domain and path pairs, are served.",
+})
+
+var containerCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "baker",
+	Name:      "containers",
+	Help:      "How many containers are registered, including the ones which haven't sent their config yet.",
+})
+
+var middlewareCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "baker",
+	Name:      "middleware_cache_size",
+	Help:      "How many middlewares are kept in the cache of the cachable rules.",
+})
+
+var driverReconnectCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "baker",
+		Name:      "driver_reconnect_count",
+		Help:      "How many times a driver reconnected to the event stream of the orchestrator, partitioned by driver.",
+	},
+	[]string{"driver"},
+)
+
+func RunnerQueueDepth(depth int) {
+	runnerQueueDepth.Set(float64(depth))
+}
+
+func RunnerDroppedEvent(event string) {
+	runnerDroppedEventCount.WithLabelValues(event).Inc()
+}
+
+func RunnerEventDuration(event string, duration float64) {
+	runnerEventDuration.WithLabelValues(event).Observe(duration)
+}
+
+// RoutingTableSize sets the number of domains, paths and containers known by the server
+func RoutingTableSize(domains int, paths int, containers int) {
+	domainCount.Set(float64(domains))
+	pathCount.Set(float64(paths))
+	containerCount.Set(float64(containers))
+}
+
+func MiddlewareCacheSize(size int) {
+	middlewareCacheSize.Set(float64(size))
+}
+
+func DriverReconnect(driver string) {
+	driverReconnectCount.WithLabelValues(driver).Inc()
+}
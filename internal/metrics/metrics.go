@@ -3,17 +3,114 @@ package metrics
 import (
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	// UnmatchedLabel is the domain and path of the requests which didn't match any endpoint
+	UnmatchedLabel = "unmatched"
+	// OverflowLabel replaces the domain and path once the limit of path labels is reached
+	OverflowLabel = "overflow"
+
+	defaultMaxPathLabels = 1000
+)
+
+// besides the classic buckets, the histograms are exposed as native histograms,
+// which are used by the Prometheus servers scraping with the protobuf format
+const (
+	nativeHistogramBucketFactor     = 1.1
+	nativeHistogramMaxBucketNumber  = 100
+	nativeHistogramMinResetDuration = time.Hour
+)
+
+// pathLabels limits the number of domain and path pairs used as labels, every pair
+// creates new series for each method and code, and the number of endpoints is only
+// bounded by the configs of the containers
+type pathLabels struct {
+	mu   sync.Mutex
+	max  int
+	seen map[[2]string]struct{}
+}
+
+func (p *pathLabels) get(domain, path string) (string, string) {
+	if domain == UnmatchedLabel {
+		return domain, path
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := [2]string{domain, path}
+	if _, ok := p.seen[key]; ok {
+		return domain, path
+	}
+
+	if p.max > 0 && len(p.seen) >= p.max {
+		return OverflowLabel, OverflowLabel
+	}
+
+	p.seen[key] = struct{}{}
+	return domain, path
+}
+
+func (p *pathLabels) release(domain, path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.seen, [2]string{domain, path})
+}
+
+var requestPathLabels = &pathLabels{
+	max:  defaultMaxPathLabels,
+	seen: make(map[[2]string]struct{}),
+}
+
+// SetMaxPathLabels sets how many domain and path pairs are used as labels, the
+// requests of the other endpoints are recorded with the overflow label. Zero means no limit.
+func SetMaxPathLabels(max int) {
+	requestPathLabels.mu.Lock()
+	defer requestPathLabels.mu.Unlock()
+
+	requestPathLabels.max = max
+}
+
+// RemovePath deletes the metrics of an endpoint which is gone and frees its
+// path label, so the endpoints of the next deployments aren't recorded as overflow
+func RemovePath(domain, path string) {
+	requestPathLabels.release(domain, path)
+
+	labels := prometheus.Labels{"domain": domain, "path": path}
+
+	httpRequestCount.DeletePartialMatch(labels)
+	httpRequestDuration.DeletePartialMatch(labels)
+	httpRequestSize.DeletePartialMatch(labels)
+	httpResponseSize.DeletePartialMatch(labels)
+	websocketRequestCount.DeletePartialMatch(labels)
+	websocketConnectionDuration.DeletePartialMatch(labels)
+	websocketMessageCount.DeletePartialMatch(labels)
+}
+
+// methodLabel keeps the standard methods, as any string can be sent as a method
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
 var websocketRequestCount = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Namespace: "baker",
 		Name:      "websocket_request_count",
-		Help:      "How many WebSocket requests processed, partitioned by status code, method and HTTP path.",
+		Help:      "How many WebSocket requests processed, partitioned by status code, method and HTTP path (with patterns).",
 	},
 	[]string{"domain", "path", "method", "code"},
 )
@@ -31,11 +128,78 @@ var httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 	Namespace: "baker",
 	Name:      "http_request_duration_seconds",
 	Help:      "How long it took to process the request, partitioned by status code, method and HTTP path (with patterns).",
-	Buckets:   []float64{.1, .3, 1, 1.5, 2, 5, 10},
+	Buckets:   []float64{.005, .01, .025, .05, .1, .3, 1, 1.5, 2, 5, 10},
+
+	NativeHistogramBucketFactor:     nativeHistogramBucketFactor,
+	NativeHistogramMaxBucketNumber:  nativeHistogramMaxBucketNumber,
+	NativeHistogramMinResetDuration: nativeHistogramMinResetDuration,
 },
 	[]string{"domain", "path", "method", "code"},
 )
 
+var httpRequestSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "baker",
+	Name:      "http_request_size_bytes",
+	Help:      "Size of the request bodies, partitioned by method and HTTP path (with patterns).",
+	Buckets:   prometheus.ExponentialBuckets(100, 10, 7),
+
+	NativeHistogramBucketFactor:     nativeHistogramBucketFactor,
+	NativeHistogramMaxBucketNumber:  nativeHistogramMaxBucketNumber,
+	NativeHistogramMinResetDuration: nativeHistogramMinResetDuration,
+},
+	[]string{"domain", "path", "method"},
+)
+
+var httpResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "baker",
+	Name:      "http_response_size_bytes",
+	Help:      "Size of the response bodies, partitioned by status code, method and HTTP path (with patterns).",
+	Buckets:   prometheus.ExponentialBuckets(100, 10, 7),
+
+	NativeHistogramBucketFactor:     nativeHistogramBucketFactor,
+	NativeHistogramMaxBucketNumber:  nativeHistogramMaxBucketNumber,
+	NativeHistogramMinResetDuration: nativeHistogramMinResetDuration,
+},
+	[]string{"domain", "path", "method", "code"},
+)
+
+var httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "baker",
+	Name:      "http_requests_in_flight",
+	Help:      "How many requests, including WebSocket connections, are being processed.",
+})
+
+var websocketConnectionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "baker",
+	Name:      "websocket_connection_duration_seconds",
+	Help:      "How long the WebSocket connections stayed open, partitioned by HTTP path (with patterns).",
+	Buckets:   []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 14400},
+
+	NativeHistogramBucketFactor:     nativeHistogramBucketFactor,
+	NativeHistogramMaxBucketNumber:  nativeHistogramMaxBucketNumber,
+	NativeHistogramMinResetDuration: nativeHistogramMinResetDuration,
+},
+	[]string{"domain", "path"},
+)
+
+var websocketMessageCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "baker",
+		Name:      "websocket_message_count",
+		Help:      "How many WebSocket messages were proxied, partitioned by HTTP path (with patterns) and direction (inbound from the client, outbound from the container).",
+	},
+	[]string{"domain", "path", "direction"},
+)
+
+var cacheRequestCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "baker",
+		Name:      "cache_request_count",
+		Help:      "How many requests went through the HTTPCache rule, partitioned by domain and cache status (HIT, MISS, STALE, REVALIDATED, BYPASS).",
+	},
+	[]string{"domain", "status"},
+)
+
 var infoGuage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 	Namespace: "baker",
 	Name:      "info",
@@ -50,29 +214,91 @@ func SetInfo(version, commit string) {
 }
 
 func HttpRequestCount(domain string, path string, method string, code int) {
+	domain, path = requestPathLabels.get(domain, path)
+
 	httpRequestCount.With(prometheus.Labels{
 		"domain": domain,
-		"method": method,
+		"method": methodLabel(method),
 		"path":   path,
 		"code":   strconv.FormatInt(int64(code), 10),
 	}).Inc()
 }
 
 func HttpRequestDuration(domain string, path string, method string, code int, duration float64) {
+	domain, path = requestPathLabels.get(domain, path)
+
 	httpRequestDuration.With(prometheus.Labels{
 		"domain": domain,
-		"method": method,
+		"method": methodLabel(method),
 		"path":   path,
 		"code":   strconv.FormatInt(int64(code), 10),
 	}).Observe(duration)
 }
 
 func WebsocketRequest(domain string, path string, method string, code int) {
+	domain, path = requestPathLabels.get(domain, path)
+
 	websocketRequestCount.With(prometheus.Labels{
 		"domain": domain,
-		"method": method,
+		"method": methodLabel(method),
+		"path":   path,
+		"code":   strconv.FormatInt(int64(code), 10),
+	}).Inc()
+}
+
+func HttpRequestSize(domain string, path string, method string, size int64) {
+	domain, path = requestPathLabels.get(domain, path)
+
+	httpRequestSize.With(prometheus.Labels{
+		"domain": domain,
+		"method": methodLabel(method),
+		"path":   path,
+	}).Observe(float64(size))
+}
+
+func HttpResponseSize(domain string, path string, method string, code int, size int64) {
+	domain, path = requestPathLabels.get(domain, path)
+
+	httpResponseSize.With(prometheus.Labels{
+		"domain": domain,
+		"method": methodLabel(method),
 		"path":   path,
 		"code":   strconv.FormatInt(int64(code), 10),
+	}).Observe(float64(size))
+}
+
+// RequestStart increments the in-flight gauge, the returned
+// function decrements it once the request is done
+func RequestStart() func() {
+	httpRequestsInFlight.Inc()
+	return httpRequestsInFlight.Dec
+}
+
+func WebsocketConnectionDuration(domain string, path string, duration float64) {
+	domain, path = requestPathLabels.get(domain, path)
+
+	websocketConnectionDuration.With(prometheus.Labels{
+		"domain": domain,
+		"path":   path,
+	}).Observe(duration)
+}
+
+// WebsocketMessageCounter returns the function called for each message of
+// a WebSocket connection, direction is either inbound or outbound
+func WebsocketMessageCounter(domain string, path string, direction string) func() {
+	domain, path = requestPathLabels.get(domain, path)
+
+	return websocketMessageCount.With(prometheus.Labels{
+		"domain":    domain,
+		"path":      path,
+		"direction": direction,
+	}).Inc
+}
+
+func CacheRequest(domain string, status string) {
+	cacheRequestCount.With(prometheus.Labels{
+		"domain": domain,
+		"status": status,
 	}).Inc()
 }
 
@@ -84,7 +310,29 @@ func SetupHandler() http.Handler {
 		infoGuage,
 		httpRequestCount,
 		httpRequestDuration,
+		httpRequestSize,
+		httpResponseSize,
+		httpRequestsInFlight,
 		websocketRequestCount,
+		websocketConnectionDuration,
+		websocketMessageCount,
+		cacheRequestCount,
+		upstreamRequestCount,
+		upstreamTTFB,
+		upstreamDuration,
+		upstreamActiveConnections,
+		upstreamDialErrorCount,
+		upstreamHealth,
+		upstreamPingDuration,
+		upstreamPingFailureCount,
+		runnerQueueDepth,
+		runnerDroppedEventCount,
+		runnerEventDuration,
+		domainCount,
+		pathCount,
+		containerCount,
+		middlewareCacheSize,
+		driverReconnectCount,
 	)
 
 	// Create a custom http serve mux
@@ -0,0 +1,59 @@
+package metrics
+
+import "testing"
+
+func TestPathLabels(t *testing.T) {
+	labels := &pathLabels{
+		max:  2,
+		seen: make(map[[2]string]struct{}),
+	}
+
+	tests := []struct {
+		domain, path         string
+		wantDomain, wantPath string
+	}{
+		{"example.com", "/api/*", "example.com", "/api/*"},
+		{"example.com", "/static/*", "example.com", "/static/*"},
+		{"example.com", "/admin/*", OverflowLabel, OverflowLabel},
+		{"example.com", "/api/*", "example.com", "/api/*"},
+		{UnmatchedLabel, UnmatchedLabel, UnmatchedLabel, UnmatchedLabel},
+	}
+	for _, tt := range tests {
+		domain, path := labels.get(tt.domain, tt.path)
+		if domain != tt.wantDomain || path != tt.wantPath {
+			t.Errorf("get(%s, %s) = (%s, %s), want (%s, %s)", tt.domain, tt.path, domain, path, tt.wantDomain, tt.wantPath)
+		}
+	}
+}
+
+func TestPathLabelsRelease(t *testing.T) {
+	labels := &pathLabels{
+		max:  1,
+		seen: make(map[[2]string]struct{}),
+	}
+
+	labels.get("example.com", "/api/*")
+
+	if domain, _ := labels.get("example.com", "/admin/*"); domain != OverflowLabel {
+		t.Fatalf("expected %s, got %s", OverflowLabel, domain)
+	}
+
+	labels.release("example.com", "/api/*")
+
+	if domain, path := labels.get("example.com", "/admin/*"); domain != "example.com" || path != "/admin/*" {
+		t.Errorf("expected the released slot to be used, got (%s, %s)", domain, path)
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	for method, want := range map[string]string{
+		"GET":      "GET",
+		"OPTIONS":  "OPTIONS",
+		"get":      "OTHER",
+		"PROPFIND": "OTHER",
+	} {
+		if got := methodLabel(method); got != want {
+			t.Errorf("methodLabel(%s) = %s, want %s", method, got, want)
+		}
+	}
+}
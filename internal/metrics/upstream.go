@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var upstreamRequestCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "baker",
+		Name:      "upstream_request_count",
+		Help:      "How many requests were sent to the containers, partitioned by container id and status code (error if no response was received).",
+	},
+	[]string{"container_id", "code"},
+)
+
+var upstreamTTFB = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "baker",
+	Name:      "upstream_ttfb_seconds",
+	Help:      "How long it took for the container to send the response headers, partitioned by container id.",
+	Buckets:   prometheus.DefBuckets,
+
+	NativeHistogramBucketFactor:     nativeHistogramBucketFactor,
+	NativeHistogramMaxBucketNumber:  nativeHistogramMaxBucketNumber,
+	NativeHistogramMinResetDuration: nativeHistogramMinResetDuration,
+},
+	[]string{"container_id"},
+)
+
+var upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "baker",
+	Name:      "upstream_duration_seconds",
+	Help:      "How long it took for the container to send the whole response, partitioned by container id.",
+	Buckets:   prometheus.DefBuckets,
+
+	NativeHistogramBucketFactor:     nativeHistogramBucketFactor,
+	NativeHistogramMaxBucketNumber:  nativeHistogramMaxBucketNumber,
+	NativeHistogramMinResetDuration: nativeHistogramMinResetDuration,
+},
+	[]string{"container_id"},
+)
+
+var upstreamActiveConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "baker",
+	Name:      "upstream_active_connections",
+	Help:      "How many requests and WebSocket connections to the container are in progress, partitioned by container id.",
+},
+	[]string{"container_id"},
+)
+
+var upstreamDialErrorCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "baker",
+		Name:      "upstream_dial_error_count",
+		Help:      "How many times baker failed to connect to the container, partitioned by container id.",
+	},
+	[]string{"container_id"},
+)
+
+var upstreamHealth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "baker",
+	Name:      "upstream_health",
+	Help:      "1 if the last config ping of the container succeeded, 0 otherwise, partitioned by container id.",
+},
+	[]string{"container_id"},
+)
+
+var upstreamPingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "baker",
+	Name:      "upstream_ping_duration_seconds",
+	Help:      "How long it took to fetch the config of the container, partitioned by container id.",
+	Buckets:   prometheus.DefBuckets,
+
+	NativeHistogramBucketFactor:     nativeHistogramBucketFactor,
+	NativeHistogramMaxBucketNumber:  nativeHistogramMaxBucketNumber,
+	NativeHistogramMinResetDuration: nativeHistogramMinResetDuration,
+},
+	[]string{"container_id"},
+)
+
+var upstreamPingFailureCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "baker",
+		Name:      "upstream_ping_failure_count",
+		Help:      "How many config pings of the container failed, partitioned by container id and reason (request, status, decode).",
+	},
+	[]string{"container_id", "reason"},
+)
+
+// UpstreamRequestStart marks the beginning of a request or a WebSocket connection to the container
+func UpstreamRequestStart(containerID string) {
+	upstreamActiveConnections.WithLabelValues(containerID).Inc()
+}
+
+// UpstreamRequestEnd marks the end of a request started with UpstreamRequestStart,
+// code is 0 if the container didn't send a response
+func UpstreamRequestEnd(containerID string, code int) {
+	label := "error"
+	if code != 0 {
+		label = strconv.FormatInt(int64(code), 10)
+	}
+
+	upstreamActiveConnections.WithLabelValues(containerID).Dec()
+	upstreamRequestCount.WithLabelValues(containerID, label).Inc()
+}
+
+func UpstreamTTFB(containerID string, duration float64) {
+	upstreamTTFB.WithLabelValues(containerID).Observe(duration)
+}
+
+func UpstreamDuration(containerID string, duration float64) {
+	upstreamDuration.WithLabelValues(containerID).Observe(duration)
+}
+
+func UpstreamDialError(containerID string) {
+	upstreamDialErrorCount.WithLabelValues(containerID).Inc()
+}
+
+func UpstreamHealth(containerID string, healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	upstreamHealth.WithLabelValues(containerID).Set(value)
+}
+
+func UpstreamPingDuration(containerID string, duration float64) {
+	upstreamPingDuration.WithLabelValues(containerID).Observe(duration)
+}
+
+func UpstreamPingFailure(containerID string, reason string) {
+	upstreamPingFailureCount.WithLabelValues(containerID, reason).Inc()
+}
+
+// RemoveUpstream deletes the metrics of a container which is gone,
+// so the number of series doesn't grow with every deployment
+func RemoveUpstream(containerID string) {
+	labels := prometheus.Labels{"container_id": containerID}
+
+	upstreamRequestCount.DeletePartialMatch(labels)
+	upstreamTTFB.DeletePartialMatch(labels)
+	upstreamDuration.DeletePartialMatch(labels)
+	upstreamActiveConnections.DeletePartialMatch(labels)
+	upstreamDialErrorCount.DeletePartialMatch(labels)
+	upstreamHealth.DeletePartialMatch(labels)
+	upstreamPingDuration.DeletePartialMatch(labels)
+	upstreamPingFailureCount.DeletePartialMatch(labels)
+}
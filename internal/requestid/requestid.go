@@ -0,0 +1,138 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	FormatUUIDv7 = "uuidv7"
+	FormatULID   = "ulid"
+)
+
+// maxLength is the longest request id accepted from the clients
+const maxLength = 128
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatUUIDv7, FormatULID:
+		return nil
+	default:
+		return fmt.Errorf("unknown request id format '%s', expected uuidv7 or ulid", format)
+	}
+}
+
+// New generates a request id in the given format, both formats start
+// with a millisecond timestamp so the ids are sorted by creation time
+func New(format string) string {
+	var b [16]byte
+	rand.Read(b[6:])
+
+	ms := uint64(time.Now().UnixMilli())
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+
+	if format == FormatULID {
+		return encodeULID(b)
+	}
+
+	// version 7 and variant 10, see RFC 9562 section 5.7
+	b[6] = (b[6] & 0x0f) | 0x70
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+
+	return string(buf[:])
+}
+
+// encodeULID encodes the 128 bits in 26 characters of Crockford's base32
+func encodeULID(b [16]byte) string {
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+
+	var buf [26]byte
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(buf[:])
+}
+
+// IsValid reports whether an id sent by a client can be used as is. Only short
+// ids made of safe characters are accepted, so they can't be used to inject
+// anything into the logs or the headers sent to the services.
+func IsValid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+type idKey struct{}
+
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+// FromContext returns the request id of the context, or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
+
+// LogHandler adds the request id to the records logged with a request context,
+// e.g. slog.ErrorContext(r.Context(), ...)
+type LogHandler struct {
+	slog.Handler
+}
+
+var _ slog.Handler = (*LogHandler)(nil)
+
+func NewLogHandler(h slog.Handler) *LogHandler {
+	return &LogHandler{Handler: h}
+}
+
+func (h *LogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := FromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithGroup(name)}
+}
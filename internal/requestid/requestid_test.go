@@ -0,0 +1,78 @@
+package requestid_test
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"ella.to/baker/internal/requestid"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		format string
+		re     *regexp.Regexp
+	}{
+		{format: requestid.FormatUUIDv7, re: regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		{format: requestid.FormatULID, re: regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			seen := map[string]bool{}
+
+			prev := ""
+			for range 1000 {
+				id := requestid.New(tt.format)
+				if !tt.re.MatchString(id) {
+					t.Fatalf("invalid %s id %q", tt.format, id)
+				}
+
+				if seen[id] {
+					t.Fatalf("duplicate id %q", id)
+				}
+				seen[id] = true
+
+				// the timestamp prefix keeps the ids sorted across milliseconds
+				if prev != "" && id[:8] < prev[:8] {
+					t.Fatalf("id %q is sorted before %q", id, prev)
+				}
+				prev = id
+
+				if !requestid.IsValid(id) {
+					t.Fatalf("generated id %q is not valid", id)
+				}
+			}
+		})
+	}
+}
+
+func TestIsValid(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{id: "abc-123", want: true},
+		{id: "0190b7a4-3f9e-7c1d-8a2b-3c4d5e6f7a8b", want: true},
+		{id: "trace:1/span=2", want: true},
+		{id: "", want: false},
+		{id: "with space", want: false},
+		{id: "line\nbreak", want: false},
+		{id: string(make([]byte, 129)), want: false},
+	}
+	for _, tt := range tests {
+		if got := requestid.IsValid(tt.id); got != tt.want {
+			t.Errorf("IsValid(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	ctx := requestid.WithID(context.Background(), "abc")
+
+	// the values of the other packages don't replace the request id
+	ctx = context.WithValue(ctx, &struct{}{}, "other")
+
+	if id := requestid.FromContext(ctx); id != "abc" {
+		t.Errorf("FromContext() = %q, want abc", id)
+	}
+}
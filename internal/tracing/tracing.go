@@ -0,0 +1,451 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Kind int
+
+// span kinds as defined by OTLP
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type StatusCode int
+
+// span status codes as defined by OTLP
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext is the part of a span which is propagated to other services
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+// ParseTraceparent parses a W3C traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, fmt.Errorf("invalid traceparent '%s'", value)
+	}
+
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+
+	// version ff is invalid, and version 00 doesn't allow more fields
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("unsupported traceparent version '%s'", version)
+	}
+
+	if len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 {
+		return sc, fmt.Errorf("invalid traceparent '%s'", value)
+	}
+
+	if strings.ToLower(value) != value {
+		return sc, fmt.Errorf("traceparent must be lowercase")
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(traceID)); err != nil || !sc.TraceID.IsValid() {
+		return sc, fmt.Errorf("invalid trace id '%s'", traceID)
+	}
+
+	if _, err := hex.Decode(sc.SpanID[:], []byte(spanID)); err != nil || !sc.SpanID.IsValid() {
+		return sc, fmt.Errorf("invalid span id '%s'", spanID)
+	}
+
+	var f [1]byte
+	if _, err := hex.Decode(f[:], []byte(flags)); err != nil {
+		return sc, fmt.Errorf("invalid trace flags '%s'", flags)
+	}
+	sc.Sampled = f[0]&0x01 == 0x01
+
+	return sc, nil
+}
+
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Span is a single operation of a trace, spans which are not sampled
+// are still propagated but never exported. All the methods can be
+// called on a nil span, which is returned when tracing is disabled.
+type Span struct {
+	tracer *Tracer
+
+	mu            sync.Mutex
+	name          string
+	kind          Kind
+	spanContext   SpanContext
+	parentSpanID  SpanID
+	start         time.Time
+	end           time.Time
+	attributes    []Attribute
+	statusCode    StatusCode
+	statusMessage string
+	ended         bool
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.spanContext
+}
+
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.name = name
+}
+
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil || !s.spanContext.Sampled {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes = append(s.attributes, attrs...)
+}
+
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.statusCode = code
+	s.statusMessage = message
+}
+
+// RecordError marks the span as failed
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.SetStatus(StatusError, err.Error())
+}
+
+// End finishes the span and queues it for export, calling it more than once does nothing
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.spanContext.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// SpanFromContext returns the current span, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+func spanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.spanContext, true
+	}
+
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Inject writes the traceparent and tracestate headers of the current span
+func Inject(ctx context.Context, header http.Header) {
+	sc, ok := spanContextFromContext(ctx)
+	if !ok {
+		return
+	}
+
+	header.Set("traceparent", sc.Traceparent())
+	if sc.TraceState != "" {
+		header.Set("tracestate", sc.TraceState)
+	} else {
+		header.Del("tracestate")
+	}
+}
+
+// Exporter sends the ended spans to a tracing backend
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+}
+
+const (
+	defaultQueueSize     = 2048
+	defaultBatchSize     = 512
+	defaultFlushInterval = 5 * time.Second
+)
+
+type Tracer struct {
+	exporter      Exporter
+	sampleRate    float64
+	trustParent   bool
+	batchSize     int
+	flushInterval time.Duration
+
+	queue    chan *Span
+	done     chan struct{}
+	stopped  chan struct{}
+	shutdown sync.Once
+}
+
+type Option func(*Tracer)
+
+// WithSampleRate sets the fraction of the traces which are sampled. It applies to the
+// traces started by the clients as well, any client can send a sampled traceparent and
+// they would all be exported otherwise. A trace which isn't sampled by the client is
+// never sampled.
+func WithSampleRate(rate float64) Option {
+	return func(t *Tracer) {
+		t.sampleRate = min(max(rate, 0), 1)
+	}
+}
+
+// WithTrustedParent follows the decision of the clients which send a sampled traceparent,
+// instead of applying the sample rate to them. Only use it if the clients are trusted,
+// e.g. other services sampling their own traces.
+func WithTrustedParent() Option {
+	return func(t *Tracer) {
+		t.trustParent = true
+	}
+}
+
+// WithBatch sets how many spans are exported at once, and how long
+// the spans are held before being exported
+func WithBatch(size int, interval time.Duration) Option {
+	return func(t *Tracer) {
+		t.batchSize = size
+		t.flushInterval = interval
+	}
+}
+
+func New(exporter Exporter, opts ...Option) *Tracer {
+	t := &Tracer{
+		exporter:      exporter,
+		sampleRate:    1,
+		batchSize:     defaultBatchSize,
+		flushInterval: defaultFlushInterval,
+		queue:         make(chan *Span, defaultQueueSize),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	go t.run()
+
+	return t
+}
+
+// Extract reads the traceparent and tracestate headers sent by the client,
+// the next span started from the returned context is their child
+func (t *Tracer) Extract(ctx context.Context, header http.Header) context.Context {
+	if t == nil {
+		return ctx
+	}
+
+	value := header.Get("traceparent")
+	if value == "" {
+		return ctx
+	}
+
+	sc, err := ParseTraceparent(value)
+	if err != nil {
+		return ctx
+	}
+	sc.TraceState = header.Get("tracestate")
+
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Start creates a span which is the child of the current span of ctx, or the root of a new trace
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.spanContext.TraceID = parent.spanContext.TraceID
+		span.spanContext.Sampled = parent.spanContext.Sampled
+		span.spanContext.TraceState = parent.spanContext.TraceState
+		span.parentSpanID = parent.spanContext.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		span.spanContext.TraceID = remote.TraceID
+		span.spanContext.Sampled = remote.Sampled && (t.trustParent || t.sample())
+		span.spanContext.TraceState = remote.TraceState
+		span.parentSpanID = remote.SpanID
+	} else {
+		rand.Read(span.spanContext.TraceID[:])
+		span.spanContext.Sampled = t.sample()
+	}
+
+	rand.Read(span.spanContext.SpanID[:])
+
+	span.SetAttributes(attrs...)
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *Tracer) sample() bool {
+	return t.sampleRate >= 1 || mathrand.Float64() < t.sampleRate
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		slog.Debug("tracing queue is full, dropping span", "name", span.name)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, t.batchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			slog.Error("failed to export spans", "count", len(batch), "error", err)
+		}
+
+		batch = make([]*Span, 0, t.batchSize)
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown exports the queued spans and stops the tracer
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	t.shutdown.Do(func() {
+		close(t.done)
+	})
+
+	select {
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,205 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"ella.to/baker/internal/tracing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		wantErr     bool
+		wantSampled bool
+	}{
+		{name: "sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantSampled: true},
+		{name: "not sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{name: "future version", value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", wantSampled: true},
+		{name: "version ff", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantErr: true},
+		{name: "extra fields", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", wantErr: true},
+		{name: "zero trace id", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", wantErr: true},
+		{name: "zero span id", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", wantErr: true},
+		{name: "uppercase", value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", wantErr: true},
+		{name: "short", value: "00-4bf92f3577b34da6-00f067aa0ba902b7-01", wantErr: true},
+		{name: "garbage", value: "hello", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := tracing.ParseTraceparent(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+				t.Fatalf("unexpected span context %s", sc.Traceparent())
+			}
+
+			if sc.Sampled != tt.wantSampled {
+				t.Fatalf("sampled = %v, want %v", sc.Sampled, tt.wantSampled)
+			}
+		})
+	}
+}
+
+// collector is a stand-in for an OpenTelemetry collector
+type collector struct {
+	mu    sync.Mutex
+	spans []map[string]any
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]any `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, rs := range payload.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func (c *collector) Spans() []map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]map[string]any(nil), c.spans...)
+}
+
+func TestTracerExport(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	tracer := tracing.New(tracing.NewOTLPExporter(server.URL, "baker", nil), tracing.WithBatch(10, time.Hour))
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	header.Set("tracestate", "vendor=value")
+
+	ctx, parent := tracer.Start(tracer.Extract(context.Background(), header), "GET /", tracing.KindServer, tracing.String("url.path", "/"))
+	_, child := tracer.Start(ctx, "upstream", tracing.KindClient, tracing.Int("http.response.status_code", 502))
+	child.SetStatus(tracing.StatusError, "bad gateway")
+	child.End()
+	parent.End()
+
+	outgoing := http.Header{}
+	tracing.Inject(ctx, outgoing)
+	if outgoing.Get("traceparent") != parent.SpanContext().Traceparent() || outgoing.Get("tracestate") != "vendor=value" {
+		t.Fatalf("unexpected propagated headers %v", outgoing)
+	}
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := c.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	upstream, root := spans[0], spans[1]
+
+	if root["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" || root["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Errorf("server span doesn't continue the trace of the client: %v", root)
+	}
+
+	if upstream["traceId"] != root["traceId"] || upstream["parentSpanId"] != root["spanId"] {
+		t.Errorf("upstream span is not the child of the server span: %v", upstream)
+	}
+
+	if upstream["kind"] != float64(tracing.KindClient) || root["kind"] != float64(tracing.KindServer) {
+		t.Errorf("unexpected span kinds %v and %v", upstream["kind"], root["kind"])
+	}
+
+	status, _ := upstream["status"].(map[string]any)
+	if status["code"] != float64(tracing.StatusError) {
+		t.Errorf("unexpected upstream status %v", upstream["status"])
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	tracer := tracing.New(tracing.NewOTLPExporter("http://127.0.0.1:0", "baker", nil), tracing.WithSampleRate(0))
+	defer tracer.Shutdown(context.Background())
+
+	_, span := tracer.Start(context.Background(), "root", tracing.KindServer)
+	if span.SpanContext().Sampled {
+		t.Error("new traces should not be sampled with a sample rate of 0")
+	}
+
+	// the sample rate applies to the traces sampled by the client
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, span := tracer.Start(tracer.Extract(context.Background(), header), "child", tracing.KindServer)
+	if span.SpanContext().Sampled {
+		t.Error("traces sampled by the client should not be sampled with a sample rate of 0")
+	}
+	if span.SpanContext().TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the span to join the trace of the client, got %s", span.SpanContext().TraceID)
+	}
+
+	// the spans started inside baker follow the decision of their parent
+	_, child := tracer.Start(ctx, "upstream", tracing.KindClient)
+	if child.SpanContext().Sampled != span.SpanContext().Sampled {
+		t.Error("child spans should follow the decision of their parent")
+	}
+
+	// the decision of a trusted client is followed
+	trusting := tracing.New(tracing.NewOTLPExporter("http://127.0.0.1:0", "baker", nil), tracing.WithSampleRate(0), tracing.WithTrustedParent())
+	defer trusting.Shutdown(context.Background())
+
+	_, span = trusting.Start(trusting.Extract(context.Background(), header), "child", tracing.KindServer)
+	if !span.SpanContext().Sampled {
+		t.Error("traces sampled by a trusted client should be sampled")
+	}
+
+	// a trace which isn't sampled by the client is never sampled
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	_, span = trusting.Start(trusting.Extract(context.Background(), header), "child", tracing.KindServer)
+	if span.SpanContext().Sampled {
+		t.Error("traces not sampled by the client should not be sampled")
+	}
+
+	// a nil tracer is a disabled tracer
+	var disabled *tracing.Tracer
+	ctx, span = disabled.Start(context.Background(), "disabled", tracing.KindServer)
+	span.SetAttributes(tracing.String("key", "value"))
+	span.End()
+
+	if tracing.SpanFromContext(ctx) != nil {
+		t.Error("a disabled tracer should not create spans")
+	}
+}
@@ -0,0 +1,164 @@
+package baker
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"ella.to/baker/rule"
+)
+
+var maintenanceBuilders = func() map[string]rule.BuilderFunc {
+	builders := make(map[string]rule.BuilderFunc)
+	rule.RegisterMaintenance()(builders)
+	return builders
+}()
+
+// Maintenance puts a domain, or the paths of a domain, into maintenance. Path follows
+// the same rules as the endpoints, e.g. "/api/*", and an empty path means the whole
+// domain. Args are the args of the Maintenance rule.
+type Maintenance struct {
+	Domain     string          `json:"domain"`
+	Path       string          `json:"path"`
+	Args       json.RawMessage `json:"args,omitempty"`
+	middleware rule.Middleware
+}
+
+func (m *Maintenance) matches(path string) bool {
+	if prefix, ok := strings.CutSuffix(m.Path, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return m.Path == path
+}
+
+// maintenanceList holds the domains and paths in maintenance, it is checked
+// before looking for a container so it works even if no container is running
+type maintenanceList struct {
+	rw      sync.RWMutex
+	domains map[string][]*Maintenance
+}
+
+func newMaintenanceList() *maintenanceList {
+	return &maintenanceList{
+		domains: make(map[string][]*Maintenance),
+	}
+}
+
+func (l *maintenanceList) set(m *Maintenance) {
+	l.rw.Lock()
+	defer l.rw.Unlock()
+
+	entries := slices.DeleteFunc(l.domains[m.Domain], func(e *Maintenance) bool {
+		return e.Path == m.Path
+	})
+
+	l.domains[m.Domain] = append(entries, m)
+}
+
+func (l *maintenanceList) remove(domain, path string) bool {
+	l.rw.Lock()
+	defer l.rw.Unlock()
+
+	entries, ok := l.domains[domain]
+	if !ok {
+		return false
+	}
+
+	size := len(entries)
+
+	entries = slices.DeleteFunc(entries, func(e *Maintenance) bool {
+		return e.Path == path
+	})
+
+	if len(entries) == 0 {
+		delete(l.domains, domain)
+	} else {
+		l.domains[domain] = entries
+	}
+
+	return len(entries) != size
+}
+
+// get returns the most specific maintenance for the path, or nil
+func (l *maintenanceList) get(domain, path string) *Maintenance {
+	l.rw.RLock()
+	defer l.rw.RUnlock()
+
+	var found *Maintenance
+
+	for _, m := range l.domains[domain] {
+		if m.matches(path) && (found == nil || len(m.Path) > len(found.Path)) {
+			found = m
+		}
+	}
+
+	return found
+}
+
+func (l *maintenanceList) list() []Maintenance {
+	l.rw.RLock()
+	defer l.rw.RUnlock()
+
+	result := make([]Maintenance, 0)
+	for _, entries := range l.domains {
+		for _, m := range entries {
+			result = append(result, Maintenance{
+				Domain: m.Domain,
+				Path:   m.Path,
+				Args:   m.Args,
+			})
+		}
+	}
+
+	slices.SortFunc(result, func(a, b Maintenance) int {
+		return strings.Compare(a.Domain+a.Path, b.Domain+b.Path)
+	})
+
+	return result
+}
+
+func normalizeMaintenancePath(path string) string {
+	if path == "" {
+		return "/*"
+	}
+	return path
+}
+
+// SetMaintenance puts the domain and path into maintenance, or updates
+// the args if they are already in maintenance
+func (s *Server) SetMaintenance(domain string, path string, args json.RawMessage) error {
+	if domain == "" {
+		return fmt.Errorf("domain is required")
+	}
+
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+
+	middleware, err := maintenanceBuilders[rule.MaintenanceName](args)
+	if err != nil {
+		return fmt.Errorf("failed to parse maintenance args: %w", err)
+	}
+
+	s.maintenance.set(&Maintenance{
+		Domain:     domain,
+		Path:       normalizeMaintenancePath(path),
+		Args:       args,
+		middleware: middleware,
+	})
+
+	return nil
+}
+
+// RemoveMaintenance takes the domain and path out of maintenance,
+// it returns false if they were not in maintenance
+func (s *Server) RemoveMaintenance(domain string, path string) bool {
+	return s.maintenance.remove(domain, normalizeMaintenancePath(path))
+}
+
+// Maintenances returns the domains and paths in maintenance
+func (s *Server) Maintenances() []Maintenance {
+	return s.maintenance.list()
+}
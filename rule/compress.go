@@ -0,0 +1,467 @@
+package rule
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"ella.to/baker/internal/accesslog"
+)
+
+const CompressName = "Compress"
+
+const defaultCompressMinSize = 1 << 10
+
+var defaultCompressEncodings = []string{"br", "zstd", "gzip"}
+
+var defaultCompressContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/x-javascript",
+	"application/wasm",
+	"image/svg+xml",
+	"application/problem+json",
+	"application/ld+json",
+	"application/manifest+json",
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {
+		New: func() any {
+			w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+			return w
+		},
+	},
+	"br": {
+		New: func() any {
+			return brotli.NewWriterLevel(io.Discard, brotli.DefaultCompression)
+		},
+	},
+	"zstd": {
+		New: func() any {
+			w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+			return w
+		},
+	},
+}
+
+// Compress compresses the responses based on the Accept-Encoding header of the request
+type Compress struct {
+	Encodings    []string `json:"encodings,omitempty"`
+	ContentTypes []string `json:"content_types,omitempty"`
+	MinSize      ByteSize `json:"min_size,omitempty"`
+}
+
+var _ Middleware = (*Compress)(nil)
+
+func (c *Compress) IsCachable() bool {
+	return false
+}
+
+func (c *Compress) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (c *Compress) validate() error {
+	for _, encoding := range c.Encodings {
+		if _, ok := encoderPools[encoding]; !ok {
+			return fmt.Errorf("unsupported encoding '%s'", encoding)
+		}
+	}
+	return nil
+}
+
+func (c *Compress) encodings() []string {
+	if len(c.Encodings) == 0 {
+		return defaultCompressEncodings
+	}
+	return c.Encodings
+}
+
+func (c *Compress) minSize() int {
+	if c.MinSize <= 0 {
+		return defaultCompressMinSize
+	}
+	return int(c.MinSize)
+}
+
+func (c *Compress) isCompressible(contentType string) bool {
+	contentTypes := c.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = defaultCompressContentTypes
+	}
+
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "" {
+		return false
+	}
+
+	for _, prefix := range contentTypes {
+		if strings.HasPrefix(contentType, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiateEncoding picks the first of the supported encodings accepted by the client,
+// see RFC 9110 section 12.5.3
+func negotiateEncoding(acceptEncoding string, supported []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.TrimSpace(key) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		accepted[name] = q
+	}
+
+	for _, encoding := range supported {
+		if q, ok := accepted[encoding]; ok {
+			if q > 0 {
+				return encoding
+			}
+			continue
+		}
+
+		if q, ok := accepted["*"]; ok && q > 0 {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+func (c *Compress) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), c.encodings())
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			w:        w,
+			r:        r,
+			encoding: encoding,
+			config:   c,
+		}
+		defer cw.Close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds the beginning of the response until it knows whether the
+// response should be compressed, which happens once min_size bytes are written,
+// the response is flushed or the handler is done.
+type compressWriter struct {
+	w          http.ResponseWriter
+	r          *http.Request
+	encoding   string
+	config     *Compress
+	statusCode int
+	buf        bytes.Buffer
+	decided    bool
+	enc        encoder
+	hijacked   bool
+}
+
+var _ http.ResponseWriter = (*compressWriter)(nil)
+var _ http.Flusher = (*compressWriter)(nil)
+var _ http.Hijacker = (*compressWriter)(nil)
+
+func (c *compressWriter) Header() http.Header {
+	return c.w.Header()
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.statusCode != 0 {
+		return
+	}
+
+	// informational responses are sent right away and don't carry a body
+	if code >= 100 && code < 200 {
+		c.w.WriteHeader(code)
+		return
+	}
+
+	c.statusCode = code
+
+	// responses which can't be compressed don't need to be buffered
+	if !c.shouldCompress(false) {
+		c.decide(false)
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.statusCode == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if !c.decided {
+		c.buf.Write(p)
+		if c.buf.Len() >= c.config.minSize() {
+			if err := c.decide(c.shouldCompress(true)); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+
+	return c.w.Write(p)
+}
+
+// shouldCompress checks the response headers, if sizeKnown is false
+// the minimum size check is only done against the Content-Length header
+func (c *compressWriter) shouldCompress(sizeKnown bool) bool {
+	header := c.w.Header()
+
+	switch c.statusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+
+	if strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+
+	if !c.config.isCompressible(header.Get("Content-Type")) {
+		return false
+	}
+
+	if contentLength, err := strconv.Atoi(header.Get("Content-Length")); err == nil && contentLength < c.config.minSize() {
+		return false
+	}
+
+	if sizeKnown && c.buf.Len() < c.config.minSize() {
+		return false
+	}
+
+	return true
+}
+
+func (c *compressWriter) decide(compress bool) error {
+	c.decided = true
+
+	header := c.w.Header()
+
+	if c.config.isCompressible(header.Get("Content-Type")) && header.Get("Content-Encoding") == "" {
+		addVary(header, "Accept-Encoding")
+	}
+
+	if compress {
+		accesslog.Annotate(c.r.Context(), CompressName, c.encoding)
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+
+		// the compressed representation is not byte for byte
+		// identical anymore, so a strong ETag must become weak
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		c.enc = encoderPools[c.encoding].Get().(encoder)
+		c.enc.Reset(c.w)
+	}
+
+	c.w.WriteHeader(c.statusCode)
+
+	if c.buf.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	if c.enc != nil {
+		_, err = c.enc.Write(c.buf.Bytes())
+	} else {
+		_, err = c.w.Write(c.buf.Bytes())
+	}
+	c.buf = bytes.Buffer{}
+
+	return err
+}
+
+// Flush sends whatever is written so far to the client. A streamed response
+// is compressed even if it is smaller than min_size, since its final size is unknown.
+func (c *compressWriter) Flush() {
+	if c.hijacked {
+		return
+	}
+
+	if c.statusCode == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if !c.decided {
+		c.decide(c.shouldCompress(false))
+	}
+
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+
+	http.NewResponseController(c.w).Flush()
+}
+
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := c.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		c.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.w
+}
+
+// Close sends the rest of the response, it is called once the handler is done
+func (c *compressWriter) Close() error {
+	if c.hijacked || c.statusCode == 0 {
+		return nil
+	}
+
+	if !c.decided {
+		if err := c.decide(false); err != nil {
+			return err
+		}
+	}
+
+	if c.enc == nil {
+		return nil
+	}
+
+	err := c.enc.Close()
+	c.enc.Reset(io.Discard)
+	encoderPools[c.encoding].Put(c.enc)
+	c.enc = nil
+
+	return err
+}
+
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.EqualFold(v, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+type CompressOption func(*Compress)
+
+// WithCompressEncodings sets the supported encodings in order of preference
+func WithCompressEncodings(encodings ...string) CompressOption {
+	return func(c *Compress) {
+		c.Encodings = slices.Clone(encodings)
+	}
+}
+
+// WithCompressContentTypes sets the prefixes of the content types to compress
+func WithCompressContentTypes(contentTypes ...string) CompressOption {
+	return func(c *Compress) {
+		c.ContentTypes = slices.Clone(contentTypes)
+	}
+}
+
+// WithCompressMinSize sets the size of the smallest response to compress
+func WithCompressMinSize(minSize int64) CompressOption {
+	return func(c *Compress) {
+		c.MinSize = ByteSize(minSize)
+	}
+}
+
+func NewCompress(opts ...CompressOption) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	compress := Compress{}
+
+	for _, opt := range opts {
+		opt(&compress)
+	}
+
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: CompressName,
+		Args: compress,
+	}
+}
+
+func RegisterCompress() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[CompressName] = func(raw json.RawMessage) (Middleware, error) {
+			compress := &Compress{}
+			err := json.Unmarshal(raw, compress)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := compress.validate(); err != nil {
+				return nil, err
+			}
+
+			return compress, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,194 @@
+package rule
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func newTestCompress(t *testing.T, args string) Middleware {
+	builders := map[string]BuilderFunc{}
+	if err := RegisterCompress()(builders); err != nil {
+		t.Fatal(err)
+	}
+
+	middleware, err := builders[CompressName](json.RawMessage(args))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return middleware
+}
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return string(body)
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{"br", "zstd", "gzip"}
+
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+		{"gzip, br;q=0", "gzip"},
+		{"zstd;q=0.5, gzip;q=1", "zstd"},
+		{"*", "br"},
+		{"*, br;q=0", "zstd"},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.acceptEncoding, supported); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat("hello world ", 200)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		encodingHeader string
+		body           string
+		wantEncoding   string
+	}{
+		{name: "gzip", acceptEncoding: "gzip", contentType: "application/json", body: large, wantEncoding: "gzip"},
+		{name: "brotli", acceptEncoding: "gzip, br", contentType: "text/html", body: large, wantEncoding: "br"},
+		{name: "zstd", acceptEncoding: "zstd", contentType: "text/plain", body: large, wantEncoding: "zstd"},
+		{name: "small body", acceptEncoding: "gzip", contentType: "text/plain", body: "hello", wantEncoding: ""},
+		{name: "image", acceptEncoding: "gzip", contentType: "image/png", body: large, wantEncoding: ""},
+		{name: "already encoded", acceptEncoding: "gzip", contentType: "text/plain", encodingHeader: "br", body: large, wantEncoding: "br"},
+		{name: "not accepted", acceptEncoding: "", contentType: "text/plain", body: large, wantEncoding: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Length", "999999")
+				if tt.encodingHeader != "" {
+					w.Header().Set("Content-Encoding", tt.encodingHeader)
+				}
+				// write in chunks to make sure buffering works
+				for i := 0; i < len(tt.body); i += 100 {
+					w.Write([]byte(tt.body[i:min(i+100, len(tt.body))]))
+				}
+			})
+
+			h := newTestCompress(t, `{}`).Process(upstream)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			if got := resp.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+
+			if tt.encodingHeader != "" {
+				return
+			}
+
+			if tt.wantEncoding != "" && resp.Header.Get("Content-Length") != "" {
+				t.Errorf("expected Content-Length to be removed")
+			}
+
+			if got := decompress(t, tt.wantEncoding, recorder.Body.Bytes()); got != tt.body {
+				t.Errorf("body mismatch, got %d bytes, want %d bytes", len(got), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestCompressFlush(t *testing.T) {
+	flushed := make(chan struct{})
+	done := make(chan struct{})
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		http.NewResponseController(w).Flush()
+		close(flushed)
+		<-done
+	})
+
+	h := newTestCompress(t, `{"encodings":["gzip"]}`).Process(upstream)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+
+	go func() {
+		<-flushed
+		defer close(done)
+
+		if !recorder.Flushed {
+			t.Error("expected response to be flushed")
+		}
+
+		gr, err := gzip.NewReader(bytes.NewReader(recorder.Body.Bytes()))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		buf := make([]byte, 64)
+		n, _ := gr.Read(buf)
+		if got := string(buf[:n]); got != "data: 1\n\n" {
+			t.Errorf("flushed body = %q", got)
+		}
+	}()
+
+	h.ServeHTTP(recorder, req)
+}
+
+func TestCompressInvalidEncoding(t *testing.T) {
+	builders := map[string]BuilderFunc{}
+	RegisterCompress()(builders)
+
+	if _, err := builders[CompressName](json.RawMessage(`{"encodings":["deflate"]}`)); err == nil {
+		t.Error("expected error for unsupported encoding")
+	}
+}
@@ -0,0 +1,122 @@
+package rule
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+
+	"ella.to/baker/internal/errorpage"
+)
+
+const ErrorPagesName = "ErrorPages"
+
+// ErrorPages sets how the errors of the endpoint are sent to the client, either
+// as plain text, html pages or json problem details (RFC 9457). The error
+// responses of the service listed in Intercept are replaced as well.
+type ErrorPages struct {
+	Format    string            `json:"format,omitempty"`
+	Templates map[string]string `json:"templates,omitempty"`
+	Intercept []int             `json:"intercept,omitempty"`
+	pages     *errorpage.Pages
+}
+
+var _ Middleware = (*ErrorPages)(nil)
+
+func (e *ErrorPages) IsCachable() bool {
+	return false
+}
+
+func (e *ErrorPages) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (e *ErrorPages) validate() error {
+	pages := &errorpage.Pages{
+		Format:    e.Format,
+		Templates: e.Templates,
+		Intercept: e.Intercept,
+	}
+
+	if err := pages.Compile(); err != nil {
+		return err
+	}
+
+	e.pages = pages
+
+	return nil
+}
+
+func (e *ErrorPages) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(errorpage.WithPages(r.Context(), e.pages))
+
+		if len(e.pages.Intercept) > 0 {
+			w = errorpage.NewInterceptWriter(w, r, e.pages)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type ErrorPagesOption func(*ErrorPages)
+
+// WithErrorPagesFormat sets the format of the error responses, text, html or json
+func WithErrorPagesFormat(format string) ErrorPagesOption {
+	return func(e *ErrorPages) {
+		e.Format = format
+	}
+}
+
+// WithErrorPagesTemplates sets the html templates keyed by status code, or "default"
+func WithErrorPagesTemplates(templates map[string]string) ErrorPagesOption {
+	return func(e *ErrorPages) {
+		e.Templates = maps.Clone(templates)
+	}
+}
+
+// WithErrorPagesIntercept replaces the responses of the service with the given status codes
+func WithErrorPagesIntercept(statusCodes ...int) ErrorPagesOption {
+	return func(e *ErrorPages) {
+		e.Intercept = slices.Clone(statusCodes)
+	}
+}
+
+func NewErrorPages(opts ...ErrorPagesOption) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	errorPages := ErrorPages{}
+
+	for _, opt := range opts {
+		opt(&errorPages)
+	}
+
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: ErrorPagesName,
+		Args: errorPages,
+	}
+}
+
+func RegisterErrorPages() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[ErrorPagesName] = func(raw json.RawMessage) (Middleware, error) {
+			errorPages := &ErrorPages{}
+			err := json.Unmarshal(raw, errorPages)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := errorPages.validate(); err != nil {
+				return nil, err
+			}
+
+			return errorPages, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,152 @@
+package rule
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestErrorPages(t *testing.T, args string) Middleware {
+	builders := map[string]BuilderFunc{}
+	RegisterErrorPages()(builders)
+
+	middleware, err := builders[ErrorPagesName](json.RawMessage(args))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return middleware
+}
+
+func TestErrorPagesFormat(t *testing.T) {
+	tests := []struct {
+		name            string
+		args            string
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "text",
+			args:            `{}`,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Too Many Requests\n",
+		},
+		{
+			name:            "json",
+			args:            `{"format":"json"}`,
+			wantContentType: "application/problem+json",
+			wantBody:        `{"type":"about:blank","title":"Too Many Requests","status":429,"instance":"/api"}`,
+		},
+		{
+			name:            "html default template",
+			args:            `{"format":"html"}`,
+			wantContentType: "text/html; charset=utf-8",
+			wantBody:        "<h1>429 Too Many Requests</h1>",
+		},
+		{
+			name:            "html status template",
+			args:            `{"format":"html","templates":{"429":"<p>slow down {{.Host}}</p>","default":"oops"}}`,
+			wantContentType: "text/html; charset=utf-8",
+			wantBody:        "<p>slow down example.com</p>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builders := map[string]BuilderFunc{}
+			RegisterRateLimiter()(builders)
+
+			// the rate limiter rejects every request after the first one
+			limiter, err := builders[RateLimiterName](json.RawMessage(`{"request_limit":1,"window_duration":"1m"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), newTestErrorPages(t, tt.args), limiter.UpdateMiddelware(nil))
+
+			for range 2 {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/api", nil)
+				req.RemoteAddr = "10.0.0.1:1234"
+
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, req)
+
+				if recorder.Code != http.StatusTooManyRequests {
+					continue
+				}
+
+				if got := recorder.Header().Get("Content-Type"); got != tt.wantContentType {
+					t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+				}
+
+				if got := recorder.Body.String(); !strings.Contains(got, tt.wantBody) {
+					t.Errorf("body = %q, want %q", got, tt.wantBody)
+				}
+
+				return
+			}
+
+			t.Fatal("expected the second request to be rate limited")
+		})
+	}
+}
+
+func TestErrorPagesIntercept(t *testing.T) {
+	h := newTestErrorPages(t, `{"format":"json","intercept":[502]}`).Process(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusNotFound
+		if r.URL.Path == "/broken" {
+			status = http.StatusBadGateway
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "13")
+		w.WriteHeader(status)
+		w.Write([]byte("stack trace!!"))
+	}))
+
+	tests := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{path: "/broken", wantCode: 502, wantBody: `{"type":"about:blank","title":"Bad Gateway","status":502,"instance":"/broken"}`},
+		{path: "/missing", wantCode: 404, wantBody: "stack trace!!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if recorder.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantCode)
+			}
+
+			if got := recorder.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestErrorPagesValidate(t *testing.T) {
+	builders := map[string]BuilderFunc{}
+	RegisterErrorPages()(builders)
+
+	tests := []struct {
+		name string
+		args string
+	}{
+		{name: "unknown format", args: `{"format":"xml"}`},
+		{name: "invalid template", args: `{"format":"html","templates":{"404":"{{.Missing"}}`},
+		{name: "invalid template key", args: `{"format":"html","templates":{"notfound":"oops"}}`},
+		{name: "intercept success", args: `{"intercept":[200]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := builders[ErrorPagesName](json.RawMessage(tt.args)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
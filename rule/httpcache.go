@@ -0,0 +1,692 @@
+package rule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ella.to/baker/internal/accesslog"
+	"ella.to/baker/internal/metrics"
+	"ella.to/baker/internal/requestid"
+	"ella.to/baker/rule/internal/cache"
+)
+
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// MarshalJSON implements the json.Marshaler interface for ByteSize.
+func (b ByteSize) MarshalJSON() ([]byte, error) {
+	for _, unit := range byteSizeUnits {
+		if b != 0 && int64(b)%unit.size == 0 {
+			return []byte(fmt.Sprintf(`"%d%s"`, int64(b)/unit.size, unit.suffix)), nil
+		}
+	}
+	return []byte(`"0B"`), nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface for ByteSize.
+// Both numbers (bytes) and strings with a unit, e.g. "10MB", are accepted.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	value := strings.TrimSpace(string(data))
+	if value == "" || value == "null" {
+		*b = 0
+		return nil
+	}
+
+	value = strings.ToUpper(strings.Trim(value, `"`))
+
+	for _, unit := range byteSizeUnits {
+		if !strings.HasSuffix(value, unit.suffix) {
+			continue
+		}
+
+		n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid size '%s'", value)
+		}
+
+		*b = ByteSize(n * unit.size)
+		return nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size '%s'", value)
+	}
+
+	*b = ByteSize(n)
+	return nil
+}
+
+const HTTPCacheName = "HTTPCache"
+
+const (
+	cacheStatusHit         = "HIT"
+	cacheStatusMiss        = "MISS"
+	cacheStatusStale       = "STALE"
+	cacheStatusRevalidated = "REVALIDATED"
+	cacheStatusBypass      = "BYPASS"
+)
+
+const (
+	defaultCacheMaxMemorySize = 64 << 20
+	defaultCacheMaxEntrySize  = 1 << 20
+	defaultCacheMaxDiskSize   = 1 << 30
+)
+
+// HTTPCache caches the responses of GET and HEAD requests, following the
+// rules of a shared cache described in RFC 9111
+type HTTPCache struct {
+	MaxMemorySize ByteSize        `json:"max_memory_size,omitempty"`
+	MaxEntrySize  ByteSize        `json:"max_entry_size,omitempty"`
+	DiskPath      string          `json:"disk_path,omitempty"`
+	MaxDiskSize   ByteSize        `json:"max_disk_size,omitempty"`
+	DefaultTTL    *WindowDuration `json:"default_ttl,omitempty"`
+
+	store        cache.Store
+	revalidating sync.Map // key -> struct{}, prevents concurrent background revalidations
+}
+
+var _ Middleware = (*HTTPCache)(nil)
+
+func (c *HTTPCache) IsCachable() bool {
+	return true
+}
+
+func (c *HTTPCache) isSame(other *HTTPCache) bool {
+	return c.MaxMemorySize == other.MaxMemorySize &&
+		c.MaxEntrySize == other.MaxEntrySize &&
+		c.DiskPath == other.DiskPath &&
+		c.MaxDiskSize == other.MaxDiskSize &&
+		c.defaultTTL() == other.defaultTTL()
+}
+
+func (c *HTTPCache) defaultTTL() time.Duration {
+	if c.DefaultTTL == nil {
+		return 0
+	}
+	return c.DefaultTTL.Duration
+}
+
+func (c *HTTPCache) maxEntrySize() int64 {
+	if c.MaxEntrySize <= 0 {
+		return defaultCacheMaxEntrySize
+	}
+	return int64(c.MaxEntrySize)
+}
+
+func (c *HTTPCache) build() (cache.Store, error) {
+	maxMemorySize := int64(c.MaxMemorySize)
+	if maxMemorySize <= 0 {
+		maxMemorySize = defaultCacheMaxMemorySize
+	}
+
+	store := cache.NewMemoryStore(maxMemorySize)
+
+	if c.DiskPath == "" {
+		return store, nil
+	}
+
+	maxDiskSize := int64(c.MaxDiskSize)
+	if maxDiskSize <= 0 {
+		maxDiskSize = defaultCacheMaxDiskSize
+	}
+
+	disk, err := cache.NewDiskStore(c.DiskPath, maxDiskSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return cache.NewTieredStore(store, disk), nil
+}
+
+func (c *HTTPCache) UpdateMiddelware(newImpl Middleware) Middleware {
+	if newImpl == nil {
+		slog.Debug(
+			"initializing for the first time",
+			"type", HTTPCacheName,
+			"max_memory_size", c.MaxMemorySize,
+			"disk_path", c.DiskPath,
+		)
+
+		if err := c.init(); err != nil {
+			slog.Error("failed to initialize middleware", "type", HTTPCacheName, "error", err)
+		}
+		return c
+	}
+
+	newC, ok := newImpl.(*HTTPCache)
+	if !ok {
+		slog.Error("failed to update middleware", "type", HTTPCacheName)
+		return c
+	}
+
+	if c.isSame(newC) && c.store != nil {
+		return c
+	}
+
+	slog.Debug(
+		"updating middleware",
+		"type", HTTPCacheName,
+		"max_memory_size", newC.MaxMemorySize,
+		"disk_path", newC.DiskPath,
+	)
+
+	if err := newC.init(); err != nil {
+		slog.Error("failed to update middleware", "type", HTTPCacheName, "error", err)
+		return c
+	}
+
+	return newC
+}
+
+func (c *HTTPCache) init() error {
+	store, err := c.build()
+	if err != nil {
+		return err
+	}
+	c.store = store
+	return nil
+}
+
+func (c *HTTPCache) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.store == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodOptions, http.MethodTrace, http.MethodConnect:
+			next.ServeHTTP(w, r)
+			return
+		default:
+			c.invalidate(w, r, next)
+			return
+		}
+
+		reqCC := cache.ParseCacheControl(r.Header)
+		if reqCC.Has("no-store") {
+			c.setStatus(w, r, cacheStatusBypass)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, entry := c.lookup(r)
+		if entry == nil {
+			c.fetch(w, r, key, next)
+			return
+		}
+
+		now := time.Now()
+		age := entry.Age(now)
+		lifetime := entry.FreshnessLifetime(c.defaultTTL())
+		respCC := entry.CacheControl()
+
+		mustRevalidate := respCC.Has("no-cache") || reqCC.Has("no-cache")
+		if maxAge, ok := reqCC.Duration("max-age"); ok && age > maxAge {
+			mustRevalidate = true
+		}
+		if minFresh, ok := reqCC.Duration("min-fresh"); ok && lifetime-age < minFresh {
+			mustRevalidate = true
+		}
+
+		if !mustRevalidate && age < lifetime {
+			c.serve(w, r, entry, age, cacheStatusHit)
+			return
+		}
+
+		if !mustRevalidate && !respCC.Has("must-revalidate") && !respCC.Has("proxy-revalidate") {
+			if swr, ok := respCC.Duration("stale-while-revalidate"); ok && age < lifetime+swr {
+				c.serve(w, r, entry, age, cacheStatusStale)
+				c.revalidateInBackground(r, key, entry, next)
+				return
+			}
+		}
+
+		if entry.HasValidator() {
+			c.revalidate(w, r, key, entry, next)
+			return
+		}
+
+		c.fetch(w, r, key, next)
+	})
+}
+
+func (c *HTTPCache) setStatus(w http.ResponseWriter, r *http.Request, status string) {
+	w.Header().Set("X-Cache", status)
+	metrics.CacheRequest(r.Host, status)
+	accesslog.Annotate(r.Context(), HTTPCacheName, status)
+}
+
+func primaryCacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// variantCacheKey builds the key of a response which depends on the
+// request headers listed in its Vary header
+func variantCacheKey(r *http.Request, variants []string) string {
+	var sb strings.Builder
+
+	sb.WriteString(primaryCacheKey(r))
+
+	for _, name := range variants {
+		sb.WriteString("\x00")
+		sb.WriteString(name)
+		sb.WriteString("=")
+		sb.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+
+	return sb.String()
+}
+
+func parseVary(header http.Header) []string {
+	variants := make([]string, 0)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !slices.Contains(variants, name) {
+				variants = append(variants, name)
+			}
+		}
+	}
+	slices.Sort(variants)
+	return variants
+}
+
+// lookup returns the key of the response for the request and the stored entry, if any
+func (c *HTTPCache) lookup(r *http.Request) (string, *cache.Entry) {
+	key := primaryCacheKey(r)
+
+	entry, ok := c.store.Get(key)
+	if !ok {
+		return key, nil
+	}
+
+	if len(entry.Variants) == 0 {
+		return key, entry
+	}
+
+	key = variantCacheKey(r, entry.Variants)
+
+	entry, ok = c.store.Get(key)
+	if !ok {
+		return key, nil
+	}
+
+	return key, entry
+}
+
+// save stores the response, if the response has a Vary header, it is stored
+// under the variant key and the primary key points to the list of variants
+func (c *HTTPCache) save(r *http.Request, entry *cache.Entry) {
+	variants := parseVary(entry.Header)
+	if len(variants) == 0 {
+		c.store.Put(primaryCacheKey(r), entry)
+		return
+	}
+
+	c.store.Put(primaryCacheKey(r), &cache.Entry{Variants: variants})
+	c.store.Put(variantCacheKey(r, variants), entry)
+}
+
+// invalidate removes the stored response once an unsafe request succeeds,
+// see RFC 9111 section 4.4
+func (c *HTTPCache) invalidate(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	cw := &cacheWriter{w: w, header: make(http.Header)}
+	next.ServeHTTP(cw, r)
+
+	if cw.statusCode < 400 {
+		c.store.Delete(primaryCacheKey(r))
+	}
+}
+
+func (c *HTTPCache) serve(w http.ResponseWriter, r *http.Request, entry *cache.Entry, age time.Duration, status string) {
+	header := w.Header()
+	for k, values := range entry.Header {
+		header[k] = values
+	}
+	header.Set("Age", strconv.FormatInt(int64(age.Seconds()), 10))
+
+	c.setStatus(w, r, status)
+
+	if isNotModified(r, entry.Header) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(entry.StatusCode)
+
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// isNotModified evaluates the conditional headers sent by the client against
+// the stored response, see RFC 9110 section 13.2.2
+func isNotModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+
+		lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+
+		return !lastModified.After(since)
+	}
+
+	return false
+}
+
+// fetch forwards the request to the upstream and stores the response while it is
+// being streamed to the client
+func (c *HTTPCache) fetch(w http.ResponseWriter, r *http.Request, key string, next http.Handler) {
+	c.setStatus(w, r, cacheStatusMiss)
+
+	cw := &cacheWriter{
+		w:       w,
+		header:  make(http.Header),
+		maxSize: c.maxEntrySize(),
+	}
+
+	requestTime := time.Now()
+	next.ServeHTTP(cw, r)
+
+	c.store.Delete(key)
+	c.storeResponse(r, cw, requestTime)
+}
+
+func (c *HTTPCache) storeResponse(r *http.Request, cw *cacheWriter, requestTime time.Time) {
+	if cw.overflow || !cache.IsStorable(r, cw.statusCode, cw.header, c.defaultTTL()) {
+		return
+	}
+
+	c.save(r, &cache.Entry{
+		StatusCode:   cw.statusCode,
+		Header:       storableHeader(cw.header),
+		Body:         cw.body.Bytes(),
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+	})
+}
+
+// revalidate sends a conditional request to the upstream. If the upstream responds with
+// 304 Not Modified, the stored response is updated and served, otherwise the new response
+// is streamed to the client and stored.
+func (c *HTTPCache) revalidate(w http.ResponseWriter, r *http.Request, key string, entry *cache.Entry, next http.Handler) {
+	// if the upstream sends a new response, it is streamed to the client as a MISS
+	w.Header().Set("X-Cache", cacheStatusMiss)
+
+	cw := &cacheWriter{
+		w:                   w,
+		header:              make(http.Header),
+		maxSize:             c.maxEntrySize(),
+		interceptNotModifed: true,
+	}
+
+	requestTime := time.Now()
+	next.ServeHTTP(cw, conditionalRequest(r, r.Context(), entry))
+
+	if cw.statusCode == http.StatusNotModified {
+		updated := entry.Update(cw.header, requestTime, time.Now())
+		c.store.Put(key, updated)
+		c.serve(w, r, updated, updated.Age(time.Now()), cacheStatusRevalidated)
+		return
+	}
+
+	metrics.CacheRequest(r.Host, cacheStatusMiss)
+	c.store.Delete(key)
+	c.storeResponse(r, cw, requestTime)
+}
+
+func (c *HTTPCache) revalidateInBackground(r *http.Request, key string, entry *cache.Entry, next http.Handler) {
+	if _, loaded := c.revalidating.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	// the request outlives the one of the client, it only keeps its request id, not
+	// its access log record or tracing span which are done once the client is served
+	ctx := requestid.WithID(context.Background(), requestid.FromContext(r.Context()))
+	req := conditionalRequest(r, ctx, entry)
+
+	go func() {
+		defer c.revalidating.Delete(key)
+
+		cw := &cacheWriter{
+			header:              make(http.Header),
+			maxSize:             c.maxEntrySize(),
+			interceptNotModifed: true,
+		}
+
+		requestTime := time.Now()
+		next.ServeHTTP(cw, req)
+
+		if cw.statusCode == http.StatusNotModified {
+			c.store.Put(key, entry.Update(cw.header, requestTime, time.Now()))
+			return
+		}
+
+		c.store.Delete(key)
+		c.storeResponse(req, cw, requestTime)
+	}()
+}
+
+func conditionalRequest(r *http.Request, ctx context.Context, entry *cache.Entry) *http.Request {
+	req := r.Clone(ctx)
+	req.Method = http.MethodGet
+	req.Body = http.NoBody
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	return req
+}
+
+// hopByHopHeaders are not stored, as they only apply to a single connection
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"X-Cache",
+	"Age",
+}
+
+func storableHeader(header http.Header) http.Header {
+	h := header.Clone()
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+	if _, ok := h["Date"]; !ok {
+		h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	return h
+}
+
+// cacheWriter copies the response to the client, if any, while keeping a copy
+// of it up to maxSize bytes. When interceptNotModifed is set, a 304 response is
+// captured and not sent to the client.
+type cacheWriter struct {
+	w                   http.ResponseWriter
+	header              http.Header
+	statusCode          int
+	body                bytes.Buffer
+	maxSize             int64
+	overflow            bool
+	interceptNotModifed bool
+	skipped             bool
+}
+
+var _ http.ResponseWriter = (*cacheWriter)(nil)
+var _ http.Flusher = (*cacheWriter)(nil)
+
+func (c *cacheWriter) Header() http.Header {
+	return c.header
+}
+
+func (c *cacheWriter) WriteHeader(code int) {
+	if c.statusCode != 0 {
+		return
+	}
+	c.statusCode = code
+
+	if c.interceptNotModifed && code == http.StatusNotModified {
+		c.skipped = true
+		return
+	}
+
+	if c.w == nil {
+		return
+	}
+
+	header := c.w.Header()
+	for k, values := range c.header {
+		header[k] = values
+	}
+	c.w.WriteHeader(code)
+}
+
+func (c *cacheWriter) Write(p []byte) (int, error) {
+	if c.statusCode == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.skipped {
+		return len(p), nil
+	}
+
+	if !c.overflow {
+		if int64(c.body.Len()+len(p)) > c.maxSize {
+			c.overflow = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(p)
+		}
+	}
+
+	if c.w == nil {
+		return len(p), nil
+	}
+
+	return c.w.Write(p)
+}
+
+func (c *cacheWriter) Flush() {
+	if c.statusCode == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := c.w.(http.Flusher); ok && !c.skipped {
+		f.Flush()
+	}
+}
+
+type HTTPCacheOption func(*HTTPCache)
+
+// WithCacheDisk stores the responses on disk as well, up to maxSize bytes
+func WithCacheDisk(path string, maxSize int64) HTTPCacheOption {
+	return func(c *HTTPCache) {
+		c.DiskPath = path
+		c.MaxDiskSize = ByteSize(maxSize)
+	}
+}
+
+// WithCacheDefaultTTL sets how long responses without any explicit
+// expiration time are considered fresh
+func WithCacheDefaultTTL(ttl time.Duration) HTTPCacheOption {
+	return func(c *HTTPCache) {
+		c.DefaultTTL = &WindowDuration{Duration: ttl}
+	}
+}
+
+// WithCacheMaxEntrySize sets the size of the largest response that can be stored
+func WithCacheMaxEntrySize(maxSize int64) HTTPCacheOption {
+	return func(c *HTTPCache) {
+		c.MaxEntrySize = ByteSize(maxSize)
+	}
+}
+
+func NewHTTPCache(maxMemorySize int64, opts ...HTTPCacheOption) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	httpCache := HTTPCache{
+		MaxMemorySize: ByteSize(maxMemorySize),
+	}
+
+	for _, opt := range opts {
+		opt(&httpCache)
+	}
+
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: HTTPCacheName,
+		Args: &httpCache,
+	}
+}
+
+func RegisterHTTPCache() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[HTTPCacheName] = func(raw json.RawMessage) (Middleware, error) {
+			httpCache := &HTTPCache{}
+			err := json.Unmarshal(raw, httpCache)
+			if err != nil {
+				return nil, err
+			}
+			return httpCache, nil
+		}
+
+		return nil
+	}
+}
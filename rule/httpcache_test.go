@@ -0,0 +1,283 @@
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ella.to/baker/internal/accesslog"
+	"ella.to/baker/internal/requestid"
+)
+
+func newTestHTTPCache(t *testing.T, args string) *HTTPCache {
+	builders := map[string]BuilderFunc{}
+	if err := RegisterHTTPCache()(builders); err != nil {
+		t.Fatal(err)
+	}
+
+	middleware, err := builders[HTTPCacheName](json.RawMessage(args))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return middleware.UpdateMiddelware(nil).(*HTTPCache)
+}
+
+func cacheCall(t *testing.T, h http.Handler, header http.Header) *http.Response {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/data?id=1", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+
+	return recorder.Result()
+}
+
+func TestHTTPCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		wait     time.Duration
+		statuses []string
+		calls    int32
+	}{
+		{
+			name:     "max-age",
+			header:   http.Header{"Cache-Control": {"max-age=60"}},
+			statuses: []string{"MISS", "HIT", "HIT"},
+			calls:    1,
+		},
+		{
+			name:     "no-store",
+			header:   http.Header{"Cache-Control": {"no-store"}},
+			statuses: []string{"MISS", "MISS"},
+			calls:    2,
+		},
+		{
+			name:     "private",
+			header:   http.Header{"Cache-Control": {"private, max-age=60"}},
+			statuses: []string{"MISS", "MISS"},
+			calls:    2,
+		},
+		{
+			name:     "expired without validator",
+			header:   http.Header{"Cache-Control": {"max-age=1"}},
+			wait:     1100 * time.Millisecond,
+			statuses: []string{"MISS", "MISS"},
+			calls:    2,
+		},
+		{
+			name:     "revalidate with etag",
+			header:   http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}},
+			statuses: []string{"MISS", "REVALIDATED", "REVALIDATED"},
+			calls:    3,
+		},
+		{
+			name:     "stale-while-revalidate",
+			header:   http.Header{"Cache-Control": {"max-age=1, stale-while-revalidate=60"}, "Etag": {`"v1"`}},
+			wait:     1100 * time.Millisecond,
+			statuses: []string{"MISS", "STALE"},
+			calls:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				if etag := tt.header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Write([]byte("hello world"))
+			})
+
+			h := newTestHTTPCache(t, `{}`).Process(upstream)
+
+			for i, status := range tt.statuses {
+				if i == len(tt.statuses)-1 && tt.wait > 0 {
+					time.Sleep(tt.wait)
+				}
+
+				resp := cacheCall(t, h, nil)
+				if got := resp.Header.Get("X-Cache"); got != status {
+					t.Errorf("call %d: X-Cache = %s, want %s", i, got, status)
+				}
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("call %d: status = %d, want 200", i, resp.StatusCode)
+				}
+			}
+
+			// wait for background revalidation
+			time.Sleep(50 * time.Millisecond)
+
+			if got := calls.Load(); got != tt.calls {
+				t.Errorf("upstream calls = %d, want %d", got, tt.calls)
+			}
+		})
+	}
+}
+
+func TestHTTPCacheVary(t *testing.T) {
+	var calls atomic.Int32
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprintf(w, "hello %s", r.Header.Get("Accept-Language"))
+	})
+
+	h := newTestHTTPCache(t, `{"max_memory_size":"1MB"}`).Process(upstream)
+
+	for i, lang := range []string{"en", "fr", "en", "fr"} {
+		resp := cacheCall(t, h, http.Header{"Accept-Language": {lang}})
+
+		body := make([]byte, 64)
+		n, _ := resp.Body.Read(body)
+		if got := string(body[:n]); got != "hello "+lang {
+			t.Errorf("call %d: body = %s, want hello %s", i, got, lang)
+		}
+	}
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("upstream calls = %d, want 2", got)
+	}
+}
+
+func TestHTTPCacheConditionalRequest(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("hello world"))
+	})
+
+	h := newTestHTTPCache(t, `{}`).Process(upstream)
+
+	cacheCall(t, h, nil)
+
+	resp := cacheCall(t, h, http.Header{"If-None-Match": {`"v1"`}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("status = %d, want 304", resp.StatusCode)
+	}
+}
+
+func TestHTTPCacheInvalidate(t *testing.T) {
+	var calls atomic.Int32
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello world"))
+	})
+
+	h := newTestHTTPCache(t, `{}`).Process(upstream)
+
+	cacheCall(t, h, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/data?id=1", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := cacheCall(t, h, nil).Header.Get("X-Cache"); got != "MISS" {
+		t.Errorf("X-Cache = %s, want MISS", got)
+	}
+
+	if got := calls.Load(); got != 3 {
+		t.Errorf("upstream calls = %d, want 3", got)
+	}
+}
+
+func TestHTTPCacheDisk(t *testing.T) {
+	dir := t.TempDir()
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello world"))
+	})
+
+	h := newTestHTTPCache(t, fmt.Sprintf(`{"disk_path":%q}`, dir)).Process(upstream)
+	cacheCall(t, h, nil)
+
+	// a new instance picks up the responses stored on disk
+	h = newTestHTTPCache(t, fmt.Sprintf(`{"disk_path":%q}`, dir)).Process(upstream)
+	if got := cacheCall(t, h, nil).Header.Get("X-Cache"); got != "HIT" {
+		t.Errorf("X-Cache = %s, want HIT", got)
+	}
+}
+
+func TestHTTPCacheRevalidateInBackground(t *testing.T) {
+	revalidated := make(chan *http.Request, 1)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") != "" {
+			revalidated <- r
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello world"))
+	})
+
+	h := newTestHTTPCache(t, `{}`).Process(upstream)
+	cacheCall(t, h, nil)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/data?id=1", nil)
+	ctx := requestid.WithID(req.Context(), "abc")
+	ctx = accesslog.WithRecord(ctx, &accesslog.Record{})
+	h.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	select {
+	case r := <-revalidated:
+		// the record of the client request is logged before the revalidation is done
+		if accesslog.FromContext(r.Context()) != nil {
+			t.Error("the revalidation request has the access log record of the client request")
+		}
+		if id := requestid.FromContext(r.Context()); id != "abc" {
+			t.Errorf("request id = %q, want abc", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the stale response was not revalidated")
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  ByteSize
+	}{
+		{`1024`, 1024},
+		{`"10KB"`, 10 << 10},
+		{`"64mb"`, 64 << 20},
+		{`"1GB"`, 1 << 30},
+		{`"12B"`, 12},
+	}
+	for _, tt := range tests {
+		var got ByteSize
+		if err := json.Unmarshal([]byte(tt.input), &got); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", tt.input, err)
+		}
+		if got != tt.want {
+			t.Errorf("Unmarshal(%s) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+
+	b, _ := json.Marshal(ByteSize(64 << 20))
+	if string(b) != `"64MB"` {
+		t.Errorf("Marshal() = %s, want \"64MB\"", b)
+	}
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directives holds the parsed directives of the Cache-Control header,
+// directive names are lower cased and values are unquoted
+type Directives map[string]string
+
+func ParseCacheControl(header http.Header) Directives {
+	d := Directives{}
+
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			d[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+
+	return d
+}
+
+func (d Directives) Has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// Duration returns the value of a delta-seconds directive such as max-age
+func (d Directives) Duration(name string) (time.Duration, bool) {
+	value, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		// RFC 9111 section 4.2.1: invalid values should be treated as stale
+		return 0, true
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type diskItem struct {
+	name string
+	size int64
+}
+
+// diskStore keeps each entry in its own file inside dir and evicts the least
+// recently used ones once the total size goes over maxSize. Files left by a
+// previous run are picked up when the store is created.
+type diskStore struct {
+	dir     string
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element // file name -> diskItem
+	lru     *list.List
+	mu      sync.Mutex
+}
+
+var _ Store = (*diskStore)(nil)
+
+func NewDiskStore(dir string, maxSize int64) (Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache dir: %w", err)
+	}
+
+	s := &diskStore{
+		dir:     dir,
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *diskStore) load() error {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache dir: %w", err)
+	}
+
+	infos := make([]os.FileInfo, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || filepath.Ext(dirEntry.Name()) != ".cache" {
+			continue
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	// oldest files are the first ones to be evicted
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	for _, info := range infos {
+		s.items[info.Name()] = s.lru.PushBack(&diskItem{name: info.Name(), size: info.Size()})
+		s.size += info.Size()
+	}
+
+	for s.size > s.maxSize && s.lru.Len() > 0 {
+		s.removeElement(s.lru.Back())
+	}
+
+	return nil
+}
+
+func (s *diskStore) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".cache"
+}
+
+func (s *diskStore) Get(key string) (*Entry, bool) {
+	name := s.fileName(key)
+
+	s.mu.Lock()
+	elem, ok := s.items[name]
+	if ok {
+		s.lru.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		s.Delete(key)
+		return nil, false
+	}
+	defer f.Close()
+
+	entry := &Entry{}
+	if err := gob.NewDecoder(f).Decode(entry); err != nil {
+		slog.Warn("failed to decode cache entry", "file", name, "error", err)
+		s.Delete(key)
+		return nil, false
+	}
+
+	return entry, true
+}
+
+func (s *diskStore) Put(key string, entry *Entry) {
+	name := s.fileName(key)
+	path := filepath.Join(s.dir, name)
+
+	// write to a temporary file first, so readers never see a partial entry
+	tmp, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		slog.Error("failed to create cache file", "error", err)
+		return
+	}
+
+	err = gob.NewEncoder(tmp).Encode(entry)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		slog.Error("failed to write cache file", "error", err)
+		return
+	}
+
+	info, err := os.Stat(tmp.Name())
+	if err != nil || info.Size() > s.maxSize {
+		os.Remove(tmp.Name())
+		s.Delete(key)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		slog.Error("failed to move cache file", "error", err)
+		return
+	}
+
+	if elem, ok := s.items[name]; ok {
+		s.lru.Remove(elem)
+		s.size -= elem.Value.(*diskItem).size
+		delete(s.items, name)
+	}
+
+	s.items[name] = s.lru.PushFront(&diskItem{name: name, size: info.Size()})
+	s.size += info.Size()
+
+	for s.size > s.maxSize {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+func (s *diskStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[s.fileName(key)]; ok {
+		s.removeElement(elem)
+	}
+}
+
+func (s *diskStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+func (s *diskStore) removeElement(elem *list.Element) {
+	item := elem.Value.(*diskItem)
+	s.lru.Remove(elem)
+	delete(s.items, item.name)
+	s.size -= item.size
+	os.Remove(filepath.Join(s.dir, item.name))
+}
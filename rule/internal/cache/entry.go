@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Entry is a stored response. If Variants is set, the entry doesn't hold any
+// response, it only lists the request headers used to find the right variant
+// of the response, based on the Vary header.
+type Entry struct {
+	StatusCode   int
+	Header       http.Header
+	Body         []byte
+	Variants     []string
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+func (e *Entry) Size() int64 {
+	size := int64(len(e.Body))
+	for k, values := range e.Header {
+		for _, v := range values {
+			size += int64(len(k) + len(v))
+		}
+	}
+	for _, v := range e.Variants {
+		size += int64(len(v))
+	}
+	return size
+}
+
+func (e *Entry) CacheControl() Directives {
+	return ParseCacheControl(e.Header)
+}
+
+// Age calculates the current age of the response, based on RFC 9111 section 4.2.3
+func (e *Entry) Age(now time.Time) time.Duration {
+	var ageValue time.Duration
+	if seconds, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		apparentAge = max(0, e.ResponseTime.Sub(date))
+	}
+
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	residentTime := now.Sub(e.ResponseTime)
+
+	return correctedInitialAge + residentTime
+}
+
+// FreshnessLifetime calculates how long the response is fresh, based on RFC 9111 section 4.2.1.
+// heuristic is used if the response doesn't have any explicit expiration time.
+func (e *Entry) FreshnessLifetime(heuristic time.Duration) time.Duration {
+	cc := e.CacheControl()
+
+	if d, ok := cc.Duration("s-maxage"); ok {
+		return d
+	}
+
+	if d, ok := cc.Duration("max-age"); ok {
+		return d
+	}
+
+	if expiresValue := e.Header.Get("Expires"); expiresValue != "" {
+		expires, err := http.ParseTime(expiresValue)
+		if err != nil {
+			return 0
+		}
+
+		date, err := http.ParseTime(e.Header.Get("Date"))
+		if err != nil {
+			date = e.ResponseTime
+		}
+
+		return max(0, expires.Sub(date))
+	}
+
+	return e.heuristicFreshness(heuristic)
+}
+
+// heuristicFreshness is used when the response has no explicit expiration
+// time, see RFC 9111 section 4.2.2
+func (e *Entry) heuristicFreshness(heuristic time.Duration) time.Duration {
+	if !isHeuristicallyCacheable(e.StatusCode) {
+		return 0
+	}
+
+	if heuristic > 0 {
+		return heuristic
+	}
+
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = e.ResponseTime
+	}
+
+	// 10% of the time since the last modification is the typical heuristic
+	return min(max(0, date.Sub(lastModified)/10), 24*time.Hour)
+}
+
+// HasValidator returns true if the response can be revalidated with a conditional request
+func (e *Entry) HasValidator() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// Update merges the headers of a 304 Not Modified response into the entry,
+// see RFC 9111 section 4.3.4
+func (e *Entry) Update(header http.Header, requestTime, responseTime time.Time) *Entry {
+	updated := &Entry{
+		StatusCode:   e.StatusCode,
+		Header:       e.Header.Clone(),
+		Body:         e.Body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+
+	for k, values := range header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range":
+			continue
+		}
+		updated.Header[k] = values
+	}
+
+	return updated
+}
+
+// cacheableStatus is the list of status codes which are understood and can be stored
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+func isHeuristicallyCacheable(statusCode int) bool {
+	return cacheableStatus[statusCode]
+}
+
+// IsStorable checks whether a response to the request can be stored
+// by a shared cache, see RFC 9111 section 3
+func IsStorable(r *http.Request, statusCode int, header http.Header, heuristic time.Duration) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+
+	if !cacheableStatus[statusCode] {
+		return false
+	}
+
+	cc := ParseCacheControl(header)
+	if cc.Has("no-store") || cc.Has("private") {
+		return false
+	}
+
+	if header.Get("Vary") == "*" || len(header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+
+	if r.Header.Get("Authorization") != "" && !cc.Has("public") && !cc.Has("s-maxage") && !cc.Has("must-revalidate") {
+		return false
+	}
+
+	if cc.Has("max-age") || cc.Has("s-maxage") || cc.Has("public") || header.Get("Expires") != "" {
+		return true
+	}
+
+	// no-cache responses can be stored as long as they are revalidated before being used
+	if cc.Has("no-cache") {
+		return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	}
+
+	return heuristic > 0 || header.Get("Last-Modified") != ""
+}
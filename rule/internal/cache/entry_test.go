@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		heuristic time.Duration
+		want      time.Duration
+	}{
+		{
+			name:   "s-maxage wins over max-age",
+			header: http.Header{"Cache-Control": {"max-age=10, s-maxage=20"}},
+			want:   20 * time.Second,
+		},
+		{
+			name:   "max-age wins over expires",
+			header: http.Header{"Cache-Control": {"max-age=10"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}},
+			want:   10 * time.Second,
+		},
+		{
+			name:   "expires",
+			header: http.Header{"Date": {now.Format(http.TimeFormat)}, "Expires": {now.Add(time.Minute).Format(http.TimeFormat)}},
+			want:   time.Minute,
+		},
+		{
+			name:   "invalid expires is stale",
+			header: http.Header{"Expires": {"0"}},
+			want:   0,
+		},
+		{
+			name:      "heuristic",
+			header:    http.Header{},
+			heuristic: time.Minute,
+			want:      time.Minute,
+		},
+		{
+			name:   "last-modified heuristic",
+			header: http.Header{"Date": {now.Format(http.TimeFormat)}, "Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}},
+			want:   time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &Entry{StatusCode: http.StatusOK, Header: tt.header, ResponseTime: now}
+			if got := entry.FreshnessLifetime(tt.heuristic); got != tt.want {
+				t.Errorf("FreshnessLifetime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAge(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	entry := &Entry{
+		Header:       http.Header{"Age": {"10"}, "Date": {now.Add(-5 * time.Second).Format(http.TimeFormat)}},
+		RequestTime:  now.Add(-time.Second),
+		ResponseTime: now,
+	}
+
+	// age value + response delay is larger than the apparent age
+	if got := entry.Age(now.Add(2 * time.Second)); got != 13*time.Second {
+		t.Errorf("Age() = %v, want 13s", got)
+	}
+}
+
+func TestIsStorable(t *testing.T) {
+	tests := []struct {
+		name       string
+		reqHeader  http.Header
+		statusCode int
+		header     http.Header
+		want       bool
+	}{
+		{name: "max-age", statusCode: 200, header: http.Header{"Cache-Control": {"max-age=10"}}, want: true},
+		{name: "no explicit freshness", statusCode: 200, header: http.Header{}, want: false},
+		{name: "unknown status", statusCode: 500, header: http.Header{"Cache-Control": {"max-age=10"}}, want: false},
+		{name: "no-store", statusCode: 200, header: http.Header{"Cache-Control": {"no-store, max-age=10"}}, want: false},
+		{name: "vary all", statusCode: 200, header: http.Header{"Cache-Control": {"max-age=10"}, "Vary": {"*"}}, want: false},
+		{name: "set-cookie", statusCode: 200, header: http.Header{"Cache-Control": {"max-age=10"}, "Set-Cookie": {"a=b"}}, want: false},
+		{name: "authorization", reqHeader: http.Header{"Authorization": {"Bearer x"}}, statusCode: 200, header: http.Header{"Cache-Control": {"max-age=10"}}, want: false},
+		{name: "authorization public", reqHeader: http.Header{"Authorization": {"Bearer x"}}, statusCode: 200, header: http.Header{"Cache-Control": {"public, max-age=10"}}, want: true},
+		{name: "no-cache with etag", statusCode: 200, header: http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"a"`}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tt.reqHeader {
+				r.Header[k] = v
+			}
+			if got := IsStorable(r, tt.statusCode, tt.header, 0); got != tt.want {
+				t.Errorf("IsStorable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	store := NewMemoryStore(100)
+
+	for _, key := range []string{"a", "b", "c"} {
+		store.Put(key, &Entry{Body: make([]byte, 40)})
+	}
+
+	if _, ok := store.Get("a"); ok {
+		t.Error("expected a to be evicted")
+	}
+
+	for _, key := range []string{"b", "c"} {
+		if _, ok := store.Get(key); !ok {
+			t.Errorf("expected %s to be stored", key)
+		}
+	}
+
+	store.Put("large", &Entry{Body: make([]byte, 200)})
+	if _, ok := store.Get("large"); ok {
+		t.Error("expected entries larger than the store to be skipped")
+	}
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Put(key string, entry *Entry)
+	Delete(key string)
+	Size() int64
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+// memoryStore keeps the entries in memory and evicts the least
+// recently used ones once the total size goes over maxSize
+type memoryStore struct {
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	lru     *list.List
+	mu      sync.Mutex
+}
+
+var _ Store = (*memoryStore)(nil)
+
+func NewMemoryStore(maxSize int64) Store {
+	return &memoryStore{
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (s *memoryStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	s.lru.MoveToFront(elem)
+
+	return elem.Value.(*memoryItem).entry, true
+}
+
+func (s *memoryStore) Put(key string, entry *Entry) {
+	size := entry.Size() + int64(len(key))
+	if size > s.maxSize {
+		s.Delete(key)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[key]; ok {
+		s.removeElement(elem)
+	}
+
+	s.items[key] = s.lru.PushFront(&memoryItem{key: key, entry: entry, size: size})
+	s.size += size
+
+	for s.size > s.maxSize {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+func (s *memoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[key]; ok {
+		s.removeElement(elem)
+	}
+}
+
+func (s *memoryStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+func (s *memoryStore) removeElement(elem *list.Element) {
+	item := elem.Value.(*memoryItem)
+	s.lru.Remove(elem)
+	delete(s.items, item.key)
+	s.size -= item.size
+}
+
+// tieredStore looks up entries in memory first and then on disk,
+// entries found on disk are moved back to memory
+type tieredStore struct {
+	memory Store
+	disk   Store
+}
+
+var _ Store = (*tieredStore)(nil)
+
+func NewTieredStore(memory, disk Store) Store {
+	return &tieredStore{
+		memory: memory,
+		disk:   disk,
+	}
+}
+
+func (s *tieredStore) Get(key string) (*Entry, bool) {
+	if entry, ok := s.memory.Get(key); ok {
+		return entry, true
+	}
+
+	entry, ok := s.disk.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	s.memory.Put(key, entry)
+
+	return entry, true
+}
+
+func (s *tieredStore) Put(key string, entry *Entry) {
+	s.memory.Put(key, entry)
+	s.disk.Put(key, entry)
+}
+
+func (s *tieredStore) Delete(key string) {
+	s.memory.Delete(key)
+	s.disk.Delete(key)
+}
+
+func (s *tieredStore) Size() int64 {
+	return s.memory.Size() + s.disk.Size()
+}
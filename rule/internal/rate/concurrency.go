@@ -0,0 +1,87 @@
+package rate
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Concurrency limits the number of requests processed at the same time to maxInFlight.
+// Requests over the limit wait in a queue of queueSize for up to queueTimeout until
+// a slot is available. Requests which don't fit in the queue, or wait longer than
+// queueTimeout, are rejected. If onLimit is nil, a 503 response is sent back.
+func Concurrency(maxInFlight int, queueSize int, queueTimeout time.Duration, onLimit http.HandlerFunc) func(next http.Handler) http.Handler {
+	return newConcurrencyLimiter(maxInFlight, queueSize, queueTimeout, onLimit).Handler
+}
+
+type concurrencyLimiter struct {
+	slots        chan struct{}
+	queueSize    int64
+	queueTimeout time.Duration
+	waiting      atomic.Int64
+	onLimit      http.HandlerFunc
+}
+
+func newConcurrencyLimiter(maxInFlight int, queueSize int, queueTimeout time.Duration, onLimit http.HandlerFunc) *concurrencyLimiter {
+	if onLimit == nil {
+		onLimit = func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+	}
+
+	return &concurrencyLimiter{
+		slots:        make(chan struct{}, maxInFlight),
+		queueSize:    int64(queueSize),
+		queueTimeout: queueTimeout,
+		onLimit:      onLimit,
+	}
+}
+
+// acquire returns true once the request holds a slot, the caller
+// must call release once the request is done
+func (l *concurrencyLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.queueSize <= 0 || l.queueTimeout <= 0 {
+		return false
+	}
+
+	if l.waiting.Add(1) > l.queueSize {
+		l.waiting.Add(-1)
+		return false
+	}
+	defer l.waiting.Add(-1)
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+func (l *concurrencyLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire(r) {
+			w.Header().Set("Retry-After", "1")
+			l.onLimit(w, r)
+			return
+		}
+		defer l.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+package rate_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"ella.to/baker/rule/internal/rate"
+)
+
+func TestConcurrency(t *testing.T) {
+	type test struct {
+		name         string
+		maxInFlight  int
+		queueSize    int
+		queueTimeout time.Duration
+		requests     int
+		accepted     int
+	}
+	tests := []test{
+		{
+			name:        "no-queue",
+			maxInFlight: 2,
+			requests:    4,
+			accepted:    2,
+		},
+		{
+			name:         "queue",
+			maxInFlight:  2,
+			queueSize:    1,
+			queueTimeout: time.Second,
+			requests:     4,
+			accepted:     3,
+		},
+		{
+			name:         "queue-timeout",
+			maxInFlight:  1,
+			queueSize:    2,
+			queueTimeout: 10 * time.Millisecond,
+			requests:     3,
+			accepted:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			started := make(chan struct{}, tt.requests)
+
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-release
+			})
+			router := rate.Concurrency(tt.maxInFlight, tt.queueSize, tt.queueTimeout, nil)(h)
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			codes := map[int]int{}
+
+			for range tt.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					recorder := httptest.NewRecorder()
+					router.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+					mu.Lock()
+					codes[recorder.Result().StatusCode]++
+					mu.Unlock()
+				}()
+			}
+
+			// wait until the slots are taken and the rest of the requests are either rejected or queued
+			for range tt.maxInFlight {
+				<-started
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if codes[200] != tt.accepted {
+				t.Errorf("accepted = %d, want %d", codes[200], tt.accepted)
+			}
+			if codes[503] != tt.requests-tt.accepted {
+				t.Errorf("rejected = %d, want %d", codes[503], tt.requests-tt.accepted)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package rate
 
 import (
 	"fmt"
+	"log/slog"
 	"math"
 	"net/http"
 	"sync"
@@ -15,6 +16,9 @@ type LimitCounter interface {
 	Increment(key string, currentWindow time.Time) error
 	IncrementBy(key string, currentWindow time.Time, amount int) error
 	Get(key string, currentWindow, previousWindow time.Time) (int, int, error)
+	// IncrementAndGet increments the counter of the current window and returns the counters
+	// of both windows at once, so concurrent requests can't read the same value
+	IncrementAndGet(key string, currentWindow, previousWindow time.Time, amount int) (int, int, error)
 }
 
 func NewRateLimiter(requestLimit int, windowLength time.Duration, options ...Option) *rateLimiter {
@@ -37,6 +41,14 @@ func newRateLimiter(requestLimit int, windowLength time.Duration, options ...Opt
 		}
 	}
 
+	if rl.keyPrefix != "" {
+		keyFn := rl.keyFn
+		rl.keyFn = func(r *http.Request) (string, error) {
+			key, err := keyFn(r)
+			return rl.keyPrefix + key, err
+		}
+	}
+
 	if rl.limitCounter == nil {
 		rl.limitCounter = &localCounter{
 			counters:     make(map[uint64]*count),
@@ -58,9 +70,9 @@ type rateLimiter struct {
 	requestLimit   int
 	windowLength   time.Duration
 	keyFn          KeyFunc
+	keyPrefix      string
 	limitCounter   LimitCounter
 	onRequestLimit http.HandlerFunc
-	mu             sync.Mutex
 }
 
 func (l *rateLimiter) Counter() LimitCounter {
@@ -100,13 +112,21 @@ func (l *rateLimiter) Handler(next http.Handler) http.Handler {
 		w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", 0))
 		w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", currentWindow.Add(l.windowLength).Unix()))
 
-		l.mu.Lock()
-		_, rate, err := l.Status(key)
+		// the request is counted first, and the count is taken back if it's rejected,
+		// so concurrent requests, even on other instances, never see the same count
+		amount := getIncrement(r.Context())
+
+		t := time.Now().UTC()
+		previousWindow := currentWindow.Add(-l.windowLength)
+
+		currCount, prevCount, err := l.limitCounter.IncrementAndGet(key, currentWindow, previousWindow, amount)
 		if err != nil {
-			l.mu.Unlock()
 			http.Error(w, err.Error(), http.StatusPreconditionRequired)
 			return
 		}
+
+		diff := t.Sub(currentWindow)
+		rate := float64(prevCount)*(float64(l.windowLength)-float64(diff))/float64(l.windowLength) + float64(currCount-amount)
 		nrate := int(math.Round(rate))
 
 		if l.requestLimit > nrate {
@@ -114,20 +134,15 @@ func (l *rateLimiter) Handler(next http.Handler) http.Handler {
 		}
 
 		if nrate >= l.requestLimit {
-			l.mu.Unlock()
+			if err := l.limitCounter.IncrementBy(key, currentWindow, -amount); err != nil {
+				slog.Warn("failed to take back the rejected request from the rate limit counter", "error", err)
+			}
+
 			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(l.windowLength.Seconds()))) // RFC 6585
 			l.onRequestLimit(w, r)
 			return
 		}
 
-		err = l.limitCounter.IncrementBy(key, currentWindow, getIncrement(r.Context()))
-		if err != nil {
-			l.mu.Unlock()
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		l.mu.Unlock()
-
 		next.ServeHTTP(w, r)
 	})
 }
@@ -175,6 +190,28 @@ func (c *localCounter) IncrementBy(key string, currentWindow time.Time, amount i
 	return nil
 }
 
+func (c *localCounter) IncrementAndGet(key string, currentWindow, previousWindow time.Time, amount int) (int, int, error) {
+	c.evict()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	curr, ok := c.counters[LimitCounterKey(key, currentWindow)]
+	if !ok {
+		curr = &count{}
+		c.counters[LimitCounterKey(key, currentWindow)] = curr
+	}
+	curr.value += amount
+	curr.updatedAt = time.Now()
+
+	prev := 0
+	if v, ok := c.counters[LimitCounterKey(key, previousWindow)]; ok {
+		prev = v.value
+	}
+
+	return curr.value, prev, nil
+}
+
 func (c *localCounter) Get(key string, currentWindow, previousWindow time.Time) (int, int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
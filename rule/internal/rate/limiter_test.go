@@ -206,3 +206,82 @@ func TestLimitIP(t *testing.T) {
 		})
 	}
 }
+
+func TestLimitByKeyFuncs(t *testing.T) {
+	// header: {"alg":"none"}, payload: {"sub":"user-1"} and {"sub":"user-2"}
+	user1 := "Bearer eyJhbGciOiJub25lIn0.eyJzdWIiOiJ1c2VyLTEifQ.sig"
+	user2 := "Bearer eyJhbGciOiJub25lIn0.eyJzdWIiOiJ1c2VyLTIifQ.sig"
+
+	type test struct {
+		name      string
+		keyFunc   rate.KeyFunc
+		header    string
+		values    []string
+		respCodes []int
+	}
+	tests := []test{
+		{
+			name:      "header",
+			keyFunc:   rate.KeyByHeader("X-Api-Key"),
+			header:    "X-Api-Key",
+			values:    []string{"key-1", "key-1", "key-2"},
+			respCodes: []int{200, 429, 200},
+		},
+		{
+			name:      "jwt-claim",
+			keyFunc:   rate.KeyByJWTClaim("sub"),
+			header:    "Authorization",
+			values:    []string{user1, user1, user2},
+			respCodes: []int{200, 429, 200},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			router := rate.Limit(1, 2*time.Second, rate.WithKeyFuncs(tt.keyFunc))(h)
+
+			for i, code := range tt.respCodes {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.RemoteAddr = "1.1.1.1:100"
+				req.Header.Set(tt.header, tt.values[i])
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, req)
+				if respCode := recorder.Result().StatusCode; respCode != code {
+					t.Errorf("resp.StatusCode(%v) = %v, want %v", i, respCode, code)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitByMissingKey(t *testing.T) {
+	keyFuncs := map[string]rate.KeyFunc{
+		"header":    rate.KeyByHeader("X-Api-Key"),
+		"cookie":    rate.KeyByCookie("session"),
+		"jwt-claim": rate.KeyByJWTClaim("sub"),
+	}
+	for name, keyFunc := range keyFuncs {
+		t.Run(name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			router := rate.Limit(1, 2*time.Second, rate.WithKeyFuncs(keyFunc))(h)
+
+			// the anonymous clients are grouped by ip, instead of sharing a single bucket
+			for i, tc := range []struct {
+				remoteAddr string
+				code       int
+			}{
+				{"1.1.1.1:100", 200},
+				{"1.1.1.1:100", 429},
+				{"2.2.2.2:100", 200},
+			} {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.RemoteAddr = tc.remoteAddr
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, req)
+				if respCode := recorder.Result().StatusCode; respCode != tc.code {
+					t.Errorf("resp.StatusCode(%v) = %v, want %v", i, respCode, tc.code)
+				}
+			}
+		})
+	}
+}
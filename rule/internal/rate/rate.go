@@ -1,6 +1,9 @@
 package rate
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
@@ -62,6 +65,81 @@ func KeyByEndpoint(r *http.Request) (string, error) {
 	return r.URL.Path, nil
 }
 
+// KeyByHeader returns a KeyFunc which uses the value of the given header.
+// Requests without the header are grouped by client IP address.
+func KeyByHeader(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		return keyOrIP(r, r.Header.Get(name))
+	}
+}
+
+// KeyByCookie returns a KeyFunc which uses the value of the given cookie.
+// Requests without the cookie are grouped by client IP address.
+func KeyByCookie(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return keyOrIP(r, "")
+		}
+		return keyOrIP(r, cookie.Value)
+	}
+}
+
+// KeyByJWTClaim returns a KeyFunc which uses the value of a claim inside
+// the bearer token of the Authorization header. The token signature is NOT
+// verified, the claim is only used to group requests, authentication should
+// be done by the upstream service. Requests without the claim are grouped by
+// client IP address.
+func KeyByJWTClaim(claim string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		return keyOrIP(r, jwtClaim(r, claim))
+	}
+}
+
+func jwtClaim(r *http.Request, claim string) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	claims := map[string]any{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	value, ok := claims[claim]
+	if !ok || value == nil {
+		return ""
+	}
+
+	return fmt.Sprint(value)
+}
+
+// keyOrIP falls back to the client IP address when the value is missing, so the
+// clients without it don't share a single bucket which one of them can exhaust
+func keyOrIP(r *http.Request, value string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+
+	ip, err := KeyByIP(r)
+	if err != nil {
+		return "", err
+	}
+
+	return "ip:" + ip, nil
+}
+
 func WithKeyFuncs(keyFuncs ...KeyFunc) Option {
 	return func(rl *rateLimiter) {
 		if len(keyFuncs) > 0 {
@@ -78,6 +156,14 @@ func WithKeyByRealIP() Option {
 	return WithKeyFuncs(KeyByRealIP)
 }
 
+// WithKeyPrefix prepends prefix to every key, so the limiters which
+// share the same counter, e.g. in redis, don't share their counts
+func WithKeyPrefix(prefix string) Option {
+	return func(rl *rateLimiter) {
+		rl.keyPrefix = prefix
+	}
+}
+
 func WithLimitHandler(h http.HandlerFunc) Option {
 	return func(rl *rateLimiter) {
 		rl.onRequestLimit = h
@@ -94,6 +180,15 @@ func WithNoop() Option {
 	return func(rl *rateLimiter) {}
 }
 
+// KeyFuncs combines multiple KeyFunc into a single one,
+// it returns nil if no KeyFunc is given
+func KeyFuncs(keyFuncs ...KeyFunc) KeyFunc {
+	if len(keyFuncs) == 0 {
+		return nil
+	}
+	return composedKeyFunc(keyFuncs...)
+}
+
 func composedKeyFunc(keyFuncs ...KeyFunc) KeyFunc {
 	return func(r *http.Request) (string, error) {
 		var key strings.Builder
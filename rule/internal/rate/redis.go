@@ -0,0 +1,430 @@
+package rate
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisClients holds one client per redis url, so rebuilding a rate limiter
+// with the same configuration doesn't open a new connection every time
+var redisClients sync.Map // url -> *redisClient
+
+// redisCounter is a LimitCounter which stores the counters inside a Redis
+// compatible server, so multiple instances of baker share the same limits.
+// If the server can't be reached, it falls back to a local counter until the
+// server is available again.
+type redisCounter struct {
+	client       *redisClient
+	prefix       string
+	windowLength time.Duration
+	fallback     *localCounter
+	mu           sync.Mutex
+}
+
+var _ LimitCounter = (*redisCounter)(nil)
+
+// NewRedisCounter creates a LimitCounter backed by a Redis compatible server.
+// The url has the following format:
+//
+//	redis://[[user]:password@]host:port[/db][?prefix=baker&timeout=1s]
+//
+// prefix is prepended to every key and can be used to separate the counters
+// of different deployments which share the same server.
+func NewRedisCounter(rawURL string) (LimitCounter, error) {
+	u, err := parseRedisURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := u.Query().Get("prefix")
+	if prefix == "" {
+		prefix = "baker"
+	}
+
+	value, ok := redisClients.Load(rawURL)
+	if !ok {
+		client, err := newRedisClient(u)
+		if err != nil {
+			return nil, err
+		}
+		value, _ = redisClients.LoadOrStore(rawURL, client)
+	}
+
+	return &redisCounter{
+		client: value.(*redisClient),
+		prefix: prefix,
+		fallback: &localCounter{
+			counters: make(map[uint64]*count),
+		},
+	}, nil
+}
+
+func (c *redisCounter) Config(requestLimit int, windowLength time.Duration) {
+	c.mu.Lock()
+	c.windowLength = windowLength
+	c.mu.Unlock()
+
+	c.fallback.Config(requestLimit, windowLength)
+}
+
+func (c *redisCounter) Increment(key string, currentWindow time.Time) error {
+	return c.IncrementBy(key, currentWindow, 1)
+}
+
+func (c *redisCounter) IncrementBy(key string, currentWindow time.Time, amount int) error {
+	c.mu.Lock()
+	ttl := c.windowLength * 3
+	c.mu.Unlock()
+
+	hkey := c.key(key, currentWindow)
+
+	_, err := c.client.Do(
+		[]string{"INCRBY", hkey, strconv.Itoa(amount)},
+		[]string{"PEXPIRE", hkey, strconv.FormatInt(ttl.Milliseconds(), 10)},
+	)
+	if err != nil {
+		slog.Warn("redis rate limit counter failed, falling back to local counter", "error", err)
+		return c.fallback.IncrementBy(key, currentWindow, amount)
+	}
+
+	return nil
+}
+
+// IncrementAndGet sends INCRBY, PEXPIRE and GET in a single round trip, the increment
+// is atomic, so the instances which share the server never read the same count
+func (c *redisCounter) IncrementAndGet(key string, currentWindow, previousWindow time.Time, amount int) (int, int, error) {
+	c.mu.Lock()
+	ttl := c.windowLength * 3
+	c.mu.Unlock()
+
+	hkey := c.key(key, currentWindow)
+
+	replies, err := c.client.Do(
+		[]string{"INCRBY", hkey, strconv.Itoa(amount)},
+		[]string{"PEXPIRE", hkey, strconv.FormatInt(ttl.Milliseconds(), 10)},
+		[]string{"GET", c.key(key, previousWindow)},
+	)
+	if err != nil {
+		slog.Warn("redis rate limit counter failed, falling back to local counter", "error", err)
+		return c.fallback.IncrementAndGet(key, currentWindow, previousWindow, amount)
+	}
+
+	curr, err := redisInt(replies[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	prev, err := redisInt(replies[2])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return curr, prev, nil
+}
+
+func (c *redisCounter) Get(key string, currentWindow, previousWindow time.Time) (int, int, error) {
+	replies, err := c.client.Do(
+		[]string{"MGET", c.key(key, currentWindow), c.key(key, previousWindow)},
+	)
+	if err != nil {
+		slog.Warn("redis rate limit counter failed, falling back to local counter", "error", err)
+		return c.fallback.Get(key, currentWindow, previousWindow)
+	}
+
+	values, ok := replies[0].([]any)
+	if !ok || len(values) != 2 {
+		return 0, 0, fmt.Errorf("unexpected redis reply for MGET: %v", replies[0])
+	}
+
+	curr, err := redisInt(values[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	prev, err := redisInt(values[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return curr, prev, nil
+}
+
+func (c *redisCounter) key(key string, window time.Time) string {
+	return fmt.Sprintf("%s:ratelimit:%d", c.prefix, LimitCounterKey(key, window))
+}
+
+func redisInt(value any) (int, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return int(v), nil
+	case string:
+		return strconv.Atoi(v)
+	default:
+		return 0, fmt.Errorf("unexpected redis value: %v", value)
+	}
+}
+
+// redisClient is a minimal client for the RESP protocol. It keeps a single
+// connection which is re-established on the next call if anything goes wrong.
+type redisClient struct {
+	addr     string
+	username string
+	password string
+	db       string
+	timeout  time.Duration
+
+	conn      net.Conn
+	rw        *bufio.ReadWriter
+	downUntil time.Time
+	mu        sync.Mutex
+}
+
+// redisRetryDelay is how long the client waits before trying to reach the
+// server again after a connection failure, so requests don't pay the dial
+// timeout while the server is down
+const redisRetryDelay = 5 * time.Second
+
+var errRedisUnavailable = errors.New("redis: server is unavailable")
+
+// ValidateRedisURL returns the error NewRedisCounter would return for the url,
+// without creating the counter
+func ValidateRedisURL(rawURL string) error {
+	u, err := parseRedisURL(rawURL)
+	if err != nil {
+		return err
+	}
+
+	_, err = newRedisClient(u)
+	return err
+}
+
+func parseRedisURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis url: %w", err)
+	}
+
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis url scheme '%s'", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("redis url requires a host")
+	}
+
+	return u, nil
+}
+
+func newRedisClient(u *url.URL) (*redisClient, error) {
+	c := &redisClient{
+		addr:    u.Host,
+		timeout: time.Second,
+	}
+
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis db '%s'", db)
+		}
+		c.db = db
+	}
+
+	if timeout := u.Query().Get("timeout"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis timeout '%s': %w", timeout, err)
+		}
+		c.timeout = d
+	}
+
+	return c, nil
+}
+
+// Do sends all the commands in a single round trip and returns their replies
+// in the same order. A redis error reply is returned as an error.
+func (c *redisClient) Do(cmds ...[]string) ([]any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	replies, err := c.roundTrip(cmds...)
+	if err != nil {
+		var replyErr redisError
+		if !errors.As(err, &replyErr) {
+			c.reset()
+		}
+		return nil, err
+	}
+
+	return replies, nil
+}
+
+func (c *redisClient) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+
+	if time.Now().Before(c.downUntil) {
+		return errRedisUnavailable
+	}
+
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		c.downUntil = time.Now().Add(redisRetryDelay)
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	c.conn = conn
+	c.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	setup := make([][]string, 0, 2)
+	if c.password != "" {
+		if c.username != "" {
+			setup = append(setup, []string{"AUTH", c.username, c.password})
+		} else {
+			setup = append(setup, []string{"AUTH", c.password})
+		}
+	}
+	if c.db != "" {
+		setup = append(setup, []string{"SELECT", c.db})
+	}
+
+	if len(setup) > 0 {
+		if _, err := c.roundTrip(setup...); err != nil {
+			c.reset()
+			c.downUntil = time.Now().Add(redisRetryDelay)
+			return fmt.Errorf("failed to setup redis connection: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (c *redisClient) reset() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = nil
+	c.rw = nil
+}
+
+func (c *redisClient) roundTrip(cmds ...[]string) ([]any, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range cmds {
+		fmt.Fprintf(c.rw, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(c.rw, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+
+	if err := c.rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, 0, len(cmds))
+	var replyErr error
+
+	// all the replies have to be read, even if one of them is an error,
+	// otherwise the next call reads the leftovers
+	for range cmds {
+		reply, err := readRedisReply(c.rw.Reader)
+		if err != nil {
+			var e redisError
+			if !errors.As(err, &e) {
+				return nil, err
+			}
+			if replyErr == nil {
+				replyErr = err
+			}
+		}
+		replies = append(replies, reply)
+	}
+
+	if replyErr != nil {
+		return nil, replyErr
+	}
+
+	return replies, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+
+		values := make([]any, 0, size)
+		for range size {
+			value, err := readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type '%c'", line[0])
+	}
+}
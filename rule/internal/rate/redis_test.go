@@ -0,0 +1,267 @@
+package rate_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ella.to/baker/rule/internal/rate"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server which only
+// understands the commands used by the redis counter
+type fakeRedis struct {
+	listener net.Listener
+	values   map[string]int64
+	commands []string
+	mu       sync.Mutex
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis{
+		listener: listener,
+		values:   make(map[string]int64),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	t.Cleanup(func() { listener.Close() })
+
+	return f
+}
+
+func (f *fakeRedis) Addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		cmd, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.ToUpper(cmd[0]))
+
+		switch strings.ToUpper(cmd[0]) {
+		case "AUTH", "SELECT", "PEXPIRE":
+			fmt.Fprint(conn, "+OK\r\n")
+		case "INCRBY":
+			amount, _ := strconv.ParseInt(cmd[2], 10, 64)
+			f.values[cmd[1]] += amount
+			fmt.Fprintf(conn, ":%d\r\n", f.values[cmd[1]])
+		case "GET":
+			value, ok := f.values[cmd[1]]
+			if !ok {
+				fmt.Fprint(conn, "$-1\r\n")
+				break
+			}
+			v := strconv.FormatInt(value, 10)
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+		case "MGET":
+			fmt.Fprintf(conn, "*%d\r\n", len(cmd)-1)
+			for _, key := range cmd[1:] {
+				value, ok := f.values[key]
+				if !ok {
+					fmt.Fprint(conn, "$-1\r\n")
+					continue
+				}
+				v := strconv.FormatInt(value, 10)
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd[0])
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakeRedis) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.commands...)
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := make([]string, 0, size)
+	for range size {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, string(buf[:n]))
+	}
+
+	return cmd, nil
+}
+
+func TestRedisCounter(t *testing.T) {
+	server := newFakeRedis(t)
+
+	// two limiters with their own connection to the same server act like two baker instances
+	urls := []string{
+		fmt.Sprintf("redis://:secret@%s/2?prefix=test", server.Addr()),
+		fmt.Sprintf("redis://:secret@%s/2?prefix=test&timeout=2s", server.Addr()),
+	}
+
+	routers := make([]http.Handler, 0, len(urls))
+	for _, url := range urls {
+		counter, err := rate.NewRedisCounter(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		routers = append(routers, rate.Limit(3, 10*time.Second, rate.WithLimitCounter(counter))(h))
+	}
+
+	respCodes := []int{200, 200, 200, 429, 429}
+	for i, code := range respCodes {
+		req := httptest.NewRequest("GET", "/", nil)
+		recorder := httptest.NewRecorder()
+		routers[i%2].ServeHTTP(recorder, req)
+		if respCode := recorder.Result().StatusCode; respCode != code {
+			t.Errorf("resp.StatusCode(%v) = %v, want %v", i, respCode, code)
+		}
+	}
+
+	commands := strings.Join(server.Commands(), ",")
+	if !strings.HasPrefix(commands, "AUTH,SELECT,INCRBY,PEXPIRE,GET") {
+		t.Errorf("unexpected commands: %s", commands)
+	}
+}
+
+func TestRedisCounterConcurrent(t *testing.T) {
+	server := newFakeRedis(t)
+
+	url := fmt.Sprintf("redis://%s?prefix=concurrent", server.Addr())
+
+	newRouter := func(prefix string) http.Handler {
+		counter, err := rate.NewRedisCounter(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		return rate.Limit(10, time.Minute, rate.WithLimitCounter(counter), rate.WithKeyPrefix(prefix))(h)
+	}
+
+	// two instances of the same endpoint, and another endpoint with the same key
+	endpoint := []http.Handler{newRouter("a:"), newRouter("a:")}
+	other := newRouter("b:")
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	allowed := 0
+
+	for i := range 30 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			recorder := httptest.NewRecorder()
+			endpoint[i%2].ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+			if recorder.Result().StatusCode == http.StatusOK {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 10 {
+		t.Fatalf("expected 10 requests to be allowed, got %d", allowed)
+	}
+
+	recorder := httptest.NewRecorder()
+	other.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Result().StatusCode != http.StatusOK {
+		t.Fatal("expected the other endpoint to have its own counter")
+	}
+}
+
+func TestRedisCounterFallback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	counter, err := rate.NewRedisCounter(fmt.Sprintf("redis://%s?timeout=100ms", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router := rate.Limit(2, 10*time.Second, rate.WithLimitCounter(counter))(h)
+
+	for i, code := range []int{200, 200, 429} {
+		req := httptest.NewRequest("GET", "/", nil)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		if respCode := recorder.Result().StatusCode; respCode != code {
+			t.Errorf("resp.StatusCode(%v) = %v, want %v", i, respCode, code)
+		}
+	}
+}
+
+func TestNewRedisCounterInvalidURL(t *testing.T) {
+	for _, rawURL := range []string{"http://localhost:6379", "redis://", "redis://localhost:6379/abc"} {
+		if _, err := rate.NewRedisCounter(rawURL); err == nil {
+			t.Errorf("expected error for %s", rawURL)
+		}
+		if err := rate.ValidateRedisURL(rawURL); err == nil {
+			t.Errorf("expected validation error for %s", rawURL)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package rate
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits requests using a token bucket per key. Each bucket holds up to
+// burst tokens and is refilled with ratePerSecond tokens every second. Every request
+// takes one token (or the value set by WithIncrement), and is rejected if the bucket
+// doesn't have enough tokens. If keyFn is nil, all requests share the same bucket.
+// If onLimit is nil, a 429 response is sent back.
+func TokenBucket(ratePerSecond float64, burst int, keyFn KeyFunc, onLimit http.HandlerFunc) func(next http.Handler) http.Handler {
+	return newTokenBucketLimiter(ratePerSecond, burst, keyFn, onLimit).Handler
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+type tokenBucketLimiter struct {
+	ratePerSecond float64
+	burst         int
+	keyFn         KeyFunc
+	onLimit       http.HandlerFunc
+	buckets       map[string]*bucket
+	lastEvict     time.Time
+	mu            sync.Mutex
+}
+
+func newTokenBucketLimiter(ratePerSecond float64, burst int, keyFn KeyFunc, onLimit http.HandlerFunc) *tokenBucketLimiter {
+	if keyFn == nil {
+		keyFn = func(r *http.Request) (string, error) {
+			return "*", nil
+		}
+	}
+
+	if onLimit == nil {
+		onLimit = func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		}
+	}
+
+	return &tokenBucketLimiter{
+		ratePerSecond: ratePerSecond,
+		burst:         burst,
+		keyFn:         keyFn,
+		onLimit:       onLimit,
+		buckets:       make(map[string]*bucket),
+	}
+}
+
+// take tries to remove the given amount of tokens from the bucket of the key. It returns
+// whether it succeeded, the number of remaining tokens and how long the caller
+// should wait before the bucket has enough tokens.
+func (l *tokenBucketLimiter) take(key string, amount int) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.evict(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), updatedAt: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.updatedAt).Seconds()*l.ratePerSecond)
+	b.updatedAt = now
+
+	if b.tokens < float64(amount) {
+		wait := time.Duration((float64(amount) - b.tokens) / l.ratePerSecond * float64(time.Second))
+		return false, int(b.tokens), wait
+	}
+
+	b.tokens -= float64(amount)
+
+	return true, int(b.tokens), 0
+}
+
+// evict removes the buckets which are full, since a missing bucket
+// is the same as a full one. It should be called while holding the lock.
+func (l *tokenBucketLimiter) evict(now time.Time) {
+	refill := time.Duration(float64(l.burst) / l.ratePerSecond * float64(time.Second))
+	if now.Sub(l.lastEvict) < refill {
+		return
+	}
+	l.lastEvict = now
+
+	for k, b := range l.buckets {
+		if now.Sub(b.updatedAt) >= refill {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+func (l *tokenBucketLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := l.keyFn(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusPreconditionRequired)
+			return
+		}
+
+		ok, remaining, wait := l.take(key, getIncrement(r.Context()))
+
+		w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", l.burst))
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", remaining))
+
+		if !ok {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds())))) // RFC 6585
+			l.onLimit(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,44 @@
+package rate_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ella.to/baker/rule/internal/rate"
+)
+
+func TestTokenBucket(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	// 10 tokens per second with a burst of 3
+	router := rate.TokenBucket(10, 3, rate.KeyByIP, nil)(h)
+
+	call := func(ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Result().StatusCode
+	}
+
+	for i, code := range []int{200, 200, 200, 429} {
+		if respCode := call("1.1.1.1:100"); respCode != code {
+			t.Errorf("resp.StatusCode(%v) = %v, want %v", i, respCode, code)
+		}
+	}
+
+	// other keys have their own bucket
+	if respCode := call("2.2.2.2:100"); respCode != 200 {
+		t.Errorf("resp.StatusCode = %v, want 200", respCode)
+	}
+
+	// one token is added every 100ms
+	time.Sleep(150 * time.Millisecond)
+
+	for i, code := range []int{200, 429} {
+		if respCode := call("1.1.1.1:100"); respCode != code {
+			t.Errorf("resp.StatusCode(%v) = %v, want %v", i, respCode, code)
+		}
+	}
+}
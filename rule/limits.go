@@ -0,0 +1,226 @@
+package rule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"ella.to/baker/internal/accesslog"
+	"ella.to/baker/internal/errorpage"
+)
+
+const LimitsName = "Limits"
+
+var (
+	// ErrResponseHeaderTimeout is the cause of the request context being canceled
+	// when the upstream doesn't send the response headers in time
+	ErrResponseHeaderTimeout = errors.New("upstream response header timeout")
+	// ErrUpstreamTimeout is the cause of the request context being canceled
+	// when the upstream doesn't send the whole response in time
+	ErrUpstreamTimeout = errors.New("upstream timeout")
+)
+
+// IsTimeout returns true if the request was canceled because of one of the timeouts of Limits
+func IsTimeout(ctx context.Context) bool {
+	cause := context.Cause(ctx)
+	return errors.Is(cause, ErrResponseHeaderTimeout) || errors.Is(cause, ErrUpstreamTimeout)
+}
+
+// Limits protects the service from large requests and the clients from slow services
+type Limits struct {
+	MaxBodySize           ByteSize        `json:"max_body_size,omitempty"`
+	MaxHeaderSize         ByteSize        `json:"max_header_size,omitempty"`
+	ResponseHeaderTimeout *WindowDuration `json:"response_header_timeout,omitempty"`
+	Timeout               *WindowDuration `json:"timeout,omitempty"`
+}
+
+var _ Middleware = (*Limits)(nil)
+
+func (l *Limits) IsCachable() bool {
+	return false
+}
+
+func (l *Limits) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func headerSize(r *http.Request) int64 {
+	// request line: METHOD URI PROTO\r\n
+	size := int64(len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4)
+	if r.Host != "" {
+		size += int64(len("Host: \r\n") + len(r.Host))
+	}
+
+	for k, values := range r.Header {
+		for _, v := range values {
+			// key: value\r\n
+			size += int64(len(k) + len(v) + 4)
+		}
+	}
+
+	return size
+}
+
+func (l *Limits) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.MaxHeaderSize > 0 && headerSize(r) > int64(l.MaxHeaderSize) {
+			accesslog.Annotate(r.Context(), LimitsName, "header_too_large")
+			errorpage.Write(w, r, http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+
+		if l.MaxBodySize > 0 {
+			if r.ContentLength > int64(l.MaxBodySize) {
+				accesslog.Annotate(r.Context(), LimitsName, "body_too_large")
+				errorpage.Write(w, r, http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = http.MaxBytesReader(w, r.Body, int64(l.MaxBodySize))
+			}
+		}
+
+		// an upgraded connection, e.g. a websocket, lasts as long as the client and the service
+		// keep it open, the proxy closes it once the context of the request is done
+		if isUpgradeRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+
+		if l.Timeout != nil && l.Timeout.Duration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeoutCause(ctx, l.Timeout.Duration, ErrUpstreamTimeout)
+			defer cancel()
+		}
+
+		if l.ResponseHeaderTimeout != nil && l.ResponseHeaderTimeout.Duration > 0 {
+			var cancel context.CancelCauseFunc
+			ctx, cancel = context.WithCancelCause(ctx)
+			defer cancel(nil)
+
+			timer := time.AfterFunc(l.ResponseHeaderTimeout.Duration, func() {
+				cancel(ErrResponseHeaderTimeout)
+			})
+			defer timer.Stop()
+
+			w = &headerTimeoutWriter{ResponseWriter: w, timer: timer}
+		}
+
+		if ctx != r.Context() {
+			r = r.WithContext(ctx)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isUpgradeRequest returns true if the request asks to switch protocols, e.g. Connection: keep-alive, Upgrade
+func isUpgradeRequest(r *http.Request) bool {
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// headerTimeoutWriter stops the response header timer
+// once the upstream starts sending the response
+type headerTimeoutWriter struct {
+	http.ResponseWriter
+	timer *time.Timer
+}
+
+func (h *headerTimeoutWriter) WriteHeader(code int) {
+	if code >= 200 {
+		h.timer.Stop()
+	}
+	h.ResponseWriter.WriteHeader(code)
+}
+
+func (h *headerTimeoutWriter) Write(p []byte) (int, error) {
+	h.timer.Stop()
+	return h.ResponseWriter.Write(p)
+}
+
+func (h *headerTimeoutWriter) Flush() {
+	http.NewResponseController(h.ResponseWriter).Flush()
+}
+
+func (h *headerTimeoutWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+type LimitsOption func(*Limits)
+
+// WithMaxBodySize rejects requests with a body larger than size with a 413 status
+func WithMaxBodySize(size int64) LimitsOption {
+	return func(l *Limits) {
+		l.MaxBodySize = ByteSize(size)
+	}
+}
+
+// WithMaxHeaderSize rejects requests with headers larger than size with a 431 status
+func WithMaxHeaderSize(size int64) LimitsOption {
+	return func(l *Limits) {
+		l.MaxHeaderSize = ByteSize(size)
+	}
+}
+
+// WithResponseHeaderTimeout sends a 504 status if the service doesn't send
+// the response headers within the given duration
+func WithResponseHeaderTimeout(d time.Duration) LimitsOption {
+	return func(l *Limits) {
+		l.ResponseHeaderTimeout = &WindowDuration{Duration: d}
+	}
+}
+
+// WithTimeout sets how long the service has to send the whole response
+func WithTimeout(d time.Duration) LimitsOption {
+	return func(l *Limits) {
+		l.Timeout = &WindowDuration{Duration: d}
+	}
+}
+
+func NewLimits(opts ...LimitsOption) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	limits := Limits{}
+
+	for _, opt := range opts {
+		opt(&limits)
+	}
+
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: LimitsName,
+		Args: limits,
+	}
+}
+
+func RegisterLimits() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[LimitsName] = func(raw json.RawMessage) (Middleware, error) {
+			limits := &Limits{}
+			err := json.Unmarshal(raw, limits)
+			if err != nil {
+				return nil, err
+			}
+			return limits, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,172 @@
+package rule
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLimits(t *testing.T, args string) Middleware {
+	builders := map[string]BuilderFunc{}
+	RegisterLimits()(builders)
+
+	middleware, err := builders[LimitsName](json.RawMessage(args))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return middleware
+}
+
+func TestLimitsSize(t *testing.T) {
+	h := newTestLimits(t, `{"max_body_size":"10B","max_header_size":"1KB"}`).Process(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		header        string
+		wantCode      int
+	}{
+		{name: "small body", body: "hello", contentLength: 5, wantCode: 200},
+		{name: "large body", body: "hello world!", contentLength: 12, wantCode: 413},
+		{name: "large body without content length", body: "hello world!", contentLength: -1, wantCode: 413},
+		{name: "large header", header: strings.Repeat("a", 2000), wantCode: 431},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.ContentLength = tt.contentLength
+			if tt.header != "" {
+				req.Header.Set("X-Large", tt.header)
+			}
+
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestLimitsTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        string
+		headerDelay time.Duration
+		bodyDelay   time.Duration
+		wantTimeout bool
+	}{
+		{name: "fast", args: `{"response_header_timeout":"50ms","timeout":"200ms"}`, wantTimeout: false},
+		{name: "slow headers", args: `{"response_header_timeout":"50ms"}`, headerDelay: 100 * time.Millisecond, wantTimeout: true},
+		{name: "slow body", args: `{"response_header_timeout":"50ms","timeout":"100ms"}`, bodyDelay: 200 * time.Millisecond, wantTimeout: true},
+		{name: "slow body without total timeout", args: `{"response_header_timeout":"50ms"}`, bodyDelay: 100 * time.Millisecond, wantTimeout: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var timedOut bool
+
+			h := newTestLimits(t, tt.args).Process(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wait := func(d time.Duration) {
+					select {
+					case <-time.After(d):
+					case <-r.Context().Done():
+						timedOut = IsTimeout(r.Context())
+					}
+				}
+
+				wait(tt.headerDelay)
+				w.WriteHeader(http.StatusOK)
+				wait(tt.bodyDelay)
+			}))
+
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if timedOut != tt.wantTimeout {
+				t.Errorf("timed out = %v, want %v", timedOut, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestLimitsUpgrade(t *testing.T) {
+	// the service echoes the lines sent on the upgraded connection
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString(line)
+			rw.Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := newTestLimits(t, `{"response_header_timeout":"50ms","timeout":"100ms"}`)
+	server := httptest.NewServer(limits.Process(httputil.NewSingleHostReverseProxy(target)))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive, Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	// the connection outlives both timeouts
+	time.Sleep(200 * time.Millisecond)
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(conn, "hello\n")
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("expected the upgraded connection to stay open, got %v", err)
+	}
+
+	if line != "hello\n" {
+		t.Errorf("got %q, want %q", line, "hello\n")
+	}
+}
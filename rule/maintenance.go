@@ -0,0 +1,195 @@
+package rule
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ella.to/baker/internal/accesslog"
+	"ella.to/baker/internal/errorpage"
+)
+
+const MaintenanceName = "Maintenance"
+
+const defaultMaintenanceRetryAfter = time.Minute
+
+// Maintenance takes the endpoint down, every request gets a 503 error page with
+// a Retry-After header. Clients from AllowIPs, or sending BypassSecret in the
+// BypassHeader, still reach the service.
+type Maintenance struct {
+	RetryAfter   *WindowDuration `json:"retry_after,omitempty"`
+	AllowIPs     []string        `json:"allow_ips,omitempty"`
+	BypassHeader string          `json:"bypass_header,omitempty"`
+	BypassSecret string          `json:"bypass_secret,omitempty"`
+	prefixes     []netip.Prefix
+}
+
+var _ Middleware = (*Maintenance)(nil)
+
+func (m *Maintenance) IsCachable() bool {
+	return false
+}
+
+func (m *Maintenance) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (m *Maintenance) validate() error {
+	if (m.BypassHeader == "") != (m.BypassSecret == "") {
+		return fmt.Errorf("bypass_header and bypass_secret must be set together")
+	}
+
+	m.prefixes = make([]netip.Prefix, 0, len(m.AllowIPs))
+
+	for _, value := range m.AllowIPs {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return fmt.Errorf("invalid allowed ip '%s': %w", value, err)
+			}
+			m.prefixes = append(m.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return fmt.Errorf("invalid allowed ip range '%s': %w", value, err)
+		}
+		m.prefixes = append(m.prefixes, prefix.Masked())
+	}
+
+	return nil
+}
+
+// isAllowed checks the address of the connection, forwarded headers are
+// ignored since any client can set them
+func (m *Maintenance) isAllowed(r *http.Request) bool {
+	if len(m.prefixes) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	return slices.ContainsFunc(m.prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+func (m *Maintenance) hasSecret(r *http.Request) bool {
+	if m.BypassHeader == "" {
+		return false
+	}
+
+	value := r.Header.Get(m.BypassHeader)
+
+	return value != "" && subtle.ConstantTimeCompare([]byte(value), []byte(m.BypassSecret)) == 1
+}
+
+func (m *Maintenance) retryAfter() time.Duration {
+	if m.RetryAfter == nil || m.RetryAfter.Duration <= 0 {
+		return defaultMaintenanceRetryAfter
+	}
+	return m.RetryAfter.Duration
+}
+
+func (m *Maintenance) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.hasSecret(r) {
+			// the secret is meant for baker, the service doesn't need to see it
+			r.Header.Del(m.BypassHeader)
+			accesslog.Annotate(r.Context(), MaintenanceName, "bypass")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if m.isAllowed(r) {
+			accesslog.Annotate(r.Context(), MaintenanceName, "allowed")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		accesslog.Annotate(r.Context(), MaintenanceName, "blocked")
+		w.Header().Set("Retry-After", strconv.Itoa(int(m.retryAfter().Seconds())))
+		w.Header().Set("Cache-Control", "no-store")
+		errorpage.Write(w, r, http.StatusServiceUnavailable)
+	})
+}
+
+type MaintenanceOption func(*Maintenance)
+
+// WithMaintenanceRetryAfter sets the Retry-After header sent to the clients, one minute by default
+func WithMaintenanceRetryAfter(d time.Duration) MaintenanceOption {
+	return func(m *Maintenance) {
+		m.RetryAfter = &WindowDuration{Duration: d}
+	}
+}
+
+// WithMaintenanceAllowIPs lets the given ips or ranges, e.g. "10.0.0.0/8", reach the service
+func WithMaintenanceAllowIPs(ips ...string) MaintenanceOption {
+	return func(m *Maintenance) {
+		m.AllowIPs = slices.Clone(ips)
+	}
+}
+
+// WithMaintenanceBypass lets the requests with the secret in the given header reach the service
+func WithMaintenanceBypass(header string, secret string) MaintenanceOption {
+	return func(m *Maintenance) {
+		m.BypassHeader = header
+		m.BypassSecret = secret
+	}
+}
+
+func NewMaintenance(opts ...MaintenanceOption) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	maintenance := Maintenance{}
+
+	for _, opt := range opts {
+		opt(&maintenance)
+	}
+
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: MaintenanceName,
+		Args: maintenance,
+	}
+}
+
+func RegisterMaintenance() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[MaintenanceName] = func(raw json.RawMessage) (Middleware, error) {
+			maintenance := &Maintenance{}
+			err := json.Unmarshal(raw, maintenance)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := maintenance.validate(); err != nil {
+				return nil, err
+			}
+
+			return maintenance, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,98 @@
+package rule
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestMaintenance(t *testing.T, args string) Middleware {
+	builders := map[string]BuilderFunc{}
+	RegisterMaintenance()(builders)
+
+	middleware, err := builders[MaintenanceName](json.RawMessage(args))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return middleware
+}
+
+func TestMaintenance(t *testing.T) {
+	h := newTestMaintenance(t, `{
+		"retry_after": "10m",
+		"allow_ips": ["10.0.0.0/8", "192.168.1.10", "2001:db8::1"],
+		"bypass_header": "X-Maintenance-Bypass",
+		"bypass_secret": "s3cret"
+	}`).Process(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Maintenance-Bypass") != "" {
+			t.Error("bypass header should not reach the service")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		secret     string
+		forwarded  string
+		wantCode   int
+	}{
+		{name: "blocked", remoteAddr: "1.2.3.4:1234", wantCode: 503},
+		{name: "allowed range", remoteAddr: "10.1.2.3:1234", wantCode: 200},
+		{name: "allowed ip", remoteAddr: "192.168.1.10:1234", wantCode: 200},
+		{name: "allowed ipv4 mapped ipv6", remoteAddr: "[::ffff:192.168.1.10]:1234", wantCode: 200},
+		{name: "allowed ipv6", remoteAddr: "[2001:db8::1]:1234", wantCode: 200},
+		{name: "forwarded headers are ignored", remoteAddr: "1.2.3.4:1234", forwarded: "10.0.0.1", wantCode: 503},
+		{name: "secret", remoteAddr: "1.2.3.4:1234", secret: "s3cret", wantCode: 200},
+		{name: "wrong secret", remoteAddr: "1.2.3.4:1234", secret: "guess", wantCode: 503},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.secret != "" {
+				req.Header.Set("X-Maintenance-Bypass", tt.secret)
+			}
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.wantCode)
+			}
+
+			if tt.wantCode == http.StatusServiceUnavailable {
+				if got := recorder.Header().Get("Retry-After"); got != "600" {
+					t.Errorf("Retry-After = %q, want %q", got, "600")
+				}
+			}
+		})
+	}
+}
+
+func TestMaintenanceValidate(t *testing.T) {
+	builders := map[string]BuilderFunc{}
+	RegisterMaintenance()(builders)
+
+	tests := []struct {
+		name string
+		args string
+	}{
+		{name: "invalid ip", args: `{"allow_ips":["10.0.0"]}`},
+		{name: "invalid range", args: `{"allow_ips":["10.0.0.0/40"]}`},
+		{name: "header without secret", args: `{"bypass_header":"X-Bypass"}`},
+		{name: "secret without header", args: `{"bypass_secret":"s3cret"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := builders[MaintenanceName](json.RawMessage(tt.args)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -11,6 +11,13 @@ type Middleware interface {
 	UpdateMiddelware(newImpl Middleware) Middleware
 }
 
+// Scoped is implemented by the middlewares which keep their state outside of baker, e.g.
+// in Redis. The scope identifies the endpoint and the position of the rule, so the state
+// of the endpoints which share the same storage is kept apart.
+type Scoped interface {
+	SetScope(scope string)
+}
+
 type BuilderFunc func(raw json.RawMessage) (Middleware, error)
 type RegisterFunc func(map[string]BuilderFunc) error
 
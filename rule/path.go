@@ -1,9 +1,16 @@
 package rule
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+
+	"ella.to/baker/internal/errorpage"
 )
 
 const AppendPathName = "AppendPath"
@@ -124,3 +131,126 @@ func RegisterReplacePath() RegisterFunc {
 		return nil
 	}
 }
+
+const RewritePathName = "RewritePath"
+
+// RewritePath rewrites the path using a regular expression. If Query is set, the
+// pattern is applied to the path and query string together, e.g. /a?b=c
+type RewritePath struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	Query       bool   `json:"query,omitempty"`
+	regex       *regexp.Regexp
+}
+
+var _ Middleware = (*RewritePath)(nil)
+
+func (p *RewritePath) IsCachable() bool {
+	return false
+}
+
+func (p *RewritePath) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+type originalURIKey struct{}
+
+func (p *RewritePath) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the pattern is applied to the escaped path, so an encoded ? or / stays part of the path
+		input := r.URL.EscapedPath()
+		if p.Query && r.URL.RawQuery != "" {
+			input += "?" + r.URL.RawQuery
+		}
+
+		if !p.regex.MatchString(input) {
+			// the header is only sent by baker, unless a previous rewrite set it
+			if _, ok := r.Context().Value(originalURIKey{}).(string); !ok {
+				r.Header.Del("X-Original-URI")
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		output := p.regex.ReplaceAllString(input, p.Replacement)
+
+		escapedPath, query, hasQuery := strings.Cut(output, "?")
+		if !strings.HasPrefix(escapedPath, "/") {
+			escapedPath = "/" + escapedPath
+		}
+
+		path, err := url.PathUnescape(escapedPath)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to rewrite path", "path", r.URL.Path, "output", output, "error", err)
+			errorpage.Write(w, r, http.StatusBadRequest)
+			return
+		}
+
+		// keep the very first uri, in case there are multiple rewrites, the
+		// header sent by the client is always replaced
+		originalURI, ok := r.Context().Value(originalURIKey{}).(string)
+		if !ok {
+			originalURI = r.URL.RequestURI()
+			r = r.WithContext(context.WithValue(r.Context(), originalURIKey{}, originalURI))
+		}
+		r.Header.Set("X-Original-URI", originalURI)
+
+		// the query string of the replacement is merged with the one of the request,
+		// unless the pattern was applied to the query string too
+		if hasQuery {
+			if !p.Query && r.URL.RawQuery != "" {
+				query += "&" + r.URL.RawQuery
+			}
+			r.URL.RawQuery = query
+		} else if p.Query {
+			r.URL.RawQuery = ""
+		}
+
+		r.URL.Path = path
+		r.URL.RawPath = ""
+		if r.URL.EscapedPath() != escapedPath {
+			r.URL.RawPath = escapedPath
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func NewRewritePath(pattern string, replacement string, query bool) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: RewritePathName,
+		Args: RewritePath{
+			Pattern:     pattern,
+			Replacement: replacement,
+			Query:       query,
+		},
+	}
+}
+
+func RegisterRewritePath() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[RewritePathName] = func(raw json.RawMessage) (Middleware, error) {
+			rewritePath := &RewritePath{}
+			err := json.Unmarshal(raw, rewritePath)
+			if err != nil {
+				return nil, err
+			}
+
+			rewritePath.regex, err = compileRegexp(rewritePath.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rewrite pattern: %w", err)
+			}
+
+			return rewritePath, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,163 @@
+package rule
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewritePath(t *testing.T) {
+	tests := []struct {
+		name            string
+		args            string
+		url             string
+		header          http.Header
+		wantURI         string
+		wantOriginalURI string
+	}{
+		{
+			name:            "capture groups",
+			args:            `{"pattern":"^/api/v(\\d+)/(.*)$","replacement":"/$2"}`,
+			url:             "/api/v1/users?page=2",
+			wantURI:         "/users?page=2",
+			wantOriginalURI: "/api/v1/users?page=2",
+		},
+		{
+			name:            "named capture groups",
+			args:            `{"pattern":"^/users/(?P<id>\\d+)$","replacement":"/profile/${id}"}`,
+			url:             "/users/42",
+			wantURI:         "/profile/42",
+			wantOriginalURI: "/users/42",
+		},
+		{
+			name:            "path to query",
+			args:            `{"pattern":"^/users/(\\d+)$","replacement":"/users?id=$1"}`,
+			url:             "/users/42",
+			wantURI:         "/users?id=42",
+			wantOriginalURI: "/users/42",
+		},
+		{
+			name:            "path to query merged with the query of the request",
+			args:            `{"pattern":"^/users/(\\d+)$","replacement":"/users?id=$1"}`,
+			url:             "/users/42?page=2",
+			wantURI:         "/users?id=42&page=2",
+			wantOriginalURI: "/users/42?page=2",
+		},
+		{
+			name:            "encoded question mark stays in the path",
+			args:            `{"pattern":"^/files/(.*)$","replacement":"/static/$1"}`,
+			url:             "/files/a%3Fadmin=1",
+			wantURI:         "/static/a%3Fadmin=1",
+			wantOriginalURI: "/files/a%3Fadmin=1",
+		},
+		{
+			name:            "original uri sent by the client is replaced",
+			args:            `{"pattern":"^/api/(.*)$","replacement":"/$1"}`,
+			url:             "/api/users",
+			header:          http.Header{"X-Original-Uri": {"/admin"}},
+			wantURI:         "/users",
+			wantOriginalURI: "/api/users",
+		},
+		{
+			name:            "with query",
+			args:            `{"pattern":"^/search\\?q=([^&]*)$","replacement":"/find?term=$1","query":true}`,
+			url:             "/search?q=baker",
+			wantURI:         "/find?term=baker",
+			wantOriginalURI: "/search?q=baker",
+		},
+		{
+			name:            "with query removed",
+			args:            `{"pattern":"^/a\\?.*$","replacement":"/b","query":true}`,
+			url:             "/a?x=1",
+			wantURI:         "/b",
+			wantOriginalURI: "/a?x=1",
+		},
+		{
+			name:    "not matching with an original uri sent by the client",
+			args:    `{"pattern":"^/api/(.*)$","replacement":"/$1"}`,
+			url:     "/web/index.html",
+			header:  http.Header{"X-Original-Uri": {"/admin"}},
+			wantURI: "/web/index.html",
+		},
+		{
+			name:    "not matching",
+			args:    `{"pattern":"^/api/(.*)$","replacement":"/$1"}`,
+			url:     "/web/index.html",
+			wantURI: "/web/index.html",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builders := map[string]BuilderFunc{}
+			RegisterRewritePath()(builders)
+
+			middleware, err := builders[RewritePathName](json.RawMessage(tt.args))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotURI, gotOriginalURI string
+			h := middleware.Process(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotURI = r.URL.RequestURI()
+				gotOriginalURI = r.Header.Get("X-Original-URI")
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if gotURI != tt.wantURI {
+				t.Errorf("uri = %q, want %q", gotURI, tt.wantURI)
+			}
+			if gotOriginalURI != tt.wantOriginalURI {
+				t.Errorf("X-Original-URI = %q, want %q", gotOriginalURI, tt.wantOriginalURI)
+			}
+		})
+	}
+}
+
+func TestRewritePathChained(t *testing.T) {
+	builders := map[string]BuilderFunc{}
+	RegisterRewritePath()(builders)
+
+	first, err := builders[RewritePathName](json.RawMessage(`{"pattern":"^/a$","replacement":"/b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := builders[RewritePathName](json.RawMessage(`{"pattern":"^/b$","replacement":"/c"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rewrite which doesn't match keeps the header of the previous ones
+	third, err := builders[RewritePathName](json.RawMessage(`{"pattern":"^/x$","replacement":"/y"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotURI, gotOriginalURI string
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURI = r.URL.RequestURI()
+		gotOriginalURI = r.Header.Get("X-Original-URI")
+	}), first, second, third)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a", nil))
+
+	if gotURI != "/c" || gotOriginalURI != "/a" {
+		t.Errorf("uri = %q, X-Original-URI = %q, want /c and /a", gotURI, gotOriginalURI)
+	}
+}
+
+func TestRewritePathInvalidPattern(t *testing.T) {
+	builders := map[string]BuilderFunc{}
+	RegisterRewritePath()(builders)
+
+	if _, err := builders[RewritePathName](json.RawMessage(`{"pattern":"(","replacement":""}`)); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
+	"ella.to/baker/internal/accesslog"
+	"ella.to/baker/internal/errorpage"
 	"ella.to/baker/rule/internal/rate"
 )
 
@@ -35,13 +38,221 @@ func (d *WindowDuration) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+const RateLimiterName = "RateLimiter"
+
+const (
+	// RateLimitSlidingWindow counts the requests in a sliding window of window_duration
+	RateLimitSlidingWindow = "sliding_window"
+	// RateLimitTokenBucket refills request_limit tokens every window_duration, and allows
+	// up to burst requests at once
+	RateLimitTokenBucket = "token_bucket"
+	// RateLimitConcurrency limits the number of requests processed at the same time
+	RateLimitConcurrency = "concurrency"
+)
+
 type RateLimiter struct {
-	RequestLimit   int            `json:"request_limit"`
-	WindowDuration WindowDuration `json:"window_duration"`
+	Mode           string          `json:"mode,omitempty"`
+	RequestLimit   int             `json:"request_limit"`
+	WindowDuration WindowDuration  `json:"window_duration"`
+	Burst          int             `json:"burst,omitempty"`
+	MaxInFlight    int             `json:"max_in_flight,omitempty"`
+	QueueSize      int             `json:"queue_size,omitempty"`
+	QueueTimeout   *WindowDuration `json:"queue_timeout,omitempty"`
+	Key            string          `json:"key,omitempty"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	ResponseBody   string          `json:"response_body,omitempty"`
+	Counter        string          `json:"counter,omitempty"`
+	keyFuncs       []rate.KeyFunc
+	scope          string
 	middle         func(next http.Handler) http.Handler
 }
 
+// parseRateLimitKey converts a key spec into a list of key functions. The spec is
+// a comma separated list of the following items: ip, real_ip, path, header:<name>,
+// cookie:<name> and jwt:<claim>. If more than one item is given, the final key is
+// the combination of all of them. An empty spec means ip.
+func parseRateLimitKey(spec string) ([]rate.KeyFunc, error) {
+	if strings.TrimSpace(spec) == "" {
+		return []rate.KeyFunc{rate.KeyByIP}, nil
+	}
+
+	keyFuncs := make([]rate.KeyFunc, 0)
+
+	for _, item := range strings.Split(spec, ",") {
+		kind, name, _ := strings.Cut(strings.TrimSpace(item), ":")
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		name = strings.TrimSpace(name)
+
+		switch kind {
+		case "ip":
+			keyFuncs = append(keyFuncs, rate.KeyByIP)
+		case "real_ip":
+			keyFuncs = append(keyFuncs, rate.KeyByRealIP)
+		case "path":
+			keyFuncs = append(keyFuncs, rate.KeyByEndpoint)
+		case "header", "cookie", "jwt":
+			if name == "" {
+				return nil, fmt.Errorf("rate limiter key '%s' requires a name", kind)
+			}
+
+			switch kind {
+			case "header":
+				keyFuncs = append(keyFuncs, rate.KeyByHeader(name))
+			case "cookie":
+				keyFuncs = append(keyFuncs, rate.KeyByCookie(name))
+			case "jwt":
+				keyFuncs = append(keyFuncs, rate.KeyByJWTClaim(name))
+			}
+		default:
+			return nil, fmt.Errorf("unknown rate limiter key '%s'", item)
+		}
+	}
+
+	return keyFuncs, nil
+}
+
+// parseRateLimitCounter returns the counter used to store the number of requests.
+// An empty value or "local" keeps the counters in memory, so each instance of baker
+// has its own limits. A redis:// url shares the counters between all instances
+// which point to the same server.
+func parseRateLimitCounter(spec string) (rate.LimitCounter, error) {
+	switch {
+	case spec == "" || spec == "local":
+		return nil, nil
+	case strings.HasPrefix(spec, "redis://"):
+		return rate.NewRedisCounter(spec)
+	default:
+		return nil, fmt.Errorf("unknown rate limiter counter '%s'", spec)
+	}
+}
+
+// validateRateLimitCounter checks the spec like parseRateLimitCounter, without creating
+// the counter, which is done once the middleware is built instead of for every request
+func validateRateLimitCounter(spec string) error {
+	if strings.HasPrefix(spec, "redis://") {
+		return rate.ValidateRedisURL(spec)
+	}
+
+	// nothing is created for the local counters and the unknown specs
+	_, err := parseRateLimitCounter(spec)
+	return err
+}
+
+func (r *RateLimiter) validate() error {
+	switch r.Mode {
+	case "", RateLimitSlidingWindow:
+	case RateLimitTokenBucket:
+		if r.RequestLimit <= 0 || r.WindowDuration.Duration <= 0 {
+			return fmt.Errorf("token_bucket mode requires request_limit and window_duration")
+		}
+	case RateLimitConcurrency:
+		if r.MaxInFlight <= 0 {
+			return fmt.Errorf("concurrency mode requires max_in_flight")
+		}
+		if r.QueueSize > 0 && r.queueTimeout() <= 0 {
+			return fmt.Errorf("queue_size requires queue_timeout")
+		}
+		if r.Key != "" {
+			return fmt.Errorf("key is not supported in concurrency mode, the limit is shared by all clients")
+		}
+	default:
+		return fmt.Errorf("unknown rate limiter mode '%s'", r.Mode)
+	}
+
+	if r.Counter != "" && r.Counter != "local" && r.Mode != "" && r.Mode != RateLimitSlidingWindow {
+		return fmt.Errorf("counter is only supported in sliding_window mode")
+	}
+
+	return validateRateLimitCounter(r.Counter)
+}
+
+func (r *RateLimiter) isSame(other *RateLimiter) bool {
+	return r.Mode == other.Mode &&
+		r.RequestLimit == other.RequestLimit &&
+		r.WindowDuration == other.WindowDuration &&
+		r.Burst == other.Burst &&
+		r.MaxInFlight == other.MaxInFlight &&
+		r.QueueSize == other.QueueSize &&
+		r.queueTimeout() == other.queueTimeout() &&
+		r.Key == other.Key &&
+		r.ResponseStatus == other.ResponseStatus &&
+		r.ResponseBody == other.ResponseBody &&
+		r.Counter == other.Counter
+}
+
+func (r *RateLimiter) build() func(next http.Handler) http.Handler {
+	onLimit := r.limitHandler()
+
+	switch r.Mode {
+	case RateLimitTokenBucket:
+		burst := r.Burst
+		if burst <= 0 {
+			burst = r.RequestLimit
+		}
+
+		ratePerSecond := float64(r.RequestLimit) / r.WindowDuration.Seconds()
+
+		return rate.TokenBucket(ratePerSecond, burst, rate.KeyFuncs(r.keyFuncs...), onLimit)
+	case RateLimitConcurrency:
+		return rate.Concurrency(r.MaxInFlight, r.QueueSize, r.queueTimeout(), onLimit)
+	}
+
+	opts := []rate.Option{
+		rate.WithKeyFuncs(r.keyFuncs...),
+	}
+
+	counter, err := parseRateLimitCounter(r.Counter)
+	if err != nil {
+		// the spec was validated when the rule was built, the local counters are used as a fallback
+		slog.Error("failed to create rate limiter counter", "counter", r.Counter, "error", err)
+	}
+
+	if counter != nil {
+		// the shared counters of the endpoints are kept apart, like the local ones
+		opts = append(opts, rate.WithLimitCounter(counter), rate.WithKeyPrefix(r.scope+":"))
+	}
+
+	opts = append(opts, rate.WithLimitHandler(onLimit))
+
+	return rate.Limit(r.RequestLimit, r.WindowDuration.Duration, opts...)
+}
+
+func (r *RateLimiter) queueTimeout() time.Duration {
+	if r.QueueTimeout == nil {
+		return 0
+	}
+	return r.QueueTimeout.Duration
+}
+
+// limitHandler returns the handler for rejected requests, without a custom
+// body the error page of the request is sent back
+func (r *RateLimiter) limitHandler() http.HandlerFunc {
+	statusCode := r.ResponseStatus
+	if statusCode == 0 {
+		statusCode = http.StatusTooManyRequests
+		if r.Mode == RateLimitConcurrency {
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		accesslog.Annotate(req.Context(), RateLimiterName, "limited")
+
+		if r.ResponseBody == "" {
+			errorpage.Write(w, req, statusCode)
+			return
+		}
+
+		http.Error(w, r.ResponseBody, statusCode)
+	}
+}
+
 var _ Middleware = (*RateLimiter)(nil)
+var _ Scoped = (*RateLimiter)(nil)
+
+func (r *RateLimiter) SetScope(scope string) {
+	r.scope = scope
+}
 
 func (r *RateLimiter) IsCachable() bool {
 	return true
@@ -52,11 +263,13 @@ func (r *RateLimiter) UpdateMiddelware(newImpl Middleware) Middleware {
 		slog.Debug(
 			"initializing for the first time",
 			"type", "RateLimiter",
+			"mode", r.Mode,
 			"request_limit", r.RequestLimit,
 			"window_duration", r.WindowDuration.Duration,
+			"key", r.Key,
 		)
 
-		r.middle = rate.LimitByIP(r.RequestLimit, r.WindowDuration.Duration)
+		r.middle = r.build()
 		return r
 	}
 
@@ -66,23 +279,22 @@ func (r *RateLimiter) UpdateMiddelware(newImpl Middleware) Middleware {
 		return r
 	}
 
-	if r.RequestLimit == newR.RequestLimit &&
-		r.WindowDuration == newR.WindowDuration &&
-		r.middle != nil {
+	if r.isSame(newR) && r.middle != nil {
 		return r
 	}
 
 	slog.Debug(
 		"updating middleware",
 		"type", "RateLimiter",
+		"mode", newR.Mode,
 		"request_limit", newR.RequestLimit,
 		"window_duration", newR.WindowDuration.Duration,
+		"key", newR.Key,
 	)
 
-	r.RequestLimit = newR.RequestLimit
-	r.WindowDuration = newR.WindowDuration
+	*r = *newR
 
-	r.middle = rate.LimitByIP(r.RequestLimit, r.WindowDuration.Duration)
+	r.middle = r.build()
 
 	return r
 }
@@ -91,32 +303,96 @@ func (r *RateLimiter) Process(next http.Handler) http.Handler {
 	return r.middle(next)
 }
 
-func NewRateLimiter(requestLimit int, windowDuration time.Duration) struct {
+type RateLimiterOption func(*RateLimiter)
+
+// WithRateLimitKey sets the key spec used to group requests, e.g. "header:X-Api-Key"
+// or "real_ip,path". See parseRateLimitKey for all the supported values.
+func WithRateLimitKey(key string) RateLimiterOption {
+	return func(r *RateLimiter) {
+		r.Key = key
+	}
+}
+
+// WithRateLimitResponse overrides the status code and body sent back
+// when the limit is reached.
+func WithRateLimitResponse(statusCode int, body string) RateLimiterOption {
+	return func(r *RateLimiter) {
+		r.ResponseStatus = statusCode
+		r.ResponseBody = body
+	}
+}
+
+// WithRateLimitTokenBucket switches the rate limiter to token bucket mode. request_limit
+// tokens are added every window_duration and up to burst requests are allowed at once.
+func WithRateLimitTokenBucket(burst int) RateLimiterOption {
+	return func(r *RateLimiter) {
+		r.Mode = RateLimitTokenBucket
+		r.Burst = burst
+	}
+}
+
+// WithRateLimitConcurrency switches the rate limiter to concurrency mode, which allows up to
+// maxInFlight requests at the same time. Other requests wait for up to queueTimeout in a queue
+// of queueSize. When this option is used, requestLimit and windowDuration are ignored.
+func WithRateLimitConcurrency(maxInFlight int, queueSize int, queueTimeout time.Duration) RateLimiterOption {
+	return func(r *RateLimiter) {
+		r.Mode = RateLimitConcurrency
+		r.MaxInFlight = maxInFlight
+		r.QueueSize = queueSize
+		r.QueueTimeout = &WindowDuration{Duration: queueTimeout}
+	}
+}
+
+// WithRateLimitCounter sets where the counters are stored, e.g. "redis://redis:6379/0",
+// so multiple instances of baker share the same limits.
+func WithRateLimitCounter(counter string) RateLimiterOption {
+	return func(r *RateLimiter) {
+		r.Counter = counter
+	}
+}
+
+func NewRateLimiter(requestLimit int, windowDuration time.Duration, opts ...RateLimiterOption) struct {
 	Type string `json:"type"`
 	Args any    `json:"args"`
 } {
+	rateLimiter := RateLimiter{
+		RequestLimit: requestLimit,
+		WindowDuration: WindowDuration{
+			Duration: windowDuration,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(&rateLimiter)
+	}
+
 	return struct {
 		Type string `json:"type"`
 		Args any    `json:"args"`
 	}{
-		Type: "RateLimiter",
-		Args: RateLimiter{
-			RequestLimit: requestLimit,
-			WindowDuration: WindowDuration{
-				Duration: windowDuration,
-			},
-		},
+		Type: RateLimiterName,
+		Args: rateLimiter,
 	}
 }
 
 func RegisterRateLimiter() RegisterFunc {
 	return func(m map[string]BuilderFunc) error {
-		m["RateLimiter"] = func(raw json.RawMessage) (Middleware, error) {
+		m[RateLimiterName] = func(raw json.RawMessage) (Middleware, error) {
 			rateLimiter := &RateLimiter{}
 			err := json.Unmarshal(raw, rateLimiter)
 			if err != nil {
 				return nil, err
 			}
+
+			if err := rateLimiter.validate(); err != nil {
+				return nil, err
+			}
+
+			rateLimiter.keyFuncs, err = parseRateLimitKey(rateLimiter.Key)
+			if err != nil {
+				return nil, err
+			}
+
 			return rateLimiter, nil
 		}
 
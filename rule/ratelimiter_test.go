@@ -0,0 +1,87 @@
+package rule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		count   int
+		wantErr bool
+	}{
+		{name: "empty defaults to ip", spec: "", count: 1},
+		{name: "single", spec: "real_ip", count: 1},
+		{name: "header", spec: "header:X-Api-Key", count: 1},
+		{name: "combination", spec: "ip, path, cookie:session, jwt:sub", count: 4},
+		{name: "missing name", spec: "header", wantErr: true},
+		{name: "unknown", spec: "ip,unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyFuncs, err := parseRateLimitKey(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRateLimitKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(keyFuncs) != tt.count {
+				t.Errorf("parseRateLimitKey() = %d key funcs, want %d", len(keyFuncs), tt.count)
+			}
+		})
+	}
+}
+
+func TestParseRateLimitCounter(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		isNil   bool
+		wantErr bool
+	}{
+		{name: "empty is local", spec: "", isNil: true},
+		{name: "local", spec: "local", isNil: true},
+		{name: "redis", spec: "redis://localhost:6379/0?prefix=api"},
+		{name: "unknown", spec: "memcached://localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter, err := parseRateLimitCounter(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRateLimitCounter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (counter == nil) != tt.isNil {
+				t.Errorf("parseRateLimitCounter() = %v, want nil %v", counter, tt.isNil)
+			}
+		})
+	}
+}
+
+func TestRateLimiterValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		limiter RateLimiter
+		wantErr bool
+	}{
+		{name: "default mode", limiter: RateLimiter{RequestLimit: 1}},
+		{name: "token bucket", limiter: RateLimiter{Mode: RateLimitTokenBucket, RequestLimit: 10, WindowDuration: WindowDuration{Duration: time.Second}, Burst: 20}},
+		{name: "token bucket without window", limiter: RateLimiter{Mode: RateLimitTokenBucket, RequestLimit: 10}, wantErr: true},
+		{name: "concurrency", limiter: RateLimiter{Mode: RateLimitConcurrency, MaxInFlight: 5}},
+		{name: "concurrency without max in flight", limiter: RateLimiter{Mode: RateLimitConcurrency}, wantErr: true},
+		{name: "concurrency with queue", limiter: RateLimiter{Mode: RateLimitConcurrency, MaxInFlight: 5, QueueSize: 10, QueueTimeout: &WindowDuration{Duration: time.Second}}},
+		{name: "concurrency with queue without timeout", limiter: RateLimiter{Mode: RateLimitConcurrency, MaxInFlight: 5, QueueSize: 10}, wantErr: true},
+		{name: "concurrency with key", limiter: RateLimiter{Mode: RateLimitConcurrency, MaxInFlight: 5, Key: "ip"}, wantErr: true},
+		{name: "concurrency with redis counter", limiter: RateLimiter{Mode: RateLimitConcurrency, MaxInFlight: 5, Counter: "redis://localhost:6379"}, wantErr: true},
+		{name: "redis counter", limiter: RateLimiter{RequestLimit: 1, Counter: "redis://localhost:6379/0"}},
+		{name: "redis counter with invalid db", limiter: RateLimiter{RequestLimit: 1, Counter: "redis://localhost:6379/abc"}, wantErr: true},
+		{name: "unknown counter", limiter: RateLimiter{RequestLimit: 1, Counter: "memcached://localhost"}, wantErr: true},
+		{name: "unknown mode", limiter: RateLimiter{Mode: "leaky"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limiter.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
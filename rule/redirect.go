@@ -0,0 +1,249 @@
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"ella.to/baker/internal/accesslog"
+)
+
+const RedirectName = "Redirect"
+
+// Redirect sends the client to a different url. The new url is built from the
+// request by changing its scheme, host and path, if nothing changes the request
+// is passed to the service as usual.
+type Redirect struct {
+	StatusCode  int    `json:"status_code,omitempty"`
+	Scheme      string `json:"scheme,omitempty"`
+	Host        string `json:"host,omitempty"`
+	WWW         string `json:"www,omitempty"`
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	// TrustForwardedProto uses the X-Forwarded-Proto header as the scheme of the request,
+	// it must only be set when baker runs behind a proxy which sets the header
+	TrustForwardedProto bool `json:"trust_forwarded_proto,omitempty"`
+	regex               *regexp.Regexp
+}
+
+var _ Middleware = (*Redirect)(nil)
+
+func (rd *Redirect) IsCachable() bool {
+	return false
+}
+
+func (rd *Redirect) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (rd *Redirect) validate() error {
+	switch rd.StatusCode {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid redirect status code %d", rd.StatusCode)
+	}
+
+	switch rd.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("invalid redirect scheme '%s'", rd.Scheme)
+	}
+
+	switch rd.WWW {
+	case "", "add", "remove":
+	default:
+		return fmt.Errorf("invalid redirect www value '%s', expected add or remove", rd.WWW)
+	}
+
+	if rd.Pattern != "" {
+		regex, err := compileRegexp(rd.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid redirect pattern: %w", err)
+		}
+		rd.regex = regex
+	}
+
+	return nil
+}
+
+// requestScheme returns the scheme used by the client, the X-Forwarded-Proto
+// header is only used if it's trusted, any client can send it
+func (rd *Redirect) requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); rd.TrustForwardedProto && proto != "" {
+		return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+func (rd *Redirect) target(r *http.Request) string {
+	scheme := rd.requestScheme(r)
+	host := r.Host
+	path := r.URL.EscapedPath()
+	query := r.URL.RawQuery
+
+	if rd.Scheme != "" && rd.Scheme != scheme {
+		scheme = rd.Scheme
+
+		// the default port of the old scheme is meaningless for the new one
+		if h, port, err := net.SplitHostPort(host); err == nil && (port == "80" || port == "443") {
+			host = h
+		}
+	}
+
+	if rd.Host != "" {
+		host = rd.Host
+	}
+
+	switch rd.WWW {
+	case "add":
+		if !strings.HasPrefix(host, "www.") {
+			host = "www." + host
+		}
+	case "remove":
+		host = strings.TrimPrefix(host, "www.")
+	}
+
+	if rd.regex != nil && rd.regex.MatchString(path) {
+		path = rd.regex.ReplaceAllString(path, rd.Replacement)
+
+		// the replacement can have its own query string, which is
+		// merged with the query string of the request
+		if newPath, newQuery, ok := strings.Cut(path, "?"); ok {
+			path = newPath
+			if query != "" {
+				query = newQuery + "&" + query
+			} else {
+				query = newQuery
+			}
+		}
+	}
+
+	if path == "" {
+		path = "/"
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString(scheme)
+	sb.WriteString("://")
+	sb.WriteString(host)
+	sb.WriteString(path)
+	if query != "" {
+		sb.WriteString("?")
+		sb.WriteString(query)
+	}
+
+	return sb.String()
+}
+
+func (rd *Redirect) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := (&Redirect{TrustForwardedProto: rd.TrustForwardedProto}).target(r)
+		target := rd.target(r)
+
+		if target == current {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		statusCode := rd.StatusCode
+		if statusCode == 0 {
+			statusCode = http.StatusFound
+		}
+
+		accesslog.Annotate(r.Context(), RedirectName, target)
+		http.Redirect(w, r, target, statusCode)
+	})
+}
+
+type RedirectOption func(*Redirect)
+
+// WithRedirectHTTPS upgrades the requests to https
+func WithRedirectHTTPS() RedirectOption {
+	return func(rd *Redirect) {
+		rd.Scheme = "https"
+	}
+}
+
+// WithRedirectTrustForwardedProto uses the X-Forwarded-Proto header set by the proxy in front of baker
+func WithRedirectTrustForwardedProto() RedirectOption {
+	return func(rd *Redirect) {
+		rd.TrustForwardedProto = true
+	}
+}
+
+// WithRedirectHost sends the requests to a different host
+func WithRedirectHost(host string) RedirectOption {
+	return func(rd *Redirect) {
+		rd.Host = host
+	}
+}
+
+// WithRedirectWWW adds the www. prefix to the host if add is true, removes it otherwise
+func WithRedirectWWW(add bool) RedirectOption {
+	return func(rd *Redirect) {
+		if add {
+			rd.WWW = "add"
+		} else {
+			rd.WWW = "remove"
+		}
+	}
+}
+
+// WithRedirectPath rewrites the path using a regular expression, the replacement
+// can refer to the capture groups of the pattern, e.g. $1 or ${name}
+func WithRedirectPath(pattern, replacement string) RedirectOption {
+	return func(rd *Redirect) {
+		rd.Pattern = pattern
+		rd.Replacement = replacement
+	}
+}
+
+func NewRedirect(statusCode int, opts ...RedirectOption) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	redirect := Redirect{
+		StatusCode: statusCode,
+	}
+
+	for _, opt := range opts {
+		opt(&redirect)
+	}
+
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: RedirectName,
+		Args: redirect,
+	}
+}
+
+func RegisterRedirect() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[RedirectName] = func(raw json.RawMessage) (Middleware, error) {
+			redirect := &Redirect{}
+			err := json.Unmarshal(raw, redirect)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := redirect.validate(); err != nil {
+				return nil, err
+			}
+
+			return redirect, nil
+		}
+
+		return nil
+	}
+}
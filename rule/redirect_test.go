@@ -0,0 +1,139 @@
+package rule
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         string
+		url          string
+		tls          bool
+		header       http.Header
+		wantCode     int
+		wantLocation string
+	}{
+		{
+			name:         "https upgrade",
+			args:         `{"scheme":"https","status_code":301}`,
+			url:          "http://example.com/a?b=c",
+			wantCode:     301,
+			wantLocation: "https://example.com/a?b=c",
+		},
+		{
+			name:     "already https",
+			args:     `{"scheme":"https"}`,
+			url:      "https://example.com/a",
+			tls:      true,
+			wantCode: 200,
+		},
+		{
+			name:     "already https behind a proxy",
+			args:     `{"scheme":"https","trust_forwarded_proto":true}`,
+			url:      "http://example.com/a",
+			header:   http.Header{"X-Forwarded-Proto": {"https"}},
+			wantCode: 200,
+		},
+		{
+			name:         "forwarded proto is not trusted",
+			args:         `{"scheme":"https"}`,
+			url:          "http://example.com/a",
+			header:       http.Header{"X-Forwarded-Proto": {"https"}},
+			wantCode:     302,
+			wantLocation: "https://example.com/a",
+		},
+		{
+			name:         "https upgrade drops default port",
+			args:         `{"scheme":"https"}`,
+			url:          "http://example.com:80/a",
+			wantCode:     302,
+			wantLocation: "https://example.com/a",
+		},
+		{
+			name:         "add www",
+			args:         `{"www":"add","status_code":308}`,
+			url:          "http://example.com/a",
+			wantCode:     308,
+			wantLocation: "http://www.example.com/a",
+		},
+		{
+			name:         "remove www and upgrade",
+			args:         `{"www":"remove","scheme":"https"}`,
+			url:          "http://www.example.com/",
+			wantCode:     302,
+			wantLocation: "https://example.com/",
+		},
+		{
+			name:         "host",
+			args:         `{"host":"example.org"}`,
+			url:          "http://example.com/a",
+			wantCode:     302,
+			wantLocation: "http://example.org/a",
+		},
+		{
+			name:         "regex path",
+			args:         `{"pattern":"^/blog/(\\d+)/(.*)$","replacement":"/posts/$2?id=$1","status_code":301}`,
+			url:          "http://example.com/blog/12/hello?ref=x",
+			wantCode:     301,
+			wantLocation: "http://example.com/posts/hello?id=12&ref=x",
+		},
+		{
+			name:     "regex path not matching",
+			args:     `{"pattern":"^/blog/(\\d+)$","replacement":"/posts/$1"}`,
+			url:      "http://example.com/about",
+			wantCode: 200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builders := map[string]BuilderFunc{}
+			RegisterRedirect()(builders)
+
+			middleware, err := builders[RedirectName](json.RawMessage(tt.args))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := middleware.Process(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantCode)
+			}
+			if got := recorder.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestRedirectInvalidArgs(t *testing.T) {
+	builders := map[string]BuilderFunc{}
+	RegisterRedirect()(builders)
+
+	for _, args := range []string{
+		`{"status_code":200}`,
+		`{"scheme":"ftp"}`,
+		`{"www":"maybe"}`,
+		`{"pattern":"("}`,
+	} {
+		if _, err := builders[RedirectName](json.RawMessage(args)); err == nil {
+			t.Errorf("expected error for %s", args)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package rule
+
+import (
+	"regexp"
+	"sync"
+)
+
+// regexps caches the compiled regular expressions, rules are built for every
+// request, so compiling the same pattern over and over should be avoided
+var regexps sync.Map // pattern -> *regexp.Regexp
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	regexps.Store(pattern, re)
+
+	return re, nil
+}
@@ -14,23 +14,36 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
 
+	"ella.to/baker/internal/accesslog"
 	"ella.to/baker/internal/collection"
+	"ella.to/baker/internal/errorpage"
 	"ella.to/baker/internal/httpclient"
 	"ella.to/baker/internal/metrics"
+	"ella.to/baker/internal/requestid"
+	"ella.to/baker/internal/tracing"
 	"ella.to/baker/internal/trie"
 	"ella.to/baker/rule"
 )
 
 type containerInfo struct {
-	container *Container
-	domain    string
-	path      string
-	pingCount int64
+	container  *Container
+	routes     []route // a container can serve more than one endpoint
+	pingCount  int64
+	draining   bool
+	drainTimer *time.Timer
+}
+
+type route struct {
+	domain string
+	path   string
 }
 
 type Server struct {
@@ -38,10 +51,24 @@ type Server struct {
 	pingDuration       time.Duration
 	containersMap      map[string]*containerInfo       // containerID -> containerInfo
 	domainsMap         map[string]*trie.Node[*Service] // domain -> path -> containers
+	pathsCount         map[string]int                  // domain -> number of paths
 	rules              map[string]rule.BuilderFunc
 	middlewareCacheMap *collection.Map[rule.Middleware]
 	runner             *ActionRunner
+	transport          *http.Transport
+	errorPages         *errorpage.Pages
+	requestIDHeader    string
+	requestIDFormat    string
+	accessLog          *accesslog.Logger
+	tracer             *tracing.Tracer
+	maintenance        *maintenanceList
+	inflight           atomic.Int64
+	websockets         *websocketSet
+	upstreams          *upstreamConns
+	drainTimeout       time.Duration
+	draining           atomic.Bool
 	close              chan struct{}
+	closeOnce          sync.Once
 	isDebug            bool
 }
 
@@ -49,6 +76,7 @@ var _ http.Handler = (*Server)(nil)
 
 type trackResponseWriter struct {
 	statusCode int
+	bytes      int64
 	w          http.ResponseWriter
 }
 
@@ -63,6 +91,19 @@ func (t *trackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return h.Hijack()
 }
 
+var _ http.Flusher = (*trackResponseWriter)(nil)
+
+// Flush is required for streaming responses, such as server-sent events,
+// to reach the client while the upstream is still writing them
+func (t *trackResponseWriter) Flush() {
+	http.NewResponseController(t.w).Flush()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying response writer
+func (t *trackResponseWriter) Unwrap() http.ResponseWriter {
+	return t.w
+}
+
 var _ http.ResponseWriter = (*trackResponseWriter)(nil)
 
 func (t *trackResponseWriter) Header() http.Header {
@@ -70,7 +111,13 @@ func (t *trackResponseWriter) Header() http.Header {
 }
 
 func (t *trackResponseWriter) Write(p []byte) (int, error) {
-	return t.w.Write(p)
+	if t.statusCode == 0 {
+		t.statusCode = http.StatusOK
+	}
+
+	n, err := t.w.Write(p)
+	t.bytes += int64(n)
+	return n, err
 }
 
 func (t *trackResponseWriter) WriteHeader(code int) {
@@ -83,14 +130,18 @@ func isWebSocketRequest(r *http.Request) bool {
 }
 
 func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request, container *Container, endpoint *Endpoint) {
+	var upstreamStart time.Time
+
 	proxy := &httputil.ReverseProxy{
 		Rewrite: func(r *httputil.ProxyRequest) {
+			upstreamStart = time.Now()
+
 			url := &url.URL{
 				Scheme: "http",
 				Host:   container.Addr.String(),
 			}
 
-			slog.Debug("rewriting url", "from", r.In.URL.String(), "to", url.String())
+			slog.DebugContext(r.In.Context(), "rewriting url", "from", r.In.URL.String(), "to", url.String())
 
 			r.SetURL(url)     // Forward request to outboundURL.
 			r.SetXForwarded() // Set X-Forwarded-* headers.
@@ -104,19 +155,66 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request, container *C
 				r.Out.Header.Set(key, v)
 			}
 		},
+		ModifyResponse: func(resp *http.Response) error {
+			if record := accesslog.FromContext(resp.Request.Context()); record != nil {
+				record.UpstreamLatency = time.Since(upstreamStart)
+			}
+
+			// the client gets the request id set by baker, not a second one from the container
+			if s.requestIDHeader != "" {
+				resp.Header.Del(s.requestIDHeader)
+			}
+			return nil
+		},
+		Transport:    s.upstreamTransport(container),
+		ErrorHandler: s.handleProxyError,
 	}
 
 	middlewares, err := s.getMiddlewares(endpoint)
 	if err != nil {
-		slog.Error("failed to get middlewares", "error", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "failed to get middlewares", "domain", r.Host, "path", r.URL.Path, "error", err)
+		errorpage.Write(w, r, http.StatusInternalServerError)
 		return
 	}
 
-	rule.Chain(proxy, middlewares...).ServeHTTP(w, r)
+	// the ErrorPages rule of the endpoint takes over the interception of the server
+	if s.errorPages != nil && len(s.errorPages.Intercept) > 0 && !endpoint.hasRule(rule.ErrorPagesName) {
+		w = errorpage.NewInterceptWriter(w, r, s.errorPages)
+	}
+
+	rule.Chain(proxy, s.traceMiddlewares(endpoint, middlewares)...).ServeHTTP(w, r)
 }
 
-func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, container *Container) {
+// handleProxyError is called when the request can't be forwarded to the container,
+// or the container fails to send back a response
+func (s *Server) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		errorpage.Write(w, r, http.StatusRequestEntityTooLarge)
+	case rule.IsTimeout(r.Context()), errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		slog.ErrorContext(r.Context(), "container timed out", "domain", r.Host, "path", r.URL.Path, "error", err)
+		errorpage.Write(w, r, http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled):
+		// the client is gone, there is no one to send the response to
+		slog.DebugContext(r.Context(), "client canceled the request", "domain", r.Host, "path", r.URL.Path)
+		w.WriteHeader(http.StatusBadGateway)
+	default:
+		slog.ErrorContext(r.Context(), "failed to proxy request", "domain", r.Host, "path", r.URL.Path, "error", err)
+		errorpage.Write(w, r, http.StatusBadGateway)
+	}
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, container *Container, endpoint *Endpoint) {
+	// the connection would be closed right away by the shutdown
+	if s.isDraining() {
+		w.Header().Set("Retry-After", "1")
+		errorpage.Write(w, r, http.StatusServiceUnavailable)
+		return
+	}
+
 	targetURL := &url.URL{
 		Scheme: "ws",
 		Host:   container.Addr.String(),
@@ -133,51 +231,72 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, contain
 		}
 	}
 
+	header := r.Header
+	if s.tracer != nil {
+		header = r.Header.Clone()
+		tracing.Inject(r.Context(), header)
+	}
+
+	metrics.UpstreamRequestStart(container.Id)
+
 	clientConn, _, err := websocket.Dial(r.Context(), targetURL.String(), &websocket.DialOptions{
-		HTTPHeader: r.Header,
+		HTTPHeader: header,
 		Host:       host,
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error connecting to backend server: %s", err), http.StatusInternalServerError)
+		if isDialError(err) {
+			metrics.UpstreamDialError(container.Id)
+		}
+		metrics.UpstreamRequestEnd(container.Id, 0)
+		slog.ErrorContext(r.Context(), "failed to connect to container websocket", "domain", r.Host, "path", r.URL.Path, "error", err)
+		errorpage.Write(w, r, http.StatusBadGateway)
 		return
 	}
+	defer metrics.UpstreamRequestEnd(container.Id, http.StatusSwitchingProtocols)
 	defer clientConn.Close(websocket.StatusNormalClosure, "")
 
 	serverConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		InsecureSkipVerify: true,
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error connecting to backend server: %s", err), http.StatusInternalServerError)
+		// Accept already sent the error response to the client
+		slog.ErrorContext(r.Context(), "failed to accept websocket", "domain", r.Host, "path", r.URL.Path, "error", err)
 		return
 	}
 	defer serverConn.Close(websocket.StatusNormalClosure, "")
 
+	s.websockets.add(serverConn)
+	defer s.websockets.remove(serverConn)
+	defer s.upstreams.addWebsocket(container.Id, serverConn)()
+
+	start := time.Now()
+	defer func() {
+		metrics.WebsocketConnectionDuration(endpoint.Domain, endpoint.Path, time.Since(start).Seconds())
+	}()
+
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	// Proxy data between client and server
+	inbound := metrics.WebsocketMessageCounter(endpoint.Domain, endpoint.Path, "inbound")
+	outbound := metrics.WebsocketMessageCounter(endpoint.Domain, endpoint.Path, "outbound")
+
+	// Proxy data between client and server, the connection is over
+	// as soon as one of the sides stops sending messages
 	go func() {
 		defer cancel()
 
-		for {
-			err = copyWebsocketStream(ctx, clientConn, serverConn)
-			if err != nil {
-				slog.Error("failed to copy data between server and client", "error", err)
-				return
-			}
+		if err := copyWebsocketStream(ctx, clientConn, serverConn, inbound); err != nil {
+			slog.ErrorContext(ctx, "failed to copy data between server and client", "error", err)
 		}
 	}()
 
-	for {
-		err = copyWebsocketStream(ctx, serverConn, clientConn)
-		if err != nil {
-			slog.Error("failed to copy data between client and server", "error", err)
-			return
-		}
+	if err := copyWebsocketStream(ctx, serverConn, clientConn, outbound); err != nil {
+		slog.ErrorContext(ctx, "failed to copy data between client and server", "error", err)
 	}
 }
 
-func copyWebsocketStream(ctx context.Context, dst, src *websocket.Conn) error {
+// copyWebsocketStream copies the messages from src to dst until one of them is closed
+func copyWebsocketStream(ctx context.Context, dst, src *websocket.Conn, onMessage func()) error {
 	var msgType websocket.MessageType
 	var r io.Reader
 	var w io.WriteCloser
@@ -198,6 +317,13 @@ func copyWebsocketStream(ctx context.Context, dst, src *websocket.Conn) error {
 		if err != nil {
 			break
 		}
+
+		err = w.Close()
+		if err != nil {
+			break
+		}
+
+		onMessage()
 	}
 
 	if errors.Is(err, context.Canceled) {
@@ -206,48 +332,189 @@ func copyWebsocketStream(ctx context.Context, dst, src *websocket.Conn) error {
 		return nil
 	}
 
+	switch websocket.CloseStatus(err) {
+	case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+		return nil
+	}
+
 	return err
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	domain := r.Host
-	path := r.URL.Path
-	method := r.Method
+	defer metrics.RequestStart()()
+
+	s.inflight.Add(1)
+	defer s.inflight.Add(-1)
 
 	tw := &trackResponseWriter{w: w}
 
+	if s.requestIDHeader != "" {
+		r = s.setRequestID(tw, r)
+	}
+
+	if s.tracer != nil {
+		var span *tracing.Span
+		r, span = s.startServerSpan(r)
+		defer endServerSpan(span, tw)
+	}
+
+	var body *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+
+	if s.accessLog != nil {
+		record := s.newAccessRecord(r)
+		r = r.WithContext(accesslog.WithRecord(r.Context(), record))
+
+		defer s.logAccess(record, tw, body)
+	}
+
+	if s.errorPages != nil {
+		r = r.WithContext(errorpage.WithPages(r.Context(), s.errorPages))
+	}
+
+	if m := s.maintenance.get(r.Host, r.URL.Path); m != nil {
+		m.middleware.Process(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serve(tw, r, body)
+		})).ServeHTTP(tw, r)
+		return
+	}
+
+	s.serve(tw, r, body)
+}
+
+func (s *Server) newAccessRecord(r *http.Request) *accesslog.Record {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	return &accesslog.Record{
+		Time:      time.Now(),
+		RequestID: requestid.FromContext(r.Context()),
+		ClientIP:  clientIP,
+		Host:      r.Host,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Query:     r.URL.RawQuery,
+		Proto:     r.Proto,
+		UserAgent: r.UserAgent(),
+		Referer:   r.Referer(),
+	}
+}
+
+func (s *Server) logAccess(record *accesslog.Record, tw *trackResponseWriter, body *countingReader) {
+	record.BytesIn = body.Count()
+	record.Status = tw.statusCode
+	record.BytesOut = tw.bytes
+	record.Latency = time.Since(record.Time)
+
+	s.accessLog.Log(record)
+}
+
+// countingReader counts the bytes of the request body read by the proxy,
+// the body can be read by the transport after the handler returns
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+// Count returns the number of bytes read so far, a nil reader has read nothing
+func (c *countingReader) Count() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.n.Load()
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// setRequestID keeps the request id sent by the client if it is valid, otherwise
+// a new one is generated. It is sent to the container and back to the client.
+func (s *Server) setRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(s.requestIDHeader)
+	if !requestid.IsValid(id) {
+		id = requestid.New(s.requestIDFormat)
+		r.Header.Set(s.requestIDHeader, id)
+	}
+
+	w.Header().Set(s.requestIDHeader, id)
+
+	return r.WithContext(requestid.WithID(r.Context(), id))
+}
+
+func (s *Server) serve(tw *trackResponseWriter, r *http.Request, body *countingReader) {
+	method := r.Method
+
 	start := time.Now()
 
 	var container *Container
 	endpoint := &Endpoint{
-		Domain: domain,
-		Path:   path,
+		Domain: r.Host,
+		Path:   r.URL.Path,
 	}
 
+	_, routeSpan := s.tracer.Start(r.Context(), "route", tracing.KindInternal)
 	container, endpoint = s.runner.Get(r.Context(), endpoint)
+	routeSpan.End()
+
 	if container == nil {
-		tw.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(tw, "not found, domain: %s, path: %s", domain, path)
+		// requests to unknown domains and paths share the same labels,
+		// otherwise every url tried by a scanner would create new series
+		defer s.recordMetrics(metrics.UnmatchedLabel, metrics.UnmatchedLabel, method, start, tw, body)
+		errorpage.Write(tw, r, http.StatusNotFound)
 		return
 	}
 
+	// the metrics use the pattern of the endpoint, e.g. /api/*, not the path of the request
+	domain := endpoint.Domain
+	path := endpoint.Path
+
+	if span := tracing.SpanFromContext(r.Context()); span != nil {
+		span.SetName(method + " " + endpoint.Path)
+		span.SetAttributes(
+			tracing.String("http.route", endpoint.Path),
+			tracing.String("baker.container_id", container.Id),
+		)
+	}
+
+	if record := accesslog.FromContext(r.Context()); record != nil {
+		record.Endpoint = endpoint.Domain + endpoint.Path
+		record.ContainerID = container.Id
+	}
+
+	defer s.upstreams.acquire(container.Id)()
+
 	if isWebSocketRequest(r) {
 		defer func() {
 			metrics.WebsocketRequest(domain, path, method, tw.statusCode)
 		}()
-		s.handleWebSocket(tw, r, container)
+		s.handleWebSocket(tw, r, container, endpoint)
 	} else {
-		defer func() {
-			metrics.HttpRequestCount(domain, path, method, tw.statusCode)
-			metrics.HttpRequestDuration(domain, path, method, tw.statusCode, float64(time.Since(start)))
-		}()
+		defer s.recordMetrics(domain, path, method, start, tw, body)
 		s.handleHTTP(tw, r, container, endpoint)
 	}
 }
 
+func (s *Server) recordMetrics(domain, path, method string, start time.Time, tw *trackResponseWriter, body *countingReader) {
+	metrics.HttpRequestCount(domain, path, method, tw.statusCode)
+	metrics.HttpRequestDuration(domain, path, method, tw.statusCode, time.Since(start).Seconds())
+	metrics.HttpRequestSize(domain, path, method, body.Count())
+	metrics.HttpResponseSize(domain, path, method, tw.statusCode, tw.bytes)
+}
+
 func (s *Server) Close() {
-	s.runner.Close()
-	close(s.close)
+	s.closeOnce.Do(func() {
+		s.runner.Close()
+		s.transport.CloseIdleConnections()
+		close(s.close)
+	})
 }
 
 func (s *Server) RegisterDriver(fn func(Driver)) {
@@ -261,7 +528,7 @@ func (s *Server) getMiddlewares(endpoint *Endpoint) ([]rule.Middleware, error) {
 
 	middlewares := make([]rule.Middleware, 0)
 
-	for _, r := range endpoint.Rules {
+	for i, r := range endpoint.Rules {
 		builder, ok := s.rules[r.Type]
 		if !ok {
 			return nil, fmt.Errorf("failed to find rule builder for %s", r.Type)
@@ -272,14 +539,24 @@ func (s *Server) getMiddlewares(endpoint *Endpoint) ([]rule.Middleware, error) {
 			return nil, fmt.Errorf("failed to parse args for rule %s: %w", r.Type, err)
 		}
 
+		if scoped, ok := middleware.(rule.Scoped); ok {
+			scoped.SetScope(endpoint.getMiddlewareKey(i, r.Type))
+		}
+
 		if middleware.IsCachable() {
-			middleware = s.middlewareCacheMap.GetAndUpdate(endpoint.getHashKey(), func(old rule.Middleware, found bool) rule.Middleware {
+			var added bool
+			middleware = s.middlewareCacheMap.GetAndUpdate(endpoint.getMiddlewareKey(i, r.Type), func(old rule.Middleware, found bool) rule.Middleware {
 				if found {
 					return old.UpdateMiddelware(middleware)
 				}
 
+				added = true
 				return middleware.UpdateMiddelware(nil)
 			})
+
+			if added {
+				metrics.MiddlewareCacheSize(s.middlewareCacheMap.Len())
+			}
 		}
 
 		middlewares = append(middlewares, middleware)
@@ -292,14 +569,20 @@ func (s *Server) pingContainers() {
 	// make a copy of the containers map
 	containers := make([]*containerInfo, 0, len(s.containersMap))
 	for _, cInfo := range s.containersMap {
+		if cInfo.draining {
+			continue
+		}
+
 		// if container has a static domain configuration, we dont need to ping it
 		if cInfo.container.Meta.Static.Domain == "" {
 			containers = append(containers, cInfo)
 		} else {
-			s.runner.Update(cInfo.container, &Endpoint{
+			metrics.UpstreamHealth(cInfo.container.Id, true)
+			// the pinger runs on the runner, the container is updated right away
+			s.updateContainer(cInfo.container, &Endpoint{
 				Domain: cInfo.container.Meta.Static.Domain,
 				Path:   cInfo.container.Meta.Static.Path,
-				Rules:  []Rule{},
+				Rules:  cInfo.container.Meta.Static.Rules,
 			})
 		}
 	}
@@ -328,11 +611,20 @@ func (s *Server) pingContainers() {
 				return
 			}
 
+			failed := func(reason string) {
+				s.upstreams.record(c.Id, func() {
+					metrics.UpstreamPingFailure(c.Id, reason)
+					metrics.UpstreamHealth(c.Id, false)
+				})
+			}
+
 			ctx := context.Background()
+			start := time.Now()
 
 			rc, statusCode, err := getter.Get(ctx, url)
 			if err != nil {
 				slog.Error("failed to call container config endpoint", "container_id", c.Id, "url", url, "error", err)
+				failed("request")
 				return
 			}
 			defer rc.Close()
@@ -340,14 +632,25 @@ func (s *Server) pingContainers() {
 			config, err := s.parseConfig(rc)
 			if err != nil {
 				slog.Error("failed to read container config", "container_id", c.Id, "url", url, "error", err)
+				failed("decode")
 				return
 			}
 
+			duration := time.Since(start).Seconds()
+			s.upstreams.record(c.Id, func() {
+				metrics.UpstreamPingDuration(c.Id, duration)
+			})
+
 			if statusCode >= 400 {
 				slog.Error("container config endpoint returned an error", "container_id", c.Id, "url", url, "status_code", statusCode)
+				failed("status")
 				return
 			}
 
+			s.upstreams.record(c.Id, func() {
+				metrics.UpstreamHealth(c.Id, true)
+			})
+
 			for _, endpoint := range config.Endpoints {
 				s.runner.Update(c, &endpoint)
 			}
@@ -389,14 +692,21 @@ func (s *Server) addContainer(container *Container) {
 
 	s.containersMap[container.Id] = &containerInfo{
 		container: container,
-		domain:    "",
-		path:      "",
 	}
+	s.upstreams.added(container.Id)
+
+	s.recordRoutingTable()
 }
 
 func (s *Server) updateContainer(container *Container, endpoint *Endpoint) {
 	cInfo, ok := s.containersMap[container.Id]
-	if ok && cInfo.domain == endpoint.Domain && cInfo.path == endpoint.Path {
+	if !ok || cInfo.draining {
+		// the container was removed or drained while its config was being fetched
+		return
+	}
+
+	rt := route{domain: endpoint.Domain, path: endpoint.Path}
+	if slices.Contains(cInfo.routes, rt) {
 		// if the container is already in the correct domain and path, we don't need to do anything
 		// we can just return to avoid unnecessary work
 		return
@@ -410,6 +720,7 @@ func (s *Server) updateContainer(container *Container, endpoint *Endpoint) {
 
 	service := paths.Get([]rune(endpoint.Path))
 	if service == nil {
+		s.pathsCount[endpoint.Domain]++
 		service = &Service{
 			Containers: []*Container{container},
 			Endpoint:   endpoint,
@@ -421,16 +732,11 @@ func (s *Server) updateContainer(container *Container, endpoint *Endpoint) {
 	}
 	paths.Put([]rune(endpoint.Path), service)
 
-	// One thing to note that cInfo is not nil here
-	// because we have intitalized it during the addContainer call
-	// if it was nil, it should be a panic situation
-
-	cInfo.domain = endpoint.Domain
-	cInfo.path = endpoint.Path
+	cInfo.routes = append(cInfo.routes, rt)
 
 	slog.Debug("container updated", "container_id", container.Id, "domain", endpoint.Domain, "path", endpoint.Path)
 
-	s.containersMap[container.Id] = cInfo
+	s.recordRoutingTable()
 }
 
 func (s *Server) removeContainer(container *Container) {
@@ -440,15 +746,34 @@ func (s *Server) removeContainer(container *Container) {
 	}
 
 	delete(s.containersMap, container.Id)
+	defer s.recordRoutingTable()
+
+	if containerInfo.drainTimer != nil {
+		containerInfo.drainTimer.Stop()
+	}
+
+	// the in-flight requests record their metrics once they are done,
+	// the metrics are deleted after them so they are not created again
+	s.upstreams.removed(container.Id, func() {
+		metrics.RemoveUpstream(container.Id)
+	})
 
 	slog.Debug("container removed", "container_id", container.Id)
 
-	paths, ok := s.domainsMap[containerInfo.domain]
+	for _, rt := range containerInfo.routes {
+		s.removeRoute(container, rt)
+	}
+}
+
+// removeRoute removes the container from the service of the route,
+// and the service itself once it has no containers left
+func (s *Server) removeRoute(container *Container, rt route) {
+	paths, ok := s.domainsMap[rt.domain]
 	if !ok {
 		return
 	}
 
-	service := paths.Get([]rune(containerInfo.path))
+	service := paths.Get([]rune(rt.path))
 	if service == nil {
 		return
 	}
@@ -460,15 +785,34 @@ func (s *Server) removeContainer(container *Container) {
 
 		service.Containers = append(service.Containers[:i], service.Containers[i+1:]...)
 		if len(service.Containers) == 0 {
-			paths.Del([]rune(containerInfo.path))
-			s.middlewareCacheMap.Delete(service.Endpoint.getHashKey())
+			paths.Del([]rune(rt.path))
+			metrics.RemovePath(rt.domain, rt.path)
+			for i, r := range service.Endpoint.Rules {
+				s.middlewareCacheMap.Delete(service.Endpoint.getMiddlewareKey(i, r.Type))
+			}
+			metrics.MiddlewareCacheSize(s.middlewareCacheMap.Len())
+
+			s.pathsCount[rt.domain]--
+			if s.pathsCount[rt.domain] <= 0 {
+				delete(s.pathsCount, rt.domain)
+				delete(s.domainsMap, rt.domain)
+			}
 		} else {
-			paths.Put([]rune(containerInfo.path), service)
+			paths.Put([]rune(rt.path), service)
 		}
 		break
 	}
 }
 
+func (s *Server) recordRoutingTable() {
+	paths := 0
+	for _, count := range s.pathsCount {
+		paths += count
+	}
+
+	metrics.RoutingTableSize(len(s.domainsMap), paths, len(s.containersMap))
+}
+
 func (s *Server) getContainer(domain, path string) (container *Container, endpoint *Endpoint) {
 	defer func() {
 		if container != nil {
@@ -495,6 +839,21 @@ func (s *Server) getContainer(domain, path string) (container *Container, endpoi
 	return service.Containers[pos], service.Endpoint
 }
 
+// newTransport returns the transport used to reach the containers, it is based on
+// http.DefaultTransport but it doesn't use the proxy settings of the environment
+func newTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          1000,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
 type serverOpt interface {
 	configureServer(*Server) error
 }
@@ -519,6 +878,81 @@ func WithPingDuration(d time.Duration) serverOptFunc {
 	}
 }
 
+// WithUpstreamTimeouts sets how long baker waits to connect to a container,
+// and then to receive the response headers. Zero means no timeout. The Limits
+// rule can set a different response header timeout per endpoint.
+func WithUpstreamTimeouts(dial time.Duration, responseHeader time.Duration) serverOptFunc {
+	return func(s *Server) error {
+		s.transport.DialContext = (&net.Dialer{
+			Timeout:   dial,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		s.transport.ResponseHeaderTimeout = responseHeader
+		return nil
+	}
+}
+
+// WithContainerDrainTimeout sets how long a draining container keeps serving
+// its in-flight requests and websocket connections before it is removed
+func WithContainerDrainTimeout(d time.Duration) serverOptFunc {
+	return func(s *Server) error {
+		s.drainTimeout = d
+		return nil
+	}
+}
+
+// WithErrorPages sets how the errors generated by baker are sent to the clients,
+// format is one of text, html or json. Templates are html templates keyed by status
+// code or "default", and the responses of the containers with one of the intercept
+// status codes are replaced by the error page. The ErrorPages rule overrides them per endpoint.
+func WithErrorPages(format string, templates map[string]string, intercept ...int) serverOptFunc {
+	return func(s *Server) error {
+		pages := &errorpage.Pages{
+			Format:    format,
+			Templates: templates,
+			Intercept: intercept,
+		}
+
+		if err := pages.Compile(); err != nil {
+			return err
+		}
+
+		s.errorPages = pages
+		return nil
+	}
+}
+
+// WithRequestID sets the header which holds the id of each request, X-Request-Id by default,
+// and the format of the generated ids, uuidv7 or ulid. An empty header disables request ids.
+func WithRequestID(header string, format string) serverOptFunc {
+	return func(s *Server) error {
+		if err := requestid.ValidateFormat(format); err != nil {
+			return err
+		}
+
+		s.requestIDHeader = header
+		s.requestIDFormat = format
+		return nil
+	}
+}
+
+// WithAccessLog writes a record of every request to the logger
+func WithAccessLog(logger *accesslog.Logger) serverOptFunc {
+	return func(s *Server) error {
+		s.accessLog = logger
+		return nil
+	}
+}
+
+// WithTracer creates spans for every request and passes the
+// trace to the containers with the traceparent header
+func WithTracer(tracer *tracing.Tracer) serverOptFunc {
+	return func(s *Server) error {
+		s.tracer = tracer
+		return nil
+	}
+}
+
 func WithRules(rules ...rule.RegisterFunc) serverOptFunc {
 	return func(s *Server) error {
 		s.rules = make(map[string]rule.BuilderFunc)
@@ -541,7 +975,15 @@ func NewServer(opts ...serverOpt) *Server {
 		pingDuration:       10 * time.Second,
 		containersMap:      make(map[string]*containerInfo),
 		domainsMap:         make(map[string]*trie.Node[*Service]),
+		pathsCount:         make(map[string]int),
 		middlewareCacheMap: collection.NewMap[rule.Middleware](),
+		transport:          newTransport(),
+		maintenance:        newMaintenanceList(),
+		websockets:         &websocketSet{conns: make(map[*websocket.Conn]struct{})},
+		upstreams:          newUpstreamConns(),
+		drainTimeout:       30 * time.Second,
+		requestIDHeader:    "X-Request-Id",
+		requestIDFormat:    requestid.FormatUUIDv7,
 		close:              make(chan struct{}),
 		isDebug:            logLevel == "debug",
 	}
@@ -560,6 +1002,8 @@ func NewServer(opts ...serverOpt) *Server {
 		WithUpdateCallback(s.updateContainer),
 		WithRemoveCallback(s.removeContainer),
 		WithGetCallback(s.getContainer),
+		WithDrainCallback(s.drainContainer),
+		WithRemoveDrainedCallback(s.removeDrainedContainer),
 	)
 
 	go func() {
@@ -1,25 +1,41 @@
 package baker_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/coder/websocket"
+
 	"ella.to/baker"
+	"ella.to/baker/internal/accesslog"
+	"ella.to/baker/internal/metrics"
+	"ella.to/baker/internal/tracing"
 	"ella.to/baker/rule"
 )
 
 var count int
 
 func createDummyContainerRaw(t *testing.T, config string) *baker.Container {
+	return createDummyContainerWithHandler(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello world"))
+	}))
+}
+
+func createDummyContainerWithHandler(t *testing.T, config string, handler http.Handler) *baker.Container {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		slog.Debug("request", "host", r.Host, "path", r.URL.Path)
 
@@ -29,8 +45,7 @@ func createDummyContainerRaw(t *testing.T, config string) *baker.Container {
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("hello world"))
+		handler.ServeHTTP(w, r)
 	}))
 
 	t.Cleanup(server.Close)
@@ -64,7 +79,14 @@ func createBakerServer(t *testing.T) (*baker.Server, string) {
 		baker.WithRules(
 			rule.RegisterAppendPath(),
 			rule.RegisterReplacePath(),
+			rule.RegisterRewritePath(),
 			rule.RegisterRateLimiter(),
+			rule.RegisterHTTPCache(),
+			rule.RegisterCompress(),
+			rule.RegisterRedirect(),
+			rule.RegisterLimits(),
+			rule.RegisterErrorPages(),
+			rule.RegisterMaintenance(),
 		),
 	)
 	server := httptest.NewServer(handler)
@@ -229,6 +251,1316 @@ func TestMultiCalls(t *testing.T) {
 	wg.Wait()
 }
 
+func TestLimits(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	container1 := createDummyContainerWithHandler(t, `
+	{
+		"endpoints": [
+		  {
+			"domain": "example.com",
+			"path": "/*",
+			"rules": [
+			  {
+				"type": "Limits",
+				"args": { "max_body_size": "1KB", "response_header_timeout": "100ms" }
+			  }
+			]
+		  }
+		]
+	}
+	`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	server, url := createBakerServer(t)
+
+	var driver baker.Driver
+
+	server.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	tests := []struct {
+		name     string
+		path     string
+		body     io.Reader
+		wantCode int
+	}{
+		{name: "ok", path: "/fast", body: strings.NewReader("hello"), wantCode: http.StatusOK},
+		{name: "slow", path: "/slow", wantCode: http.StatusGatewayTimeout},
+		{name: "large body", path: "/fast", body: io.MultiReader(strings.NewReader(strings.Repeat("a", 4096))), wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, url+tt.path, tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "example.com"
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("expected status code %d, got %d", tt.wantCode, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	container1 := createDummyContainerWithHandler(t, `
+	{
+		"endpoints": [
+		  {
+			"domain": "example.com",
+			"path": "/*",
+			"rules": [
+			  {
+				"type": "ErrorPages",
+				"args": { "format": "json", "intercept": [503] }
+			  }
+			]
+		  }
+		]
+	}
+	`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database is down", http.StatusServiceUnavailable)
+	}))
+
+	server, url := createBakerServer(t)
+
+	var driver baker.Driver
+
+	server.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	tests := []struct {
+		name     string
+		host     string
+		wantCode int
+		wantBody string
+	}{
+		{name: "unknown domain", host: "unknown.com", wantCode: http.StatusNotFound, wantBody: "Not Found\n"},
+		{name: "intercepted", host: "example.com", wantCode: http.StatusServiceUnavailable, wantBody: `{"type":"about:blank","title":"Service Unavailable","status":503,"instance":"/api"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, url+"/api", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = tt.host
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("expected status code %d, got %d", tt.wantCode, resp.StatusCode)
+			}
+
+			if string(body) != tt.wantBody {
+				t.Fatalf("expected body %q, got %q", tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	container1 := createDummyContainer(t, &baker.Config{
+		Endpoints: []baker.Endpoint{
+			{Domain: "example.com", Path: "/*"},
+		},
+	})
+
+	server, url := createBakerServer(t)
+
+	var driver baker.Driver
+
+	server.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	admin := httptest.NewServer(server.AdminHandler("token"))
+	t.Cleanup(admin.Close)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	callAdmin := func(method, path, body string) int {
+		req, err := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer token")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	call := func(host, path, secret string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, url+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		if secret != "" {
+			req.Header.Set("X-Bypass", secret)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+
+	resp, err := http.Get(admin.URL + "/maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status code %d without token, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// the admin api is never served without a token
+	recorder := httptest.NewRecorder()
+	server.AdminHandler("").ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/maintenance", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status code %d with an empty token, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+
+	statusCode := callAdmin(http.MethodPut, "/maintenance", `{"domain":"example.com","path":"/api/*","args":{"retry_after":"5m","bypass_header":"X-Bypass","bypass_secret":"s3cret"}}`)
+	if statusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d, got %d", http.StatusNoContent, statusCode)
+	}
+
+	// domains without any container can be put into maintenance as well
+	statusCode = callAdmin(http.MethodPut, "/maintenance", `{"domain":"stopped.com"}`)
+	if statusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d, got %d", http.StatusNoContent, statusCode)
+	}
+
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		secret   string
+		wantCode int
+	}{
+		{name: "in maintenance", host: "example.com", path: "/api/users", wantCode: http.StatusServiceUnavailable},
+		{name: "bypass", host: "example.com", path: "/api/users", secret: "s3cret", wantCode: http.StatusOK},
+		{name: "other path", host: "example.com", path: "/home", wantCode: http.StatusOK},
+		{name: "without container", host: "stopped.com", path: "/", wantCode: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := call(tt.host, tt.path, tt.secret)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("expected status code %d, got %d", tt.wantCode, resp.StatusCode)
+			}
+		})
+	}
+
+	if got := call("example.com", "/api/users", "").Header.Get("Retry-After"); got != "300" {
+		t.Fatalf("expected Retry-After 300, got %q", got)
+	}
+
+	statusCode = callAdmin(http.MethodDelete, "/maintenance?domain=example.com&path=/api/*", "")
+	if statusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d, got %d", http.StatusNoContent, statusCode)
+	}
+
+	if resp := call("example.com", "/api/users", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d after maintenance, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	statusCode = callAdmin(http.MethodDelete, "/maintenance?domain=example.com&path=/api/*", "")
+	if statusCode != http.StatusNotFound {
+		t.Fatalf("expected status code %d, got %d", http.StatusNotFound, statusCode)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	received := make(chan string, 1)
+
+	container1 := createDummyContainerWithHandler(t, `{"endpoints": [{"domain": "example.com", "path": "/*"}]}`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Request-Id")
+		w.Header().Set("X-Request-Id", "from-container")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	server, url := createBakerServer(t)
+
+	var driver baker.Driver
+
+	server.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	tests := []struct {
+		name   string
+		sent   string
+		wantID func(id string) bool
+	}{
+		{name: "generated", wantID: func(id string) bool { return len(id) == 36 }},
+		{name: "propagated", sent: "client-id-1", wantID: func(id string) bool { return id == "client-id-1" }},
+		{name: "invalid", sent: "bad id", wantID: func(id string) bool { return len(id) == 36 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, url+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "example.com"
+			if tt.sent != "" {
+				req.Header.Set("X-Request-Id", tt.sent)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			ids := resp.Header.Values("X-Request-Id")
+			if len(ids) != 1 || !tt.wantID(ids[0]) {
+				t.Fatalf("unexpected request id %q", ids)
+			}
+
+			if upstream := <-received; upstream != ids[0] {
+				t.Fatalf("container got request id %q, client got %q", upstream, ids[0])
+			}
+		})
+	}
+}
+
+// syncBuffer is written by the access log while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	output := &syncBuffer{}
+
+	logger, err := accesslog.New(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container1 := createDummyContainerRaw(t, `
+	{
+		"endpoints": [
+		  {
+			"domain": "example.com",
+			"path": "/api/*",
+			"rules": [
+			  {
+				"type": "HTTPCache",
+				"args": {}
+			  }
+			]
+		  }
+		]
+	}
+	`)
+
+	handler := baker.NewServer(
+		baker.WithPingDuration(2*time.Second),
+		baker.WithAccessLog(logger),
+		baker.WithRules(
+			rule.RegisterHTTPCache(),
+		),
+	)
+	server := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		handler.Close()
+		server.Close()
+	})
+
+	var driver baker.Driver
+
+	handler.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/users?page=2", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "example.com"
+	req.Header.Set("X-Request-Id", "access-log-test")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the record is written once the handler returns
+	var line string
+	for range 50 {
+		if line = output.String(); line != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	record := map[string]any{}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatalf("invalid record %q: %s", line, err)
+	}
+
+	want := map[string]any{
+		"request_id":   "access-log-test",
+		"host":         "example.com",
+		"method":       "GET",
+		"path":         "/api/users",
+		"query":        "page=2",
+		"endpoint":     "example.com/api/*",
+		"container_id": container1.Id,
+		"status":       float64(200),
+		"bytes_in":     float64(5),
+		"bytes_out":    float64(11),
+	}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s = %v, want %v", key, record[key], value)
+		}
+	}
+
+	rules, _ := record["rules"].(map[string]any)
+	if rules["HTTPCache"] != "MISS" {
+		t.Errorf("rules = %v, want the HTTPCache outcome", record["rules"])
+	}
+}
+
+func TestTracing(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	var mu sync.Mutex
+	var spans []map[string]any
+
+	// stand-in for an OpenTelemetry collector
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]any `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, rs := range payload.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+
+	tracer := tracing.New(tracing.NewOTLPExporter(collector.URL, "baker", nil), tracing.WithBatch(100, time.Hour))
+
+	received := make(chan string, 1)
+
+	container1 := createDummyContainerWithHandler(t, `
+	{
+		"endpoints": [
+		  {
+			"domain": "example.com",
+			"path": "/api/*",
+			"rules": [
+			  {
+				"type": "Limits",
+				"args": { "max_body_size": "1KB" }
+			  }
+			]
+		  }
+		]
+	}
+	`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	handler := baker.NewServer(
+		baker.WithPingDuration(2*time.Second),
+		baker.WithTracer(tracer),
+		baker.WithRules(
+			rule.RegisterLimits(),
+		),
+	)
+	server := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		handler.Close()
+		server.Close()
+	})
+
+	var driver baker.Driver
+
+	handler.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "example.com"
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	traceparent := <-received
+
+	// the spans are exported once the server span ends, which happens after the response is sent
+	time.Sleep(100 * time.Millisecond)
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	byName := map[string]map[string]any{}
+	for _, span := range spans {
+		if span["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("span %v is not part of the trace of the client", span["name"])
+		}
+		byName[span["name"].(string)] = span
+	}
+
+	root, route, limits, upstream := byName["GET /api/*"], byName["route"], byName["rule Limits"], byName["GET"]
+	if root == nil || route == nil || limits == nil || upstream == nil {
+		t.Fatalf("missing spans, got %v", byName)
+	}
+
+	if root["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Errorf("server span should be the child of the client span, got parent %v", root["parentSpanId"])
+	}
+
+	if route["parentSpanId"] != root["spanId"] || limits["parentSpanId"] != root["spanId"] || upstream["parentSpanId"] != limits["spanId"] {
+		t.Errorf("unexpected span hierarchy %v", byName)
+	}
+
+	if want := fmt.Sprintf("00-4bf92f3577b34da6a3ce929d0e0e4736-%s-01", upstream["spanId"]); traceparent != want {
+		t.Errorf("container got traceparent %q, want %q", traceparent, want)
+	}
+}
+
+func TestUpstreamMetrics(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	container1 := createDummyContainerWithHandler(t, `
+	{
+		"endpoints": [
+		  {
+			"domain": "example.com",
+			"path": "/api/*",
+			"rules": []
+		  }
+		]
+	}
+	`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("hello world"))
+	}))
+
+	// a container which doesn't answer the config pings
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	container2 := &baker.Container{
+		Id:         "container-unreachable",
+		ConfigPath: "/config",
+		Addr:       netip.MustParseAddrPort(listener.Addr().String()),
+	}
+
+	handler, url := createBakerServer(t)
+
+	var driver baker.Driver
+
+	handler.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+	driver.Add(container2)
+
+	// Wait for the server to process the containers
+	time.Sleep(4 * time.Second)
+
+	for range 2 {
+		if err := makeCall(url, "/api/users", "example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.SetupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		fmt.Sprintf(`baker_upstream_request_count{code="200",container_id="%s"} 2`, container1.Id),
+		fmt.Sprintf(`baker_upstream_ttfb_seconds_count{container_id="%s"} 2`, container1.Id),
+		fmt.Sprintf(`baker_upstream_duration_seconds_count{container_id="%s"} 2`, container1.Id),
+		fmt.Sprintf(`baker_upstream_active_connections{container_id="%s"} 0`, container1.Id),
+		fmt.Sprintf(`baker_upstream_health{container_id="%s"} 1`, container1.Id),
+		fmt.Sprintf(`baker_upstream_ping_duration_seconds_count{container_id="%s"}`, container1.Id),
+		fmt.Sprintf(`baker_upstream_health{container_id="%s"} 0`, container2.Id),
+		fmt.Sprintf(`baker_upstream_ping_failure_count{container_id="%s",reason="request"}`, container2.Id),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %s", want)
+		}
+	}
+
+	// the metrics of a removed container are deleted
+	driver.Remove(container2)
+	time.Sleep(100 * time.Millisecond)
+
+	rec = httptest.NewRecorder()
+	metrics.SetupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if strings.Contains(rec.Body.String(), container2.Id) {
+		t.Errorf("expected the metrics of %s to be removed", container2.Id)
+	}
+
+	// the metrics of a container removed with a request in flight are deleted once it's done
+	done := make(chan error, 1)
+	go func() {
+		done <- makeCall(url, "/api/slow", "example.com")
+	}()
+
+	<-started
+	driver.Remove(container1)
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	metrics.SetupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if strings.Contains(rec.Body.String(), container1.Id) {
+		t.Errorf("expected the metrics of %s to be removed after the in-flight request", container1.Id)
+	}
+}
+
+func TestUpstreamMetricsRemovedWhilePinged(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var pings atomic.Int32
+	var once sync.Once
+
+	// the first ping adds the container, the next one is still in flight when the container is removed
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pings.Add(1) > 1 {
+			once.Do(func() { close(started) })
+			<-release
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte(`{"endpoints": [{"domain": "example.com", "path": "/pinged", "rules": []}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	container1 := &baker.Container{
+		Id:         "container-pinged",
+		ConfigPath: "/config",
+		Addr:       netip.MustParseAddrPort(strings.TrimPrefix(server.URL, "http://")),
+	}
+
+	handler, _ := createBakerServer(t)
+
+	var driver baker.Driver
+
+	handler.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the container to be pinged twice")
+	}
+
+	driver.Remove(container1)
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	// Wait for the ping to be done
+	time.Sleep(200 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	metrics.SetupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if strings.Contains(rec.Body.String(), container1.Id) {
+		t.Errorf("expected the metrics of %s not to be recorded after it was removed", container1.Id)
+	}
+}
+
+func TestMetricsPathLabels(t *testing.T) {
+	container1 := createDummyContainerRaw(t, `
+	{
+		"endpoints": [
+		  {
+			"domain": "metrics.example.com",
+			"path": "/api/*",
+			"rules": []
+		  }
+		]
+	}
+	`)
+
+	handler, url := createBakerServer(t)
+
+	var driver baker.Driver
+
+	handler.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	if err := makeCall(url, "/api/users/42", "metrics.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"metrics.example.com", "scanner.example.com"} {
+		req, err := http.NewRequest(http.MethodGet, url+"/wp-admin/setup.php", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.SetupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`baker_http_request_count{code="200",domain="metrics.example.com",method="GET",path="/api/*"} 1`,
+		`baker_http_request_count{code="404",domain="unmatched",method="GET",path="unmatched"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %s", want)
+		}
+	}
+
+	for _, unwanted := range []string{"/api/users/42", "/wp-admin", "scanner.example.com"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("expected metrics not to contain %s", unwanted)
+		}
+	}
+
+	driver.Remove(container1)
+
+	// Wait for the server to process the removal
+	time.Sleep(4 * time.Second)
+
+	rec = httptest.NewRecorder()
+	metrics.SetupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if strings.Contains(rec.Body.String(), `domain="metrics.example.com"`) {
+		t.Errorf("expected the metrics of the removed endpoint to be deleted")
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	container1 := createDummyContainerWithHandler(t, `
+	{
+		"endpoints": [
+		  {
+			"domain": "sizes.example.com",
+			"path": "/upload",
+			"rules": []
+		  },
+		  {
+			"domain": "sizes.example.com",
+			"path": "/ws",
+			"rules": []
+		  }
+		]
+	}
+	`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			conn, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.CloseNow()
+
+			// echo a single message
+			msgType, msg, err := conn.Read(r.Context())
+			if err != nil {
+				return
+			}
+			conn.Write(r.Context(), msgType, msg)
+			conn.Read(r.Context())
+			return
+		}
+
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(strings.Repeat("a", 2000)))
+	}))
+
+	handler, url := createBakerServer(t)
+
+	var driver baker.Driver
+
+	handler.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	req, err := http.NewRequest(http.MethodPost, url+"/upload", strings.NewReader(strings.Repeat("b", 500)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "sizes.example.com"
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, strings.Replace(url, "http://", "ws://", 1)+"/ws", &websocket.DialOptions{
+		Host: "sizes.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Write(ctx, websocket.MessageText, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, msg, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "ping" {
+		t.Fatalf("expected ping, got %s", msg)
+	}
+
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	// wait for baker to close both sides of the connection
+	time.Sleep(500 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	metrics.SetupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		// the duration is recorded in seconds, not nanoseconds
+		`baker_http_request_duration_seconds_bucket{code="200",domain="sizes.example.com",method="POST",path="/upload",le="1"} 1`,
+		`baker_http_request_size_bytes_sum{domain="sizes.example.com",method="POST",path="/upload"} 500`,
+		`baker_http_response_size_bytes_sum{code="200",domain="sizes.example.com",method="POST",path="/upload"} 2000`,
+		`baker_http_requests_in_flight 0`,
+		`baker_websocket_message_count{direction="inbound",domain="sizes.example.com",path="/ws"} 1`,
+		`baker_websocket_message_count{direction="outbound",domain="sizes.example.com",path="/ws"} 1`,
+		`baker_websocket_connection_duration_seconds_count{domain="sizes.example.com",path="/ws"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %s", want)
+		}
+	}
+}
+
+func TestControlPlaneMetrics(t *testing.T) {
+	container1 := createDummyContainer(t, &baker.Config{
+		Endpoints: []baker.Endpoint{
+			{
+				Domain: "control.example.com",
+				Path:   "/api/*",
+				Rules: []baker.Rule{
+					{
+						Type: "RateLimiter",
+						Args: json.RawMessage(`{"request_limit":10,"window_duration":"3s"}`),
+					},
+				},
+			},
+			{
+				Domain: "control.example.com",
+				Path:   "/static/*",
+				Rules:  []baker.Rule{},
+			},
+		},
+	})
+
+	handler, url := createBakerServer(t)
+
+	var driver baker.Driver
+
+	handler.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	if err := makeCall(url, "/api/users", "control.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		metrics.SetupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	body := scrape()
+	for _, want := range []string{
+		"baker_domains 1\n",
+		"baker_paths 2\n",
+		"baker_containers 1\n",
+		"baker_middleware_cache_size 1\n",
+		`baker_runner_event_duration_seconds_count{event="get"}`,
+		`baker_runner_event_duration_seconds_count{event="update"}`,
+		"baker_runner_queue_depth",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+
+	driver.Remove(container1)
+	time.Sleep(100 * time.Millisecond)
+
+	body = scrape()
+	for _, want := range []string{
+		"baker_domains 0\n",
+		"baker_paths 0\n",
+		"baker_containers 0\n",
+		"baker_middleware_cache_size 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q after the container is removed", want)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+
+	container1 := createDummyContainerWithHandler(t, `
+	{
+		"endpoints": [
+		  {
+			"domain": "shutdown.example.com",
+			"path": "/*",
+			"rules": []
+		  }
+		]
+	}
+	`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			conn, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.CloseNow()
+
+			for {
+				if _, _, err := conn.Read(r.Context()); err != nil {
+					return
+				}
+			}
+		}
+
+		<-release
+		w.Write([]byte("done"))
+	}))
+
+	handler, url := createBakerServer(t)
+
+	var driver baker.Driver
+
+	handler.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wsURL := strings.Replace(url, "http://", "ws://", 1) + "/ws"
+
+	conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{Host: "shutdown.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+
+	// a request which is still in flight when the shutdown starts
+	slow := make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, url+"/slow", nil)
+		req.Host = "shutdown.example.com"
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- handler.Shutdown(ctx)
+	}()
+
+	// the client is told that the server is going away
+	_, _, err = conn.Read(ctx)
+	if status := websocket.CloseStatus(err); status != websocket.StatusGoingAway {
+		t.Fatalf("expected going away close status, got %v", err)
+	}
+
+	// new websocket connections are refused while draining
+	_, resp, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{Host: "shutdown.example.com"})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the websocket to be refused, got %v", err)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the in-flight request finished: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+
+	if body := <-slow; body != "done" {
+		t.Fatalf("expected the in-flight request to finish, got %s", body)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	release := make(chan struct{})
+
+	container1 := createDummyContainerWithHandler(t, `
+	{
+		"endpoints": [
+		  {
+			"domain": "deadline.example.com",
+			"path": "/*",
+			"rules": []
+		  }
+		]
+	}
+	`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	handler, url := createBakerServer(t)
+
+	// the servers wait for the request to finish when they are closed
+	t.Cleanup(func() { close(release) })
+
+	var driver baker.Driver
+
+	handler.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	go makeCall(url, "/slow", "deadline.example.com")
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := handler.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestContainerDrain(t *testing.T) {
+	release := make(chan struct{})
+
+	container1 := createDummyContainerWithHandler(t, `
+	{
+		"endpoints": [
+		  {
+			"domain": "drain.example.com",
+			"path": "/*",
+			"rules": []
+		  }
+		]
+	}
+	`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ws":
+			conn, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.CloseNow()
+
+			for {
+				if _, _, err := conn.Read(r.Context()); err != nil {
+					return
+				}
+			}
+		case "/slow":
+			<-release
+		}
+
+		w.Write([]byte("done"))
+	}))
+
+	handler := baker.NewServer(
+		baker.WithPingDuration(2*time.Second),
+		baker.WithContainerDrainTimeout(time.Second),
+	)
+	server := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		handler.Close()
+		server.Close()
+	})
+
+	var driver baker.Driver
+
+	handler.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, strings.Replace(server.URL, "http://", "ws://", 1)+"/ws", &websocket.DialOptions{
+		Host: "drain.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+
+	slow := make(chan error, 1)
+	go func() {
+		slow <- makeCall(server.URL, "/slow", "drain.example.com")
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	driver.(baker.Drainer).Drain(&baker.Container{Id: container1.Id})
+	time.Sleep(100 * time.Millisecond)
+
+	// a draining container doesn't receive new requests
+	if err := makeCall(server.URL, "/", "drain.example.com"); err == nil {
+		t.Fatal("expected the draining container not to receive new requests")
+	}
+
+	// but its in-flight requests are allowed to finish
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatalf("expected the in-flight request to finish, got %v", err)
+	}
+
+	// the websocket is closed once the drain timeout is reached
+	start := time.Now()
+	_, _, err = conn.Read(ctx)
+	if status := websocket.CloseStatus(err); status != websocket.StatusGoingAway {
+		t.Fatalf("expected going away close status, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("expected the websocket to stay open until the drain timeout, closed after %s", elapsed)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	metrics.SetupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "baker_containers 0\n") {
+		t.Error("expected the drained container to be removed")
+	}
+}
+
+func TestStaticRules(t *testing.T) {
+	paths := make(chan string, 1)
+
+	// a static container doesn't expose a config endpoint
+	container1 := createDummyContainerWithHandler(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}))
+	container1.Meta.Static.Domain = "static.example.com"
+	container1.Meta.Static.Path = "/api/*"
+	container1.Meta.Static.Rules = []baker.Rule{
+		{
+			Type: "ReplacePath",
+			Args: json.RawMessage(`{"search":"/api","replace":"","times":1}`),
+		},
+	}
+
+	server, url := createBakerServer(t)
+
+	var driver baker.Driver
+
+	server.RegisterDriver(func(d baker.Driver) {
+		driver = d
+	})
+
+	driver.Add(container1)
+
+	// Wait for the server to process the container
+	time.Sleep(4 * time.Second)
+
+	if err := makeCall(url, "/api/users", "static.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if path := <-paths; path != "/users" {
+		t.Fatalf("expected the rules of the static container to rewrite the path, got %s", path)
+	}
+}
+
 func makeCall(url, path, host string) error {
 	req, err := http.NewRequest(http.MethodGet, url+path, nil)
 	if err != nil {
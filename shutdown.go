@@ -0,0 +1,106 @@
+package baker
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// drainReportInterval is how often the progress of the shutdown is logged
+const drainReportInterval = time.Second
+
+// websocketSet keeps the open websocket connections of the clients,
+// they are hijacked so http.Server.Shutdown doesn't wait for them
+type websocketSet struct {
+	mu      sync.Mutex
+	conns   map[*websocket.Conn]struct{}
+	closing bool
+}
+
+func (w *websocketSet) add(conn *websocket.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.conns[conn] = struct{}{}
+
+	// the connection was accepted while closeAll was running
+	if w.closing {
+		go closeGoingAway(conn)
+	}
+}
+
+func (w *websocketSet) remove(conn *websocket.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.conns, conn)
+}
+
+func (w *websocketSet) len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.conns)
+}
+
+// closeAll sends a going away close frame to every client
+func (w *websocketSet) closeAll() {
+	w.mu.Lock()
+	w.closing = true
+	conns := make([]*websocket.Conn, 0, len(w.conns))
+	for conn := range w.conns {
+		conns = append(conns, conn)
+	}
+	w.mu.Unlock()
+
+	for _, conn := range conns {
+		go closeGoingAway(conn)
+	}
+}
+
+func closeGoingAway(conn *websocket.Conn) {
+	conn.Close(websocket.StatusGoingAway, "server is shutting down")
+}
+
+// isDraining returns true once Shutdown has been called
+func (s *Server) isDraining() bool {
+	return s.draining.Load()
+}
+
+// Shutdown drains the server: new websocket connections are refused, the open ones
+// are closed with a going away close frame, and it waits for the in-flight requests
+// to finish before stopping the server. If ctx is done first, the remaining requests are
+// left behind and ctx's error is returned. The listeners must be closed by the caller,
+// e.g. with http.Server.Shutdown, which also closes the idle keep-alive connections.
+func (s *Server) Shutdown(ctx context.Context) error {
+	defer s.Close()
+
+	s.draining.Store(true)
+	s.websockets.closeAll()
+
+	ticker := time.NewTicker(drainReportInterval)
+	defer ticker.Stop()
+
+	poll := time.NewTicker(10 * time.Millisecond)
+	defer poll.Stop()
+
+	for {
+		requests := s.inflight.Load()
+		if requests == 0 {
+			slog.Info("server drained")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Warn("server shutdown deadline reached", "requests", requests, "websockets", s.websockets.len())
+			return ctx.Err()
+		case <-ticker.C:
+			slog.Info("draining server", "requests", requests, "websockets", s.websockets.len())
+		case <-poll.C:
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package baker
+
+import (
+	"net/http"
+
+	"ella.to/baker/internal/requestid"
+	"ella.to/baker/internal/tracing"
+	"ella.to/baker/rule"
+)
+
+// startServerSpan starts the span covering the whole request, it continues
+// the trace of the client if the request has a valid traceparent header
+func (s *Server) startServerSpan(r *http.Request) (*http.Request, *tracing.Span) {
+	ctx := s.tracer.Extract(r.Context(), r.Header)
+
+	ctx, span := s.tracer.Start(ctx, r.Method, tracing.KindServer,
+		tracing.String("http.request.method", r.Method),
+		tracing.String("server.address", r.Host),
+		tracing.String("url.path", r.URL.Path),
+		tracing.String("client.address", r.RemoteAddr),
+		tracing.String("user_agent.original", r.UserAgent()),
+	)
+
+	if id := requestid.FromContext(r.Context()); id != "" {
+		span.SetAttributes(tracing.String("baker.request_id", id))
+	}
+
+	return r.WithContext(ctx), span
+}
+
+func endServerSpan(span *tracing.Span, tw *trackResponseWriter) {
+	span.SetAttributes(tracing.Int("http.response.status_code", tw.statusCode))
+	if tw.statusCode >= 500 {
+		span.SetStatus(tracing.StatusError, http.StatusText(tw.statusCode))
+	}
+	span.End()
+}
+
+// tracedMiddleware creates a span for the rule, which covers the rule
+// and everything after it, including the call to the container
+type tracedMiddleware struct {
+	rule.Middleware
+	name   string
+	tracer *tracing.Tracer
+}
+
+func (m *tracedMiddleware) Process(next http.Handler) http.Handler {
+	h := m.Middleware.Process(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := m.tracer.Start(r.Context(), "rule "+m.name, tracing.KindInternal)
+		defer span.End()
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// traceMiddlewares wraps every middleware of the endpoint in a span
+func (s *Server) traceMiddlewares(endpoint *Endpoint, middlewares []rule.Middleware) []rule.Middleware {
+	if s.tracer == nil || len(middlewares) != len(endpoint.Rules) {
+		return middlewares
+	}
+
+	traced := make([]rule.Middleware, len(middlewares))
+	for i, middleware := range middlewares {
+		traced[i] = &tracedMiddleware{
+			Middleware: middleware,
+			name:       endpoint.Rules[i].Type,
+			tracer:     s.tracer,
+		}
+	}
+
+	return traced
+}
+
+// tracingTransport creates a client span for every request sent to a container,
+// and passes the trace to the container with the traceparent header
+type tracingTransport struct {
+	base   http.RoundTripper
+	tracer *tracing.Tracer
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.tracer.Start(req.Context(), req.Method, tracing.KindClient,
+		tracing.String("http.request.method", req.Method),
+		tracing.String("server.address", req.URL.Host),
+		tracing.String("url.full", req.URL.String()),
+	)
+	defer span.End()
+
+	// a RoundTripper must not modify the request
+	req = req.WithContext(ctx)
+	req.Header = req.Header.Clone()
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(tracing.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(tracing.StatusError, http.StatusText(resp.StatusCode))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,78 @@
+package baker
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"ella.to/baker/internal/metrics"
+)
+
+// metricsTransport records the metrics of the requests sent to a container
+type metricsTransport struct {
+	base        http.RoundTripper
+	containerID string
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	metrics.UpstreamRequestStart(t.containerID)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		if isDialError(err) {
+			metrics.UpstreamDialError(t.containerID)
+		}
+		metrics.UpstreamRequestEnd(t.containerID, 0)
+		return nil, err
+	}
+
+	metrics.UpstreamTTFB(t.containerID, time.Since(start).Seconds())
+
+	// the body of a protocol switch is the connection itself, and must stay writable
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		metrics.UpstreamRequestEnd(t.containerID, resp.StatusCode)
+		return resp, nil
+	}
+
+	// the request is done once the proxy has copied and closed the body
+	resp.Body = &upstreamBody{
+		ReadCloser: resp.Body,
+		done: func() {
+			metrics.UpstreamDuration(t.containerID, time.Since(start).Seconds())
+			metrics.UpstreamRequestEnd(t.containerID, resp.StatusCode)
+		},
+	}
+
+	return resp, nil
+}
+
+type upstreamBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// upstreamTransport returns the transport used to forward the requests to the container
+func (s *Server) upstreamTransport(container *Container) http.RoundTripper {
+	var transport http.RoundTripper = s.transport
+	if s.tracer != nil {
+		transport = &tracingTransport{base: transport, tracer: s.tracer}
+	}
+
+	return &metricsTransport{base: transport, containerID: container.Id}
+}